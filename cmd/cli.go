@@ -1,13 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/ctl"
 	"github.com/nimatrueway/unbound-ssh/internal/view"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	"github.com/ztrue/tracerr"
 	"os"
+	"path/filepath"
 	"runtime/debug"
 )
 
@@ -22,11 +25,19 @@ var RootFlags struct {
 	Config string
 }
 
+var ListenFlags internal.ListenOptions
+
+var SpyFlags struct {
+	Hop string
+}
+
 var ListenCmd = &cobra.Command{
-	Use:   "listen <ssh command> <...ssh args>",
+	Use:   "listen [ssh command] [...ssh args]",
 	Short: "Run in listen mode and tap into the remote session stdin/stdout launched by <ssh command>",
-	Long:  ``,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Run in listen mode and tap into the remote session stdin/stdout launched by <ssh command>, plus every session
+defined as [[session]] in the config file. Only one session is shown on the terminal at a time, use "ctl" to switch.
+With --headless the terminal is left alone and spy mode is launched as soon as the shell prompts.`,
+	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		err := Listen(args)
 
@@ -37,11 +48,14 @@ var ListenCmd = &cobra.Command{
 }
 
 var SpyCmd = &cobra.Command{
-	Use:   "spy",
+	Use:   "spy [relay command] [...relay args]",
 	Short: "Run in spy mode on the remote server and connects to the instance that is running in listen mode on the other side.",
-	Long:  ``,
+	Long: `Run in spy mode on the remote server and connects to the instance that is running in listen mode on the other side.
+If a relay command is given (e.g. ssh -tt next-server ./unbound-ssh spy --hop next) spy mode runs it and acts as the
+listen mode of the next hop, so that services of further hops are reachable too.`,
+	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		err := Spy()
+		err := Spy(args)
 
 		if err != nil {
 			view.AppendRaw(tracerr.SprintSource(err))
@@ -50,13 +64,75 @@ var SpyCmd = &cobra.Command{
 	},
 }
 
+var CtlCmd = &cobra.Command{
+	Use:   "ctl <command> [...args]",
+	Short: "Manage the sessions of the running listen mode, commands: \"list\", \"switch <session>\", \"upload <path> [session]\", \"download <path> [session]\", \"uninstall [session]\"",
+	Long:  ``,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := Ctl(args)
+
+		if err != nil {
+			tracerr.PrintSourceColor(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var PutCmd = &cobra.Command{
+	Use:   "put <file>",
+	Short: "Send a file of the server to the download directory of listen mode, through the spy mode that runs in the same directory",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := Files(internal.Put, args[0]); err != nil {
+			tracerr.PrintSourceColor(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var GetCmd = &cobra.Command{
+	Use:   "get <file>",
+	Short: "Fetch a file of the upload directory of listen mode into the working directory, through the spy mode that runs in the same directory",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := Files(internal.Get, args[0]); err != nil {
+			tracerr.PrintSourceColor(err)
+			os.Exit(1)
+		}
+	},
+}
+
+var BundleCmd = &cobra.Command{
+	Use:   "bundle [binary...]",
+	Short: "Fill the binary cache that preflight uploads from, for servers and laptops without internet access",
+	Long: `Fill the binary cache that preflight uploads from: preflight.binary_dir if it is set, otherwise a directory under
+the cache directory of the user. Without arguments the latest release of every platform is downloaded from GitHub,
+otherwise the given binaries (e.g. internal builds named like unbound-ssh_linux_amd64) are copied into it. Every binary
+is listed with its sha256 in the SHA256SUMS file of the directory.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := Bundle(args); err != nil {
+			tracerr.PrintSourceColor(err)
+			os.Exit(1)
+		}
+	},
+}
+
 func init() {
 	// shared flags
-	for _, fs := range []*pflag.FlagSet{ListenCmd.Flags(), SpyCmd.Flags()} {
+	for _, fs := range []*pflag.FlagSet{ListenCmd.Flags(), SpyCmd.Flags(), CtlCmd.Flags(), PutCmd.Flags(), GetCmd.Flags(), BundleCmd.Flags()} {
 		fs.StringVarP(&RootFlags.Config, "config", "c", "config.toml", "config file")
 	}
+	ListenCmd.Flags().BoolVar(&ListenFlags.Headless, "headless", false, "leave the terminal alone and launch spy-mode as soon as the shell prompts, to run as a background tunnel")
+	ListenCmd.Flags().BoolVar(&ListenFlags.Auto, "auto", false, "run the preflight script and launch spy-mode as soon as the shell prompts for the first time")
+	ListenCmd.Flags().StringVar(&ListenFlags.Stdio, "stdio", "", "pipe stdin/stdout to the service bound to this address once it is up (implies --headless), e.g. to act as ProxyCommand of ssh")
+	SpyCmd.Flags().StringVar(&SpyFlags.Hop, "hop", "", "name of this hop, it serves the services of the same hop")
 	RootCmd.AddCommand(ListenCmd)
 	RootCmd.AddCommand(SpyCmd)
+	RootCmd.AddCommand(CtlCmd)
+	RootCmd.AddCommand(PutCmd)
+	RootCmd.AddCommand(GetCmd)
+	RootCmd.AddCommand(BundleCmd)
 	RootCmd.Version = config.Version
 }
 
@@ -65,11 +141,15 @@ func Listen(cmd []string) error {
 	if err := configure(RootFlags.Config); err != nil {
 		return err
 	}
+	// listen-mode creates the secret on its first run, preflight uploads it to spy-mode
+	if err := config.Config.LoadSecret(true); err != nil {
+		return err
+	}
 
-	return internal.Listen(cmd)
+	return internal.Listen(cmd, ListenFlags)
 }
 
-func Spy() error {
+func Spy(relayCmd []string) error {
 	defer func() {
 		// because spy-mode can not dump its error on stdout
 		// stdin/stdout is to be used for communication with listen-mode
@@ -86,8 +166,57 @@ func Spy() error {
 	if err := configure(RootFlags.Config); err != nil {
 		return err
 	}
+	if err := config.Config.LoadSecret(false); err != nil {
+		return err
+	}
+
+	return internal.Spy(SpyFlags.Hop, relayCmd)
+}
+
+func Ctl(args []string) error {
+	config.Mode = "ctl"
+	if err := configure(RootFlags.Config); err != nil {
+		return err
+	}
+
+	// listen-mode may run in another directory
+	if args[0] == "upload" && len(args) > 1 {
+		if path, err := filepath.Abs(args[1]); err == nil {
+			args[1] = path
+		}
+	}
+
+	res, err := ctl.Send(config.ProcessString(config.Config.Ctl.Socket), ctl.Request{Command: args[0], Args: args[1:]})
+	if err != nil {
+		return err
+	}
+	if res.Output != "" {
+		fmt.Println(res.Output)
+	}
+	if res.Error != "" {
+		// a plain message is enough, the error did not happen in this process
+		_, _ = fmt.Fprintln(os.Stderr, res.Error)
+		os.Exit(1)
+	}
+	return nil
+}
+
+func Files(transfer func(string) error, file string) error {
+	config.Mode = "files"
+	if err := configure(RootFlags.Config); err != nil {
+		return err
+	}
+
+	return transfer(file)
+}
+
+func Bundle(binaries []string) error {
+	config.Mode = "bundle"
+	if err := configure(RootFlags.Config); err != nil {
+		return err
+	}
 
-	return internal.Spy()
+	return internal.Bundle(binaries)
 }
 
 func configure(file string) error {
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/release"
+	"github.com/ztrue/tracerr"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Bundle fills the binary cache of preflight, with the given binaries or else the latest release of every target
+func Bundle(binaries []string) error {
+	cache, err := release.OpenCache()
+	if err != nil {
+		return err
+	}
+
+	if len(binaries) == 0 {
+		for _, target := range release.Targets {
+			path, err := cache.Fetch(release.BinaryName(target))
+			if err != nil {
+				return err
+			}
+			fmt.Println(path)
+		}
+		return nil
+	}
+
+	for _, binary := range binaries {
+		path, err := addToCache(cache, binary)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
+
+// addToCache copies a local build into the cache, its name tells the target that preflight picks it for
+func addToCache(cache *release.Cache, binary string) (string, error) {
+	name := filepath.Base(binary)
+	names := make([]string, len(release.Targets))
+	for i, target := range release.Targets {
+		names[i] = release.BinaryName(target)
+	}
+	if !slices.Contains(names, name) {
+		return "", tracerr.Errorf("%s is not named after a target, expected one of %v", binary, names)
+	}
+
+	f, err := os.Open(binary)
+	if err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return cache.Add(name, f)
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -18,33 +20,117 @@ var Mode string
 
 var Version string
 
+// Secret is the per-installation key that listen-mode and spy-mode use to authenticate each other
+var Secret []byte
+
 var Config Struct
 
 type ServiceDescription struct {
 	Type        ServiceType `toml:"type"`
 	Bind        Address     `toml:"bind"`
-	Certificate string      `toml:"certificate,omitempty"`
+	Certificate string      `toml:"certificate,omitempty" secret:"true"`
 	Destination Address     `toml:"destination,omitempty"`
+	Session     string      `toml:"session,omitempty"`
+	Hop         string      `toml:"hop,omitempty"`
+}
+
+// DefaultSession is the name of the session that runs the command given to listen-mode on the command line
+const DefaultSession = "default"
+
+type SessionDescription struct {
+	Name    string      `toml:"name"`
+	Command []string    `toml:"command"`
+	Login   []LoginStep `toml:"login,omitempty"`
+}
+
+// LoginStep waits for the output of the shell to match Expect, then types one of Send, SendEnv or SendCommand
+type LoginStep struct {
+	Expect Pattern `toml:"expect"`
+	// Send is typed as is, include "\r" to press enter
+	Send string `toml:"send,omitempty" secret:"true"`
+	// SendEnv names an environment variable whose value is typed followed by enter, e.g. a password
+	SendEnv string `toml:"send_env,omitempty"`
+	// SendCommand is run locally and its output is typed followed by enter, e.g. a password manager or an otp generator
+	SendCommand []string `toml:"send_command,omitempty"`
+	// Timeout aborts the script if Expect does not match in time, zero waits indefinitely
+	Timeout time.Duration `toml:"timeout,omitempty"`
+}
+
+// PreflightStep is run by preflight once it has uploaded unbound-ssh and its files, in the directory it uploaded them to
+type PreflightStep struct {
+	Type PreflightStepType `toml:"type"`
+	// Source is the local file that an upload step sends, its permission bits are kept
+	Source string `toml:"source,omitempty"`
+	// Path is where an upload step writes the file, or the directory that a mkdir step creates
+	Path string `toml:"path,omitempty"`
+	// Command is what a run step executes, it fails unless the command exits with ExitCode
+	Command  string        `toml:"command,omitempty"`
+	ExitCode int           `toml:"exit_code,omitempty"`
+	Timeout  time.Duration `toml:"timeout,omitempty"`
+	// Name and Value are the environment variable that an env step exports into the shell
+	Name  string `toml:"name,omitempty"`
+	Value string `toml:"value,omitempty"`
+}
+
+// the tables that listen-mode and spy-mode share, see SpyStruct
+
+type TransferConfig struct {
+	Codec                   CodecType        `default:"hex" toml:"codec"`
+	Transport               TransportType    `default:"auto" toml:"transport"`
+	SignatureDetectorBuffer units.Base2Bytes `default:"10240" toml:"signature_detector_buffer"`
+	Buffer                  units.Base2Bytes `default:"65536" toml:"buffer"`
+	ConnectionTimeout       time.Duration    `default:"10s" toml:"connection_timeout"`
+	RequestTimeout          time.Duration    `default:"10s" toml:"request_timeout"`
+}
+
+type AuthConfig struct {
+	SecretFile string `default:"unbound_ssh.secret" toml:"secret_file" secret:"true"`
+}
+
+type LogConfig struct {
+	File  string       `default:"unbound_ssh_$(mode).log" toml:"file"`
+	Level logrus.Level `default:"4" toml:"level"`
 }
 
 type Struct struct {
 	Preflight struct {
-		UploadCodec      PreflightUploadCodec `default:"auto" toml:"upload_codec"`
-		UploadChunkSize  units.Base2Bytes     `default:"65536" toml:"upload_chunk_size"`
-		AssumeNoInternet bool                 `default:"false" toml:"assume_no_internet"`
-		CommandTimeout   time.Duration        `default:"10s" toml:"command_timeout"`
-	}
-	Transfer struct {
-		Codec                   CodecType        `default:"hex" toml:"codec"`
-		SignatureDetectorBuffer units.Base2Bytes `default:"10240" toml:"signature_detector_buffer"`
-		Buffer                  units.Base2Bytes `default:"65536" toml:"buffer"`
-		ConnectionTimeout       time.Duration    `default:"10s" toml:"connection_timeout"`
-		RequestTimeout          time.Duration    `default:"10s" toml:"request_timeout"`
-	}
-	Log struct {
-		File  string       `default:"unbound_ssh_$(mode).log" toml:"file"`
-		Level logrus.Level `default:"4" toml:"level"`
+		UploadCodec      PreflightUploadCodec  `default:"auto" toml:"upload_codec"`
+		UploadMethod     PreflightUploadMethod `default:"auto" toml:"upload_method"`
+		UploadChunkSize  units.Base2Bytes      `default:"65536" toml:"upload_chunk_size"`
+		AssumeNoInternet bool                  `default:"false" toml:"assume_no_internet"`
+		CommandTimeout   time.Duration         `default:"10s" toml:"command_timeout"`
+		BinaryDir        string                `default:"" toml:"binary_dir"`
+		InstallDir       string                `default:"" toml:"install_dir"`
+		Step             []PreflightStep       `toml:"step"`
+	}
+	Transfer TransferConfig
+	Auth     AuthConfig
+	Ctl      struct {
+		Socket string `default:"unbound_ssh.sock" toml:"socket"`
+	}
+	Files struct {
+		Socket      string `default:"unbound_ssh_files.sock" toml:"socket"`
+		DownloadDir string `default:"" toml:"download_dir"`
+		UploadDir   string `default:"" toml:"upload_dir"`
+	}
+	Keys struct {
+		Preflight  KeySequence `default:"^G^G^G" toml:"preflight"`
+		ConnectNow KeySequence `default:"" toml:"connect_now"`
+		Status     KeySequence `default:"" toml:"status"`
+		Upload     KeySequence `default:"" toml:"upload"`
+		Download   KeySequence `default:"" toml:"download"`
+		Uninstall  KeySequence `default:"" toml:"uninstall"`
+		Disconnect KeySequence `default:"^C" toml:"disconnect"`
+		Cancel     KeySequence `default:"^C" toml:"cancel"`
 	}
+	Launch struct {
+		Prompt        Pattern       `default:"(?:^|\\n)[^\\r\\n]*[$#%>] ?$" toml:"prompt"`
+		Command       string        `default:"./unbound-ssh spy" toml:"command"`
+		RetryInterval time.Duration `default:"5s" toml:"retry_interval"`
+	}
+	Log     LogConfig
+	Login   []LoginStep          `toml:"login"`
+	Session []SessionDescription `toml:"session"`
 	Service []ServiceDescription `toml:"service"`
 }
 
@@ -72,6 +158,51 @@ func (s *PreflightUploadCodec) UnmarshalText(text []byte) error {
 
 // ---------------------------------------------------------------------------
 
+// PreflightUploadMethod is the command that writes the chunks of an upload on the server
+type PreflightUploadMethod string
+
+const (
+	AutoUploadMethod PreflightUploadMethod = "auto"
+	Dd               PreflightUploadMethod = "dd"
+	Head             PreflightUploadMethod = "head"
+	Python3          PreflightUploadMethod = "python3"
+	Printf           PreflightUploadMethod = "printf"
+)
+
+func (s *PreflightUploadMethod) UnmarshalText(text []byte) error {
+	validValues := []PreflightUploadMethod{AutoUploadMethod, Dd, Head, Python3, Printf}
+	method := PreflightUploadMethod(text)
+	if !lo.Contains(validValues, method) {
+		return fmt.Errorf("invalid preflight upload method: %s", text)
+	}
+	*s = method
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+// PreflightStepType is what a preflight step does
+type PreflightStepType string
+
+const (
+	UploadStep PreflightStepType = "upload"
+	RunStep    PreflightStepType = "run"
+	EnvStep    PreflightStepType = "env"
+	MkdirStep  PreflightStepType = "mkdir"
+)
+
+func (s *PreflightStepType) UnmarshalText(text []byte) error {
+	validValues := []PreflightStepType{UploadStep, RunStep, EnvStep, MkdirStep}
+	stepType := PreflightStepType(text)
+	if !lo.Contains(validValues, stepType) {
+		return fmt.Errorf("invalid preflight step type: %s", text)
+	}
+	*s = stepType
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
 type CodecType string
 
 const (
@@ -91,17 +222,57 @@ func (s *CodecType) UnmarshalText(text []byte) error {
 
 // ---------------------------------------------------------------------------
 
+// TransportType is how spy-mode gets its output to listen-mode past a terminal multiplexer it runs in
+type TransportType string
+
+const (
+	AutoDetect TransportType = "auto"
+	Raw        TransportType = "raw"
+	Tmux       TransportType = "tmux"
+	Screen     TransportType = "screen"
+)
+
+func (s *TransportType) UnmarshalText(text []byte) error {
+	validValues := []TransportType{AutoDetect, Raw, Tmux, Screen}
+	transportType := TransportType(text)
+	if !lo.Contains(validValues, transportType) {
+		return fmt.Errorf("invalid transport: %s", text)
+	}
+	*s = TransportType(text)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+
+// Pattern is a regular expression that is matched against the output of the shell
+type Pattern string
+
+func (p *Pattern) UnmarshalText(text []byte) error {
+	if _, err := regexp.Compile(string(text)); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", text, err)
+	}
+	*p = Pattern(text)
+	return nil
+}
+
+func (p Pattern) Regexp() *regexp.Regexp {
+	return regexp.MustCompile(string(p))
+}
+
+// ---------------------------------------------------------------------------
+
 type ServiceType string
 
 const (
 	EmbeddedWebdav ServiceType = "embedded_webdav"
 	EmbeddedSsh    ServiceType = "embedded_ssh"
 	PortForward    ServiceType = "port_forward"
+	DynamicForward ServiceType = "dynamic_forward"
 	Echo           ServiceType = "echo"
 )
 
 func (s *ServiceType) UnmarshalText(text []byte) error {
-	validValues := []ServiceType{EmbeddedWebdav, EmbeddedSsh, PortForward, Echo}
+	validValues := []ServiceType{EmbeddedWebdav, EmbeddedSsh, PortForward, DynamicForward, Echo}
 	serviceType := ServiceType(text)
 	if !lo.Contains(validValues, serviceType) {
 		return fmt.Errorf("invalid service type: %s", text)
@@ -173,10 +344,51 @@ func (s *Struct) LoadData(data string) error {
 	return err
 }
 
-func (s *Struct) Clone() *Struct {
-	clone := Struct{}
-	clone = Config
-	return &clone
+// LaunchCommand is the command that launches spy-mode, from Preflight.InstallDir if it is set.
+func (s *Struct) LaunchCommand() string {
+	if s.Preflight.InstallDir == "" {
+		return s.Launch.Command
+	}
+	return fmt.Sprintf("cd %s && %s", s.InstallDirArg(), s.Launch.Command)
+}
+
+// InstallDirArg is Preflight.InstallDir as a single word for the shell of the server. It is quoted, except for a
+// leading "~" that is typed as "$HOME", e.g. "~/my cache" becomes "$HOME"/'my cache'.
+func (s *Struct) InstallDirArg() string {
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	dir := s.Preflight.InstallDir
+	if dir == "~" {
+		return `"$HOME"`
+	}
+	if rest, ok := strings.CutPrefix(dir, "~/"); ok {
+		return `"$HOME"/` + quote(rest)
+	}
+	return quote(dir)
+}
+
+// Sessions lists the sessions that listen-mode runs, led by the one of the command line if cmd is not empty.
+func (s *Struct) Sessions(cmd []string) []SessionDescription {
+	sessions := make([]SessionDescription, 0, len(s.Session)+1)
+	if len(cmd) > 0 {
+		sessions = append(sessions, SessionDescription{Name: DefaultSession, Command: cmd, Login: s.Login})
+	}
+	return append(sessions, s.Session...)
+}
+
+// SessionServices is a copy of the services in which those that do not name a session are assigned to the first of
+// the given sessions. The config is left as is, so that spy-mode still serves them to whichever session connects.
+func (s *Struct) SessionServices(sessions []SessionDescription) []ServiceDescription {
+	services := slices.Clone(s.Service)
+	if len(sessions) > 0 {
+		for i := range services {
+			if services[i].Session == "" {
+				services[i].Session = sessions[0].Name
+			}
+		}
+	}
+	return services
 }
 
 func (s *Struct) SaveData() string {
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+)
+
+// KeySequence is written in caret notation, e.g. "^G^G^G" stands for pressing ctrl+g three times, other characters
+// stand for themselves. An empty sequence disables the action.
+type KeySequence string
+
+func (k *KeySequence) UnmarshalText(text []byte) error {
+	if _, err := KeySequence(text).parse(); err != nil {
+		return err
+	}
+	*k = KeySequence(text)
+	return nil
+}
+
+// Bytes is what the terminal sends when the sequence is pressed
+func (k KeySequence) Bytes() []byte {
+	keys, _ := k.parse()
+	return keys
+}
+
+func (k KeySequence) parse() ([]byte, error) {
+	keys := make([]byte, 0, len(k))
+	for i := 0; i < len(k); i++ {
+		if k[i] != '^' {
+			keys = append(keys, k[i])
+			continue
+		}
+		if i+1 == len(k) {
+			return nil, fmt.Errorf("invalid key sequence %q: ^ needs to be followed by a key", string(k))
+		}
+		i++
+		c := k[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c == '?' {
+			keys = append(keys, 0x7f)
+		} else if c >= '@' && c <= '_' {
+			keys = append(keys, c-'@')
+		} else {
+			return nil, fmt.Errorf("invalid key sequence %q: ^%c is not a control key", string(k), c)
+		}
+	}
+	return keys, nil
+}
+
+// KeyAction is what happens when its key sequence is pressed
+type KeyAction string
+
+const (
+	PreflightAction  KeyAction = "preflight"
+	ConnectNowAction KeyAction = "connect_now"
+	StatusAction     KeyAction = "status"
+	UploadAction     KeyAction = "upload"
+	DownloadAction   KeyAction = "download"
+	UninstallAction  KeyAction = "uninstall"
+	DisconnectAction KeyAction = "disconnect"
+	CancelAction     KeyAction = "cancel"
+)
+
+func (s *Struct) KeySequence(action KeyAction) KeySequence {
+	switch action {
+	case PreflightAction:
+		return s.Keys.Preflight
+	case ConnectNowAction:
+		return s.Keys.ConnectNow
+	case StatusAction:
+		return s.Keys.Status
+	case UploadAction:
+		return s.Keys.Upload
+	case DownloadAction:
+		return s.Keys.Download
+	case UninstallAction:
+		return s.Keys.Uninstall
+	case DisconnectAction:
+		return s.Keys.Disconnect
+	case CancelAction:
+		return s.Keys.Cancel
+	default:
+		panic("invalid key action")
+	}
+}
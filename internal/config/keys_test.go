@@ -0,0 +1,24 @@
+package config
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestKeySequence(t *testing.T) {
+	require.Equal(t, []byte{7, 7, 7}, KeySequence("^G^G^G").Bytes())
+	require.Equal(t, []byte{7, 'u'}, KeySequence("^gu").Bytes())
+	require.Equal(t, []byte{0x1b, 0x7f, 0x1e}, KeySequence("^[^?^^").Bytes())
+	require.Empty(t, KeySequence("").Bytes())
+
+	var k KeySequence
+	require.NoError(t, k.UnmarshalText([]byte("^T^T")))
+	require.Equal(t, KeySequence("^T^T"), k)
+	require.Error(t, k.UnmarshalText([]byte("^G^")))
+	require.Error(t, k.UnmarshalText([]byte("^1")))
+}
+
+func TestDefaultKeys(t *testing.T) {
+	require.Equal(t, []byte{7, 7, 7}, Config.KeySequence(PreflightAction).Bytes())
+	require.Equal(t, []byte{3}, Config.KeySequence(CancelAction).Bytes())
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+const secretLength = 32
+
+// LoadSecret reads the secret file into Secret, if create is set a new secret is generated when the file is missing
+func (s *Struct) LoadSecret(create bool) error {
+	file := ProcessString(s.Auth.SecretFile)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) && create {
+		secret := make([]byte, secretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(secret)), 0600); err != nil {
+			logrus.Errorf("error writing secret file %s: %s", file, err.Error())
+			return err
+		}
+		logrus.Info("generated a new secret in: ", file)
+		Secret = secret
+		return nil
+	} else if err != nil {
+		logrus.Errorf("error reading secret file %s: %s", file, err.Error())
+		return fmt.Errorf("secret file %s is not available, run preflight to upload it: %w", file, err)
+	}
+
+	secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) < secretLength {
+		return fmt.Errorf("secret file %s is corrupt, it needs %d hex encoded bytes", file, secretLength)
+	}
+	Secret = secret
+	return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// SpyStruct is the part of the config that spy-mode (and "unbound-ssh get/put" next to it) reads, preflight uploads it
+// in place of the local config so that the settings of listen-mode (e.g. the login scripts) stay on the laptop. It is
+// loaded into Struct on the server, with the defaults for everything that is left out.
+type SpyStruct struct {
+	Transfer TransferConfig
+	Auth     AuthConfig
+	Files    struct {
+		Socket string `toml:"socket"`
+	}
+	Log     LogConfig
+	Service []ServiceDescription `toml:"service"`
+}
+
+// spySecrets are the fields tagged as secret that spy-mode needs, by their key e.g. "service.certificate", any other
+// secret is scrubbed from the config of spy-mode
+var spySecrets = []string{"auth.secret_file", "service.certificate"}
+
+// SpyConfig is what spy-mode needs of the config
+func (s *Struct) SpyConfig() *SpyStruct {
+	spy := &SpyStruct{Transfer: s.Transfer, Auth: s.Auth, Log: s.Log, Service: slices.Clone(s.Service)}
+	spy.Files.Socket = s.Files.Socket
+	scrubSecrets(reflect.ValueOf(spy).Elem(), "")
+	return spy
+}
+
+func (s *SpyStruct) SaveData() string {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	if err := toml.NewEncoder(buf).Encode(s); err != nil {
+		logrus.Errorf("error saving toml config of spy-mode: %s", err.Error())
+		panic(err)
+	}
+	return buf.String()
+}
+
+// scrubSecrets zeroes the fields tagged as secret that are not in spySecrets
+func scrubSecrets(value reflect.Value, key string) {
+	switch value.Kind() {
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			fieldKey := strings.TrimPrefix(key+"."+name, ".")
+			if field.Tag.Get("secret") == "true" && !lo.Contains(spySecrets, fieldKey) {
+				logrus.Warnf("leaving the secret %s out of the config of spy-mode.", fieldKey)
+				value.Field(i).SetZero()
+				continue
+			}
+			scrubSecrets(value.Field(i), fieldKey)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			scrubSecrets(value.Index(i), key)
+		}
+	}
+}
+
+// SpyConfigDiff lists the keys of the local config that the config of spy-mode leaves out (-) or changes (~), the values
+// are not shown since they may be secrets
+func SpyConfigDiff(local string, spy string) ([]string, error) {
+	var localData, spyData map[string]any
+	if _, err := toml.Decode(local, &localData); err != nil {
+		return nil, err
+	}
+	if _, err := toml.Decode(spy, &spyData); err != nil {
+		return nil, err
+	}
+	localKeys, spyKeys := map[string]any{}, map[string]any{}
+	flattenKeys(localData, "", localKeys)
+	flattenKeys(spyData, "", spyKeys)
+
+	var diff []string
+	for key, value := range localKeys {
+		if spyValue, ok := spyKeys[key]; !ok {
+			diff = append(diff, "-"+key)
+		} else if !reflect.DeepEqual(value, spyValue) {
+			diff = append(diff, "~"+key)
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
+
+// flattenKeys collects the values of a decoded toml document by their lower cased dotted key, e.g. "service[0].bind"
+func flattenKeys(value any, key string, keys map[string]any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for name, child := range v {
+			flattenKeys(child, strings.TrimPrefix(key+"."+strings.ToLower(name), "."), keys)
+		}
+	case []map[string]any:
+		for i, child := range v {
+			flattenKeys(child, fmt.Sprintf("%s[%d]", key, i), keys)
+		}
+	default:
+		keys[key] = value
+	}
+}
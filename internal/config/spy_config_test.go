@@ -0,0 +1,106 @@
+package config
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSpyConfig(t *testing.T) {
+	defaultConfig, defaultMode := Config, Mode
+	t.Cleanup(func() {
+		Config, Mode = defaultConfig, defaultMode
+	})
+
+	dir := t.TempDir()
+	certificate, uploaded := filepath.Join(dir, "id_rsa"), filepath.Join(dir, "service0_certificate.pem")
+	require.NoError(t, os.WriteFile(certificate, []byte("key"), 0600))
+	require.NoError(t, os.WriteFile(uploaded, []byte("key"), 0600))
+	require.NoError(t, Config.LoadData(`
+[preflight]
+upload_codec = "base64"
+[transfer]
+request_timeout = "30s"
+[[login]]
+expect = "Password:"
+send = "hunter2\r"
+[[session]]
+name = "db"
+command = ["ssh", "db"]
+[[service]]
+type = "embedded_ssh"
+bind = "tcp://127.0.0.1:2222"
+certificate = "`+certificate+`"
+session = "db"
+`))
+
+	spy := Config.SpyConfig()
+	spy.Service[0].Certificate = uploaded
+	data := spy.SaveData()
+	require.NotContains(t, data, "hunter2")
+	require.NotContains(t, data, "upload_codec")
+	require.Equal(t, certificate, Config.Service[0].Certificate, "the local config is left as is")
+
+	diff, err := SpyConfigDiff(Config.SaveData(), data)
+	require.NoError(t, err)
+	require.Contains(t, diff, "-login[0].send")
+	require.Contains(t, diff, "-preflight.upload_codec")
+	require.Contains(t, diff, "-session[0].name")
+	require.Contains(t, diff, "~service[0].certificate")
+	require.NotContains(t, diff, "-transfer.request_timeout")
+
+	// spy-mode loads it without the sessions that its services refer to
+	Config, Mode = defaultConfig, "spy"
+	require.NoError(t, Config.LoadData(data))
+	require.Equal(t, "db", Config.Service[0].Session)
+	require.Equal(t, "30s", Config.Transfer.RequestTimeout.String())
+}
+
+func TestScrubSecrets(t *testing.T) {
+	conf := struct {
+		Auth    AuthConfig
+		Token   string               `toml:"token" secret:"true"`
+		Service []ServiceDescription `toml:"service"`
+	}{
+		Auth:    AuthConfig{SecretFile: "unbound_ssh.secret"},
+		Token:   "t0k3n",
+		Service: []ServiceDescription{{Certificate: "id_rsa"}},
+	}
+	scrubSecrets(reflect.ValueOf(&conf).Elem(), "")
+	require.Empty(t, conf.Token)
+	require.Equal(t, "unbound_ssh.secret", conf.Auth.SecretFile)
+	require.Equal(t, "id_rsa", conf.Service[0].Certificate)
+}
+
+func TestSessionServices(t *testing.T) {
+	defaultConfig, defaultMode := Config, Mode
+	t.Cleanup(func() {
+		Config, Mode = defaultConfig, defaultMode
+	})
+
+	require.NoError(t, Config.LoadData(`
+[[session]]
+name = "db"
+command = ["ssh", "db"]
+[[service]]
+type = "echo"
+bind = "tcp://127.0.0.1:7000"
+[[service]]
+type = "echo"
+bind = "tcp://127.0.0.1:7001"
+session = "db"
+`))
+
+	sessions := Config.Sessions([]string{"ssh", "web"})
+	require.Equal(t, []string{DefaultSession, "db"}, []string{sessions[0].Name, sessions[1].Name})
+	services := Config.SessionServices(sessions)
+	require.Equal(t, DefaultSession, services[0].Session)
+	require.Equal(t, "db", services[1].Session)
+	require.Equal(t, "db", Config.SessionServices(Config.Sessions(nil))[0].Session)
+
+	// the config is left as is, spy-mode serves the services that do not name a session to any session
+	require.Empty(t, Config.Service[0].Session)
+	require.Empty(t, Config.SpyConfig().Service[0].Session)
+}
@@ -4,12 +4,59 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 )
 
 func validateConfig() error {
+	transport := Config.Transfer.Transport
+	if (transport == Tmux || transport == Screen) && Config.Transfer.Codec != Hex {
+		return fmt.Errorf("config validation ['transfer.transport']: %s transport needs the hex codec", transport)
+	}
+
+	// the hotkeys of wiretap state are detected together, so they can not share a sequence
+	hotkeys := map[string]KeyAction{}
+	for _, action := range []KeyAction{PreflightAction, ConnectNowAction, StatusAction, UploadAction, DownloadAction, UninstallAction} {
+		keys := string(Config.KeySequence(action).Bytes())
+		if keys == "" {
+			continue
+		} else if other, ok := hotkeys[keys]; ok {
+			return fmt.Errorf("config validation ['keys.%s']: key sequence is already bound to %s", action, other)
+		}
+		hotkeys[keys] = action
+	}
+
+	if err := validatePreflightSteps(Config.Preflight.Step); err != nil {
+		return err
+	}
+
+	if err := validateLogin("login", Config.Login); err != nil {
+		return err
+	}
+
+	sessions := map[string]bool{DefaultSession: true}
+	for i, s := range Config.Session {
+		if s.Name == "" || s.Name == DefaultSession {
+			return fmt.Errorf("config validation ['session[%d].name']: session needs a name other than \"%s\"", i, DefaultSession)
+		} else if sessions[s.Name] {
+			return fmt.Errorf("config validation ['session[%d].name']: session name \"%s\" is used more than once", i, s.Name)
+		} else if len(s.Command) == 0 {
+			return fmt.Errorf("config validation ['session[%d].command']: session needs a command to run", i)
+		}
+		if err := validateLogin(fmt.Sprintf("session[%d].login", i), s.Login); err != nil {
+			return err
+		}
+		sessions[s.Name] = true
+	}
+
+	// the config that preflight uploads for spy-mode leaves out the sessions
+	serverSide := Mode == "spy" || Mode == "files"
 	for i, s := range Config.Service {
+		if s.Session != "" && !serverSide && !sessions[s.Session] {
+			return fmt.Errorf("config validation ['service[%d].session']: unknown session \"%s\"", i, s.Session)
+		}
+
 		if s.Type == EmbeddedSsh {
 			if stats, err := os.Stat(s.Certificate); stats == nil || stats.Size() == 0 || err != nil {
 				return fmt.Errorf("config validation ['service[%d].certificate']: embedded ssh needs an existant private key certificate file", i)
@@ -26,6 +73,55 @@ func validateConfig() error {
 	return nil
 }
 
+func validateLogin(key string, steps []LoginStep) error {
+	for i, step := range steps {
+		sends := 0
+		for _, set := range []bool{step.Send != "", step.SendEnv != "", len(step.SendCommand) > 0} {
+			if set {
+				sends++
+			}
+		}
+		if step.Expect == "" {
+			return fmt.Errorf("config validation ['%s[%d].expect']: login step needs a pattern to expect", key, i)
+		} else if sends > 1 {
+			return fmt.Errorf("config validation ['%s[%d]']: login step can only use one of send, send_env and send_command", key, i)
+		}
+	}
+	return nil
+}
+
+// envName is what POSIX shells take as the name of a variable
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validatePreflightSteps(steps []PreflightStep) error {
+	for i, step := range steps {
+		key := fmt.Sprintf("preflight.step[%d]", i)
+		switch step.Type {
+		case UploadStep:
+			if stats, err := os.Stat(step.Source); err != nil || !stats.Mode().IsRegular() {
+				return fmt.Errorf("config validation ['%s.source']: upload step needs an existent local file", key)
+			} else if step.Path == "" {
+				return fmt.Errorf("config validation ['%s.path']: upload step needs a path to write the file to", key)
+			}
+		case RunStep:
+			if step.Command == "" {
+				return fmt.Errorf("config validation ['%s.command']: run step needs a command", key)
+			}
+		case EnvStep:
+			if !envName.MatchString(step.Name) {
+				return fmt.Errorf("config validation ['%s.name']: env step needs a valid variable name", key)
+			}
+		case MkdirStep:
+			if step.Path == "" {
+				return fmt.Errorf("config validation ['%s.path']: mkdir step needs a path", key)
+			}
+		default:
+			return fmt.Errorf("config validation ['%s.type']: step needs a type of upload, run, env or mkdir", key)
+		}
+	}
+	return nil
+}
+
 func ProcessString(str string) string {
 	if strings.Contains(str, "$(time)") {
 		str = strings.ReplaceAll(str, "$(time)", time.Now().Format("2006-01-02-15-04-05"))
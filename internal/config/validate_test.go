@@ -0,0 +1,52 @@
+package config
+
+import (
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreflightSteps(t *testing.T) {
+	defaultConfig := Config
+	t.Cleanup(func() {
+		Config = defaultConfig
+	})
+
+	source := filepath.Join(t.TempDir(), "helper.sh")
+	require.NoError(t, os.WriteFile(source, []byte("#!/bin/sh\n"), 0755))
+
+	require.NoError(t, Config.LoadData(`
+[[preflight.step]]
+type = "mkdir"
+path = "bin"
+[[preflight.step]]
+type = "upload"
+source = "`+source+`"
+path = "bin/helper.sh"
+[[preflight.step]]
+type = "env"
+name = "PATH"
+value = "$PWD/bin:$PATH"
+[[preflight.step]]
+type = "run"
+command = "helper.sh --check"
+exit_code = 3
+timeout = "1m"
+`))
+	require.Len(t, Config.Preflight.Step, 4)
+	require.Equal(t, []PreflightStepType{MkdirStep, UploadStep, EnvStep, RunStep}, lo.Map(Config.Preflight.Step, func(step PreflightStep, _ int) PreflightStepType {
+		return step.Type
+	}))
+	require.Equal(t, 3, Config.Preflight.Step[3].ExitCode)
+
+	Config = defaultConfig
+	require.ErrorContains(t, Config.LoadData("[[preflight.step]]\ntype = \"copy\""), "invalid preflight step type")
+	Config = defaultConfig
+	require.ErrorContains(t, Config.LoadData("[[preflight.step]]\ntype = \"upload\"\nsource = \"missing.sh\"\npath = \"x\""), "preflight.step[0].source")
+	Config = defaultConfig
+	require.ErrorContains(t, Config.LoadData("[[preflight.step]]\ntype = \"env\"\nname = \"NOT-A-NAME\""), "preflight.step[0].name")
+	Config = defaultConfig
+	require.ErrorContains(t, Config.LoadData("[[preflight.step]]\ntype = \"run\""), "preflight.step[0].command")
+}
@@ -0,0 +1,165 @@
+package ctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ctl is a unix socket that listen-mode serves to be managed from other terminals, every request and response is a
+// single line of json.
+
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type Response struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Handler func(args []string) (string, error)
+
+type Server struct {
+	listener net.Listener
+	handlers map[string]Handler
+}
+
+func Listen(path string) (*Server, error) {
+	listener, err := ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Info("serving ctl on: ", path)
+
+	return &Server{listener: listener, handlers: map[string]Handler{}}, nil
+}
+
+// ListenUnix binds a unix socket that only the user can connect to, unless another process is already serving it
+func ListenUnix(path string) (net.Listener, error) {
+	// a socket file left behind by a crashed process would prevent binding
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, tracerr.Errorf("another process is already serving %s", path)
+		}
+		_ = os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	// the socket is created with the umask of the shell, which may let the group in, e.g. on a shared server
+	if err := os.Chmod(path, 0600); err != nil {
+		_ = listener.Close()
+		return nil, tracerr.Wrap(err)
+	}
+	return listener, nil
+}
+
+// Handle registers the handler of a command, all handlers need to be registered before Serve
+func (s *Server) Handle(command string, handler Handler) *Server {
+	s.handlers[command] = handler
+	return s
+}
+
+func (s *Server) Serve() {
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if !core.IsAlreadyClosed(err) {
+					logrus.Warn("error accepting ctl connection: ", err)
+				}
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}()
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		req := Request{}
+		res := Response{}
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			res.Error = fmt.Sprintf("malformed request: %s", err.Error())
+		} else if handler, ok := s.handlers[req.Command]; !ok {
+			commands := lo.Keys(s.handlers)
+			slices.Sort(commands)
+			res.Error = fmt.Sprintf("unknown command \"%s\", available commands: %s", req.Command, strings.Join(commands, ", "))
+		} else {
+			logrus.Infof("received ctl command: %s %v", req.Command, req.Args)
+			output, err := handler(req.Args)
+			res.Output = output
+			if err != nil {
+				res.Error = err.Error()
+			}
+		}
+
+		if err := encoder.Encode(res); err != nil {
+			logrus.Warn("error responding to ctl request: ", err)
+			return
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	if err != nil && !core.IsAlreadyClosed(err) {
+		return tracerr.Wrap(err)
+	}
+	return nil
+}
+
+// Send delivers a single request to the listen-mode that serves ctl on the given path
+func Send(path string, req Request) (Response, error) {
+	timeout := config.Config.Transfer.RequestTimeout
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return Response{}, tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return Response{}, tracerr.Wrap(err)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, tracerr.Wrap(err)
+	}
+
+	res := Response{}
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err == nil {
+			err = errors.New("ctl connection closed without a response")
+		}
+		return Response{}, tracerr.Wrap(err)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+		return Response{}, tracerr.Wrap(err)
+	}
+	return res, nil
+}
@@ -0,0 +1,71 @@
+package ctl
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCtlRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := Listen(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	server.
+		Handle("echo", func(args []string) (string, error) {
+			return strings.Join(args, " "), nil
+		}).
+		Handle("fail", func(args []string) (string, error) {
+			return "", errors.New("boom")
+		}).
+		Serve()
+
+	res, err := Send(path, Request{Command: "echo", Args: []string{"a", "b"}})
+	require.NoError(t, err)
+	require.Equal(t, Response{Output: "a b"}, res)
+
+	res, err = Send(path, Request{Command: "fail"})
+	require.NoError(t, err)
+	require.Equal(t, Response{Error: "boom"}, res)
+
+	res, err = Send(path, Request{Command: "unknown"})
+	require.NoError(t, err)
+	require.Equal(t, "unknown command \"unknown\", available commands: echo, fail", res.Error)
+}
+
+func TestCtlRefusesRunningSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	server, err := Listen(path)
+	require.NoError(t, err)
+	server.Serve()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	_, err = Listen(path)
+	require.Error(t, err)
+}
+
+func TestListenUnixMode(t *testing.T) {
+	umask := syscall.Umask(0002)
+	t.Cleanup(func() {
+		syscall.Umask(umask)
+	})
+
+	path := filepath.Join(t.TempDir(), "files.sock")
+	listener, err := ListenUnix(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	stat, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
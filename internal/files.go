@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/ztrue/tracerr"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Put sends a file of the server to the download directory of listen-mode through the spy-mode that runs on it
+func Put(file string) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return tracerr.Wrap(err)
+	} else if stat.IsDir() {
+		return tracerr.Errorf("%s is a directory", file)
+	}
+
+	name := filepath.Base(file)
+	conn, _, err := requestFile(mode.FileRequest{Direction: mode.FilePut, Name: name, Size: stat.Size()})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	progress := view.NewProgress(os.Stderr, fmt.Sprintf("put %s", name), stat.Size())
+	defer func() {
+		if err != nil {
+			progress.Finish("failed")
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(conn, io.TeeReader(f, io.MultiWriter(hash, progress)), stat.Size()); err != nil {
+		return tracerr.Wrap(err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err := mode.WriteFileTrailer(conn, mode.FileTrailer{Sha256: checksum}); err != nil {
+		return err
+	}
+
+	reply, err := mode.ReadFileReply(conn)
+	if err != nil {
+		return err
+	} else if !reply.IsSuccess() {
+		return tracerr.New(reply.Error)
+	}
+
+	progress.Finish(fmt.Sprintf("saved to %s by listen-mode, sha256 %s", reply.Path, checksum))
+	return nil
+}
+
+// Get fetches a file of the upload directory of listen-mode into the working directory
+func Get(name string) (err error) {
+	conn, reply, err := requestFile(mode.FileRequest{Direction: mode.FileGet, Name: name})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	base := filepath.Base(name)
+	tmp, err := os.CreateTemp(".", "."+base+".*.part")
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err := tmp.Chmod(0644); err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	progress := view.NewProgress(os.Stderr, fmt.Sprintf("get %s", name), reply.Size)
+	defer func() {
+		if err != nil {
+			progress.Finish("failed")
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tmp, hash, progress), conn, reply.Size); err != nil {
+		return tracerr.Wrap(err)
+	}
+	trailer, err := mode.ReadFileTrailer(conn)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != trailer.Sha256 {
+		err = tracerr.Errorf("checksum mismatch, sent %s but received %s", trailer.Sha256, checksum)
+		_ = mode.WriteFileReply(conn, mode.FileReply{Error: err.Error()})
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return tracerr.Wrap(err)
+	}
+	path := mode.UniquePath(base)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return tracerr.Wrap(err)
+	}
+	progress.Finish(fmt.Sprintf("saved to %s, sha256 %s", path, checksum))
+
+	// let listen-mode know that it arrived intact
+	return mode.WriteFileReply(conn, mode.FileReply{Path: path, Sha256: checksum})
+}
+
+// requestFile sends the request through spy-mode and waits for listen-mode to accept it
+func requestFile(request mode.FileRequest) (net.Conn, mode.FileReply, error) {
+	path := config.ProcessString(config.Config.Files.Socket)
+	conn, err := net.DialTimeout("unix", path, config.Config.Transfer.RequestTimeout)
+	if err != nil {
+		return nil, mode.FileReply{}, tracerr.Errorf("spy-mode is not connected to listen-mode in this directory: %w", err)
+	}
+
+	// spy-mode needs to open a stream before listen-mode can reply
+	timeout := config.Config.Transfer.ConnectionTimeout + config.Config.Transfer.RequestTimeout
+	if err = conn.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+		err = mode.WriteFileRequest(conn, request)
+	}
+	var reply mode.FileReply
+	if err == nil {
+		reply, err = mode.ReadFileReply(conn)
+	}
+	if err == nil && !reply.IsSuccess() {
+		err = tracerr.New(reply.Error)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, mode.FileReply{}, tracerr.Wrap(err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return conn, reply, nil
+}
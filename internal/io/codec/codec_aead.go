@@ -0,0 +1,98 @@
+package codec
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	stdio "io"
+)
+
+// maxSealedFrame bounds the allocation of a frame, anything larger is garbage or tampered
+const maxSealedFrame = 1 << 20
+
+// Keys of the tunnel, each direction has its own key so that the nonce counters never collide
+type Keys struct {
+	Seal []byte
+	Open []byte
+}
+
+// every write is sealed into a frame of [4-byte length][ciphertext], the nonce is the frame counter
+type aeadEncoderWriter struct {
+	stdio.Writer
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func SealWriter(dst stdio.Writer, key []byte) (stdio.Writer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadEncoderWriter{Writer: dst, aead: aead}, nil
+}
+
+func (w *aeadEncoderWriter) Write(p []byte) (int, error) {
+	frame := make([]byte, 4, 4+len(p)+w.aead.Overhead())
+	frame = w.aead.Seal(frame, nonce(w.counter), p, nil)
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	w.counter++
+
+	if _, err := w.Writer.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+type aeadDecoderReader struct {
+	stdio.Reader
+	aead    cipher.AEAD
+	counter uint64
+	pending []byte
+}
+
+func OpenReader(src stdio.Reader, key []byte) (stdio.Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	// the frames are read piecemeal, while the decoders underneath need room for at least a chunk on every read
+	return &aeadDecoderReader{Reader: bufio.NewReader(src), aead: aead}, nil
+}
+
+func (r *aeadDecoderReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		header := make([]byte, 4)
+		if _, err := stdio.ReadFull(r.Reader, header); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length > maxSealedFrame {
+			return 0, fmt.Errorf("sealed frame of %d bytes exceeds the limit", length)
+		}
+
+		sealed := make([]byte, length)
+		if _, err := stdio.ReadFull(r.Reader, sealed); err != nil {
+			return 0, err
+		}
+		opened, err := r.aead.Open(sealed[:0], nonce(r.counter), sealed, nil)
+		if err != nil {
+			return 0, fmt.Errorf("sealed frame #%d is tampered with: %w", r.counter, err)
+		}
+		r.counter++
+		r.pending = opened
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[chacha20poly1305.NonceSize-8:], counter)
+	return n
+}
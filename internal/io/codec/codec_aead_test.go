@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/stretchr/testify/require"
+	stdio "io"
+	"testing"
+)
+
+func TestAeadCodec(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	for i := 0; i < 1000; i++ {
+		// seal chunk by chunk through the same writer, so that the nonce counter advances
+		sealed := bytes.NewBufferString("")
+		sealW, err := SealWriter(sealed, key)
+		require.NoError(t, err)
+		str := randomString(false)
+		for _, slice := range core.RandomlySlice(str) {
+			_, err := sealW.Write([]byte(slice))
+			require.NoError(t, err)
+		}
+
+		// random resize chunks
+		rechunked := core.NewChannelReader()
+		for _, slice := range core.RandomlySlice(sealed.String()) {
+			rechunked.WriteString(slice)
+		}
+		rechunked.Fail(stdio.EOF)
+
+		openR, err := OpenReader(rechunked, key)
+		require.NoError(t, err)
+		output, err := stdio.ReadAll(openR)
+		require.NoError(t, err)
+		require.Equal(t, str, string(output))
+	}
+}
+
+func TestAeadCodecRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	seal := func(chunks ...string) []byte {
+		sealed := bytes.NewBufferString("")
+		sealW, err := SealWriter(sealed, key)
+		require.NoError(t, err)
+		for _, chunk := range chunks {
+			_, err := sealW.Write([]byte(chunk))
+			require.NoError(t, err)
+		}
+		return sealed.Bytes()
+	}
+	open := func(sealed []byte, key []byte) error {
+		openR, err := OpenReader(bytes.NewReader(sealed), key)
+		require.NoError(t, err)
+		_, err = stdio.ReadAll(openR)
+		return err
+	}
+
+	// a flipped bit
+	flipped := seal("hello")
+	flipped[len(flipped)-1] ^= 1
+	require.ErrorContains(t, open(flipped, key), "tampered")
+
+	// another key
+	require.ErrorContains(t, open(seal("hello"), bytes.Repeat([]byte{8}, 32)), "tampered")
+
+	// reordered frames
+	first := seal("hello")
+	second := seal("hello", "world")[len(first):]
+	require.ErrorContains(t, open(append(second, first...), key), "tampered")
+}
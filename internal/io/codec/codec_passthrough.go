@@ -0,0 +1,131 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	stdio "io"
+	"os"
+	"strings"
+)
+
+// a terminal multiplexer redraws the screen instead of forwarding what spy-mode prints, so spy-mode asks it to pass
+// its output through untouched with a DCS passthrough sequence. what comes out on the other side is framed as an OSC
+// sequence that terminals ignore, so that listen-mode can pick it out of whatever else the multiplexer prints.
+const (
+	frameStart = "\x1b]5379;"
+	frameEnd   = "\a"
+)
+
+// screen keeps the strings of escape sequences in a small buffer
+const screenPassthroughChunk = 512
+
+const tmuxPassthroughChunk = 16384
+
+// DetectTransport resolves the transport of spy-mode, "auto" picks the terminal multiplexer it runs in
+func DetectTransport() config.TransportType {
+	transport := config.Config.Transfer.Transport
+	if transport != config.AutoDetect {
+		return transport
+	}
+	if config.Config.Transfer.Codec != config.Hex {
+		// the frames can not carry the control characters of other codecs
+		return config.Raw
+	}
+	if os.Getenv("TMUX") != "" {
+		return config.Tmux
+	}
+	if os.Getenv("STY") != "" {
+		return config.Screen
+	}
+	return config.Raw
+}
+
+type passthroughEncoderWriter struct {
+	stdio.Writer
+	prefix    string
+	suffix    string
+	chunkSize int
+}
+
+// PassthroughWriter wraps every write in passthrough sequences of the given transport
+func PassthroughWriter(dst stdio.Writer, transport config.TransportType) stdio.Writer {
+	switch transport {
+	case config.Tmux:
+		// tmux expects the escape characters of the passed through sequence to be doubled
+		start := strings.ReplaceAll(frameStart, "\x1b", "\x1b\x1b")
+		return &passthroughEncoderWriter{Writer: dst, prefix: "\x1bPtmux;" + start, suffix: frameEnd + "\x1b\\", chunkSize: tmuxPassthroughChunk}
+	case config.Screen:
+		return &passthroughEncoderWriter{Writer: dst, prefix: "\x1bP" + frameStart, suffix: frameEnd + "\x1b\\", chunkSize: screenPassthroughChunk}
+	default:
+		return dst
+	}
+}
+
+func (w *passthroughEncoderWriter) Write(p []byte) (int, error) {
+	if bytes.ContainsAny(p, "\x1b\a") {
+		return 0, fmt.Errorf("passthrough can not carry control characters, use the hex codec")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(p)+(len(p)/w.chunkSize+1)*(len(w.prefix)+len(w.suffix))))
+	for start := 0; start < len(p); start += w.chunkSize {
+		buf.WriteString(w.prefix)
+		buf.Write(p[start:min(start+w.chunkSize, len(p))])
+		buf.WriteString(w.suffix)
+	}
+	if _, err := w.Writer.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ----------------------------------------------------------------------------------------------------------------
+
+type passthroughDecoderReader struct {
+	stdio.Reader
+	buf     []byte
+	matched int // number of bytes of frameStart that are matched so far
+	inFrame bool
+}
+
+// PassthroughReader extracts the content of the frames and drops everything else
+func PassthroughReader(src stdio.Reader) stdio.Reader {
+	return &passthroughDecoderReader{Reader: src, buf: make([]byte, config.Config.Transfer.Buffer)}
+}
+
+func (r *passthroughDecoderReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		// there is nowhere to extract to, reading would loop forever
+		return 0, nil
+	}
+	for {
+		n, err := r.Reader.Read(r.buf[:min(len(p), len(r.buf))])
+
+		extracted := 0
+		for _, c := range r.buf[:n] {
+			if r.inFrame {
+				if c == frameEnd[0] {
+					r.inFrame = false
+				} else {
+					p[extracted] = c
+					extracted++
+				}
+			} else if c == frameStart[r.matched] {
+				r.matched++
+				if r.matched == len(frameStart) {
+					r.inFrame = true
+					r.matched = 0
+				}
+			} else if c == frameStart[0] {
+				r.matched = 1
+			} else {
+				r.matched = 0
+			}
+		}
+
+		// keep reading while the multiplexer only prints its own stuff
+		if extracted > 0 || err != nil {
+			return extracted, err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/stretchr/testify/require"
+	stdio "io"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// multiplexer mimics what reaches the outer terminal: the passed through content, with its own redraws around it
+func multiplexer(t *testing.T, transport config.TransportType, written string) string {
+	prefix := map[config.TransportType]string{config.Tmux: "\x1bPtmux;", config.Screen: "\x1bP"}[transport]
+	passthrough := regexp.MustCompile(regexp.QuoteMeta(prefix) + "(.*?)\x1b\\\\")
+	matches := passthrough.FindAllStringSubmatch(written, -1)
+	require.NotEmpty(t, matches)
+
+	noise := "\x1b[2J\x1b]0;title\a\x1b]53 12:00 \x1b"
+	output := noise
+	for _, match := range matches {
+		output += strings.ReplaceAll(match[1], "\x1b\x1b", "\x1b") + noise
+	}
+	return output
+}
+
+func TestPassthroughCodec(t *testing.T) {
+	for _, transport := range []config.TransportType{config.Tmux, config.Screen} {
+		for i := 0; i < 1000; i++ {
+			written := bytes.NewBufferString("")
+			writer := PassthroughWriter(written, transport)
+			str := hex.EncodeToString([]byte(strings.Repeat(randomString(false), 20)))
+			for _, slice := range core.RandomlySlice(str) {
+				_, err := writer.Write([]byte(slice))
+				require.NoError(t, err)
+			}
+
+			// random resize chunks
+			rechunked := core.NewChannelReader()
+			for _, slice := range core.RandomlySlice(multiplexer(t, transport, written.String())) {
+				rechunked.WriteString(slice)
+			}
+			rechunked.Fail(stdio.EOF)
+
+			output, err := stdio.ReadAll(PassthroughReader(rechunked))
+			require.NoError(t, err)
+			require.Equal(t, str, string(output), "transport %s", transport)
+		}
+	}
+}
+
+func TestPassthroughCodecRefusesControlCharacters(t *testing.T) {
+	_, err := PassthroughWriter(stdio.Discard, config.Screen).Write([]byte("a\x1b\\b"))
+	require.Error(t, err)
+}
+
+func TestPassthroughCodecEmptyRead(t *testing.T) {
+	reader := PassthroughReader(strings.NewReader(frameStart + "0a" + frameEnd))
+	n, err := reader.Read(nil)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// nothing is consumed by the empty read
+	output, err := stdio.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "0a", string(output))
+}
@@ -6,7 +6,8 @@ import (
 	"io"
 )
 
-func WrapCodec(r io.Reader, w io.Writer) io.ReadWriter {
+// WrapCodec encodes the tunnel, it is also encrypted if keys are given
+func WrapCodec(r io.Reader, w io.Writer, keys *Keys) (io.ReadWriter, error) {
 	switch config.Config.Transfer.Codec {
 	case config.Plain:
 	case config.Hex:
@@ -15,5 +16,15 @@ func WrapCodec(r io.Reader, w io.Writer) io.ReadWriter {
 	default:
 		panic("invalid codec")
 	}
-	return core.NewReadWriter(r, w)
+
+	if keys != nil {
+		var err error
+		if r, err = OpenReader(r, keys.Open); err != nil {
+			return nil, err
+		}
+		if w, err = SealWriter(w, keys.Seal); err != nil {
+			return nil, err
+		}
+	}
+	return core.NewReadWriter(r, w), nil
 }
@@ -0,0 +1,123 @@
+package core
+
+import "bytes"
+
+// ahoCorasick finds every occurrence of a set of patterns in a single pass over the input, the state it returns
+// carries over to the next chunk of a stream so that occurrences that span chunks are found too
+type ahoCorasick struct {
+	// next is the complete transition table with failure links folded into it, a state is the offset of its row so
+	// the next state of s on byte c is next[s+c]
+	next []int32
+	// matches holds the indices of the patterns that end at each state, indexed by state/256
+	matches [][]int
+	// final tells whether any pattern ends at each state, indexed by state/256
+	final []bool
+	// starts tells the bytes that leave the root state, the scan skips the others without walking the table, which is
+	// much faster since the lookups do not depend on each other
+	starts [256]bool
+	// firstByte is the only byte that leaves the root state, or -1 if there are several, which lets the scan skip to
+	// it with a vectorized search
+	firstByte int
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	trie := make([][256]int32, 1)
+	matches := make([][]int, 1)
+
+	// build the trie, the root is never the child of another state so 0 means no transition
+	for i, pattern := range patterns {
+		state := int32(0)
+		for j := 0; j < len(pattern); j++ {
+			c := pattern[j]
+			if trie[state][c] == 0 {
+				trie = append(trie, [256]int32{})
+				matches = append(matches, nil)
+				trie[state][c] = int32(len(trie) - 1)
+			}
+			state = trie[state][c]
+		}
+		matches[state] = append(matches[state], i)
+	}
+
+	var starts [256]bool
+	startCount, firstByte := 0, -1
+	for c := 0; c < 256; c++ {
+		if trie[0][c] != 0 {
+			starts[c] = true
+			startCount++
+			firstByte = c
+		}
+	}
+	if startCount != 1 {
+		firstByte = -1
+	}
+
+	// walk the trie breadth first, so that the failure link of a state is complete before the state itself
+	fail := make([]int32, len(trie))
+	var queue []int32
+	for c := 0; c < 256; c++ {
+		if child := trie[0][c]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		matches[state] = append(matches[state], matches[fail[state]]...)
+		for c := 0; c < 256; c++ {
+			if child := trie[state][c]; child != 0 {
+				fail[child] = trie[fail[state]][c]
+				queue = append(queue, child)
+			} else {
+				trie[state][c] = trie[fail[state]][c]
+			}
+		}
+	}
+
+	ac := &ahoCorasick{
+		next:      make([]int32, len(trie)*256),
+		matches:   matches,
+		final:     make([]bool, len(trie)),
+		starts:    starts,
+		firstByte: firstByte,
+	}
+	for state := range trie {
+		for c := 0; c < 256; c++ {
+			ac.next[state*256+c] = trie[state][c] * 256
+		}
+		ac.final[state] = len(matches[state]) > 0
+	}
+	return ac
+}
+
+// scan feeds p to the automaton starting from state, found is called with the index of the pattern and the position
+// in p right after its end for every occurrence
+func (ac *ahoCorasick) scan(state int32, p []byte, found func(pattern int, end int)) int32 {
+	next, final, starts := ac.next, ac.final, &ac.starts
+	for i := 0; i < len(p); i++ {
+		if state == 0 {
+			if ac.firstByte != -1 {
+				skip := bytes.IndexByte(p[i:], byte(ac.firstByte))
+				if skip == -1 {
+					return 0
+				}
+				i += skip
+			} else {
+				for i < len(p) && !starts[p[i]] {
+					i++
+				}
+				if i == len(p) {
+					return 0
+				}
+			}
+		}
+
+		state = next[state+int32(p[i])]
+		if final[state>>8] {
+			for _, pattern := range ac.matches[state>>8] {
+				found(pattern, i+1)
+			}
+		}
+	}
+	return state
+}
@@ -0,0 +1,54 @@
+package core
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"sort"
+	"testing"
+)
+
+func TestAhoCorasick(t *testing.T) {
+	patterns := []string{"ab", "abab", "b", "bab", "cab", "aaa"}
+	ac := newAhoCorasick(patterns)
+
+	for i := 0; i < 1000; i++ {
+		input := randomAlphabetString("abc", rand.IntN(100))
+
+		// feed the input in random chunks, the occurrences that span chunks are expected too
+		var found []string
+		state := int32(0)
+		position := 0
+		for _, chunk := range RandomlySlice(input) {
+			state = ac.scan(state, []byte(chunk), func(pattern int, end int) {
+				found = append(found, fmtOccurrence(patterns[pattern], position+end))
+			})
+			position += len(chunk)
+		}
+
+		var expected []string
+		for _, pattern := range patterns {
+			for end := len(pattern); end <= len(input); end++ {
+				if input[end-len(pattern):end] == pattern {
+					expected = append(expected, fmtOccurrence(pattern, end))
+				}
+			}
+		}
+
+		sort.Strings(found)
+		sort.Strings(expected)
+		require.Equal(t, expected, found, "input: %s", input)
+	}
+}
+
+func fmtOccurrence(pattern string, end int) string {
+	return fmt.Sprintf("%s@%d", pattern, end)
+}
+
+func randomAlphabetString(alphabet string, n int) string {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = alphabet[rand.IntN(len(alphabet))]
+	}
+	return string(buf)
+}
@@ -16,22 +16,56 @@ var MaxSignatureLength = int(config.Config.Transfer.SignatureDetectorBuffer)
 
 type DetectorState struct {
 	recentBuffer *bytes.Buffer
-	lastMatch    signature.Signature
+	// position of the first byte of recentBuffer in the stream
+	recentStart int
+	// state of the prefix matcher at the end of recentBuffer
+	prefixState int32
+	// positions in the stream where the prefix of each prefixed signature occurs, dropped once they can not be the
+	// start of a match anymore
+	candidates [][]int
+	// position in the stream where the line that the unprefixed signatures look at starts
+	lineStart int
+	lastMatch signature.Signature
 }
 
+// SignatureDetector looks for signatures in a stream. The literal prefixes of the signatures are matched byte by byte
+// with Aho-Corasick, and the (regex) Find of a signature only runs on the window that starts at an occurrence of its
+// prefix, which is given up on once it is longer than the signature can be (see signature.Bounded). So the output that
+// has nothing to do with the signatures costs a table lookup per byte.
 type SignatureDetector struct {
-	signatures []signature.Signature
+	// prefixed[i] starts with the i-th pattern of prefixMatcher, and is at most maxLengths[i] long
+	prefixed      []signature.Signature
+	maxLengths    []int
+	prefixMatcher *ahoCorasick
+	// unprefixed signatures are looked for in the output since the last line break, so they can not span lines
+	unprefixed []signature.Signature
 	state      *DetectorState
 }
 
 func NewSignatureDetector(signatures ...signature.Signature) *SignatureDetector {
-	return &SignatureDetector{
-		signatures: signatures,
+	var prefixes []string
+	c := &SignatureDetector{
 		state: &DetectorState{
 			recentBuffer: &bytes.Buffer{},
 			lastMatch:    nil,
 		},
 	}
+	for _, sig := range signatures {
+		if prefixed, ok := sig.(signature.Prefixed); ok && prefixed.Prefix() != "" {
+			c.prefixed = append(c.prefixed, sig)
+			prefixes = append(prefixes, prefixed.Prefix())
+			if bounded, ok := sig.(signature.Bounded); ok {
+				c.maxLengths = append(c.maxLengths, bounded.MaxLength())
+			} else {
+				c.maxLengths = append(c.maxLengths, MaxSignatureLength)
+			}
+		} else {
+			c.unprefixed = append(c.unprefixed, sig)
+		}
+	}
+	c.prefixMatcher = newAhoCorasick(prefixes)
+	c.state.candidates = make([][]int, len(c.prefixed))
+	return c
 }
 
 func (c *SignatureDetector) Reset() {
@@ -84,35 +118,105 @@ func (c *SignatureDetectorContextBoundReader) Read(b []byte) (int, error) {
 		return n, err
 	}
 
-	// TODO: optimize
 	c.state.recentBuffer.Write(b[:n])
+	c.collectCandidates(b[:n])
 
 	if matchedEndIndex := c.findFirstSignature(); matchedEndIndex != -1 {
 		buf := c.state.recentBuffer.Bytes()
 		logrus.Debugf("signatures detected: %+v", c.state.lastMatch)
 		c.r.UnreadBytes(buf[matchedEndIndex:])
-		c.state.recentBuffer.Reset()
+		c.state.reset()
 
 		newN := n - (len(buf) - matchedEndIndex)
 		return newN, nil
 	} else {
+		c.dropCandidates()
+		if i := bytes.LastIndexByte(b[:n], '\n'); i != -1 {
+			c.state.lineStart = c.state.recentStart + c.state.recentBuffer.Len() - n + i + 1
+		}
 		if bufLen := c.state.recentBuffer.Len(); bufLen > MaxSignatureLength {
-			c.state.recentBuffer.Next(bufLen - MaxSignatureLength)
+			c.state.trim(bufLen - MaxSignatureLength)
 		}
 		return n, nil
 	}
 }
 
+// dropCandidates forgets the occurrences of the prefixes that Find has failed on while they were followed by as many
+// bytes as their signature can be long, as no match starts at them
+func (c *SignatureDetector) dropCandidates() {
+	end := c.state.recentStart + c.state.recentBuffer.Len()
+	for i, candidates := range c.state.candidates {
+		dropped := 0
+		for dropped < len(candidates) && end-candidates[dropped] >= c.maxLengths[i] {
+			dropped++
+		}
+		c.state.candidates[i] = candidates[dropped:]
+	}
+}
+
+// collectCandidates records where the prefixes occur in p, which has just been appended to the recent buffer
+func (c *SignatureDetector) collectCandidates(p []byte) {
+	if len(c.prefixed) == 0 {
+		return
+	}
+	base := c.state.recentStart + c.state.recentBuffer.Len() - len(p)
+	c.state.prefixState = c.prefixMatcher.scan(c.state.prefixState, p, func(pattern int, end int) {
+		start := base + end - len(c.prefixed[pattern].(signature.Prefixed).Prefix())
+		c.state.candidates[pattern] = append(c.state.candidates[pattern], start)
+	})
+}
+
 func (c *SignatureDetector) findFirstSignature() (matchEndIndex int) {
-	recentBuffer := c.state.recentBuffer.String()
 	matchEndIndex = -1
+	recentBuffer := c.state.recentBuffer.Bytes()
 
-	for _, sig := range c.signatures {
-		if currentIdx := sig.Find(recentBuffer); currentIdx != -1 && (matchEndIndex == -1 || currentIdx < matchEndIndex) {
-			matchEndIndex = currentIdx
+	// the window that starts at the first candidate of a signature contains all the later ones too
+	for i, sig := range c.prefixed {
+		if len(c.state.candidates[i]) == 0 {
+			continue
+		}
+		windowStart := max(c.state.candidates[i][0]-c.state.recentStart, 0)
+		if currentIdx := sig.Find(string(recentBuffer[windowStart:])); currentIdx != -1 && (matchEndIndex == -1 || windowStart+currentIdx < matchEndIndex) {
+			matchEndIndex = windowStart + currentIdx
 			c.state.lastMatch = sig
 		}
 	}
 
+	if len(c.unprefixed) > 0 {
+		// the line that was not complete before the last read, along with the lines of the last read
+		lineStart := max(c.state.lineStart-c.state.recentStart, 0)
+		line := string(recentBuffer[lineStart:])
+		for _, sig := range c.unprefixed {
+			if currentIdx := sig.Find(line); currentIdx != -1 && (matchEndIndex == -1 || lineStart+currentIdx < matchEndIndex) {
+				matchEndIndex = lineStart + currentIdx
+				c.state.lastMatch = sig
+			}
+		}
+	}
+
 	return matchEndIndex
 }
+
+// trim drops the oldest n bytes of the recent buffer along with the candidates in them
+func (s *DetectorState) trim(n int) {
+	s.recentBuffer.Next(n)
+	s.recentStart += n
+	for i, candidates := range s.candidates {
+		dropped := 0
+		for dropped < len(candidates) && candidates[dropped] < s.recentStart {
+			dropped++
+		}
+		s.candidates[i] = candidates[dropped:]
+	}
+}
+
+// reset forgets the stream so far, what follows the match is unread to be read again
+func (s *DetectorState) reset() {
+	s.recentBuffer.Reset()
+	s.recentStart = 0
+	s.lineStart = 0
+	s.prefixState = 0
+	for i := range s.candidates {
+		s.candidates[i] = nil
+	}
+}
@@ -3,10 +3,14 @@ package core
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
 	"io"
 	"math/rand/v2"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
@@ -53,6 +57,128 @@ func TestSignatureDetection(t *testing.T) {
 	//}
 }
 
+func TestSignatureDetectionPrefixed(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 1000; i++ {
+		input := "[sig:1" + strings.Repeat("noise [sig:", rand.IntN(100)) + " [sig:42] [sig:7] hello world [sig:3]"
+		contextReader := NewContextReader(randomSplitReader(input))
+		regexSig := signature.NewRegexSignature(regexp.MustCompile("\\[sig:([0-9]+)]"))
+		detector := NewSignatureDetector(&SimpleSignature{"hello world"}, regexSig)
+		spyReader := detector.Wrap(contextReader).BindTo(ctx)
+
+		// the prefix occurs many times before the signature completes
+		chunkUtilAfterSignature, err := io.ReadAll(spyReader)
+		require.ErrorIs(t, err, SignatureFound)
+		require.True(t, strings.HasSuffix(string(chunkUtilAfterSignature), " [sig:42]"))
+		require.Equal(t, regexSig, detector.LastMatch())
+		require.Equal(t, "42", regexSig.Groups[1])
+
+		detector.Reset()
+		chunkUtilAfterSignature, err = io.ReadAll(spyReader)
+		require.ErrorIs(t, err, SignatureFound)
+		require.Equal(t, " [sig:7]", string(chunkUtilAfterSignature))
+		require.Equal(t, "7", regexSig.Groups[1])
+
+		// the unprefixed signature is matched too
+		detector.Reset()
+		chunkUtilAfterSignature, err = io.ReadAll(spyReader)
+		require.ErrorIs(t, err, SignatureFound)
+		require.Equal(t, " hello world", string(chunkUtilAfterSignature))
+	}
+}
+
+func TestSignatureDetectionDropsFalsePrefixes(t *testing.T) {
+	ctx := context.Background()
+	spyStart := signature.GenerateSpyStart(signature.NewSpyStart(config.Raw))
+	input := strings.Repeat("[spy] start{ is not a signature\r\n", 1000) + spyStart + " after"
+	contextReader := NewContextReader(&chunkedReader{data: []byte(input), chunkSize: 64})
+	detector := NewSignatureDetector(&signature.SpyStart{})
+	spyReader := detector.Wrap(contextReader).BindTo(ctx)
+
+	// the prefixes that are followed by more than a spy start signature can be long are not looked at again
+	buf := make([]byte, 64)
+	for i := 0; i < 500; i++ {
+		_, err := spyReader.Read(buf)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(detector.state.candidates[0]), (&signature.SpyStart{}).MaxLength()/len("[spy] start{ is not a signature\r\n")+1)
+	}
+
+	read, err := io.ReadAll(spyReader)
+	require.ErrorIs(t, err, SignatureFound)
+	require.True(t, strings.HasSuffix(string(read), spyStart))
+}
+
+func TestSignatureDetectionUnprefixedInLine(t *testing.T) {
+	ctx := context.Background()
+
+	// an unprefixed signature is looked for in every line that a read completes
+	contextReader := NewContextReader(&chunkedReader{data: []byte("first\r\nsay hello world\r\nthird\r\nfourth"), chunkSize: 1024})
+	spyReader := NewSignatureDetector(&SimpleSignature{"hello world"}).Wrap(contextReader).BindTo(ctx)
+	read, err := io.ReadAll(spyReader)
+	require.ErrorIs(t, err, SignatureFound)
+	require.Equal(t, "first\r\nsay hello world", string(read))
+
+	// but not across lines
+	contextReader = NewContextReader(randomSplitReader("say hello\nworld\n"))
+	spyReader = NewSignatureDetector(&SimpleSignature{"hello\nworld"}).Wrap(contextReader).BindTo(ctx)
+	read, err = io.ReadAll(spyReader)
+	require.NoError(t, err)
+	require.Equal(t, "say hello\nworld\n", string(read))
+}
+
+// BenchmarkSignatureDetector compares the throughput of the detector with the bare reader underneath it for
+// different chunk sizes, the difference stays proportional to the number of bytes as the detector does not go over
+// the recent output again on every read
+func BenchmarkSignatureDetector(b *testing.B) {
+	output := []byte(strings.Repeat("2024-01-01 12:00:00 [INFO] some log line that is cat'ed to the terminal [x]\r\n", 1<<14))
+	// the prefix of the spy start signature on every line, which is never followed by the rest of it
+	falsePrefixes := []byte(strings.Repeat("2024-01-01 12:00:00 [INFO] [spy] start{ is printed by the log of spy-mode\r\n", 1<<14))
+	prompt := signature.NewRegexSignature(regexp.MustCompile(`(?:^|\n)[^\r\n]*[$#%>] ?$`))
+	detect := func(b *testing.B, output []byte, chunkSize int, signatures ...signature.Signature) {
+		b.SetBytes(int64(len(output)))
+		for i := 0; i < b.N; i++ {
+			reader := NewSignatureDetector(signatures...).Wrap(NewContextReader(&chunkedReader{data: output, chunkSize: chunkSize})).BindTo(context.Background())
+			if _, err := io.Copy(io.Discard, reader); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, chunkSize := range []int{64, 1024, 16384} {
+		b.Run(fmt.Sprintf("bare/chunk=%d", chunkSize), func(b *testing.B) {
+			b.SetBytes(int64(len(output)))
+			for i := 0; i < b.N; i++ {
+				reader := NewContextReader(&chunkedReader{data: output, chunkSize: chunkSize}).BindTo(context.Background())
+				if _, err := io.Copy(io.Discard, reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("detector/chunk=%d", chunkSize), func(b *testing.B) {
+			detect(b, output, chunkSize, &signature.SpyStart{}, signature.NewHotkey(config.PreflightAction), signature.NewRegexSignature(regexp.MustCompile("________capture_begin_")))
+		})
+		b.Run(fmt.Sprintf("false-prefixes/chunk=%d", chunkSize), func(b *testing.B) {
+			detect(b, falsePrefixes, chunkSize, &signature.SpyStart{})
+		})
+		b.Run(fmt.Sprintf("unprefixed/chunk=%d", chunkSize), func(b *testing.B) {
+			detect(b, output, chunkSize, &signature.SpyStart{}, prompt)
+		})
+	}
+}
+
+type chunkedReader struct {
+	data      []byte
+	chunkSize int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.chunkSize)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
 func randomSplitReader(str string) io.Reader {
 	var indices []int
 	for i := 0; i < len(str)-1; i += rand.IntN(len(str)-i-1) + 1 {
@@ -24,20 +24,31 @@ func (cr CommandResult) IsSuccess() bool {
 	return cr.Result == 0
 }
 
+// GenerateCommandsAndCaptureResult runs the commands in a subshell of a POSIX shell and prints their exit code and
+// output. pipefail is set where the shell supports it (dash does not), the output is escaped after the command exits so
+// that its exit code is not the one of the escaping.
 func GenerateCommandsAndCaptureResult(commands []string) (command string, collector *BatchCommandResult) {
-	prep := `set -o pipefail; ` + strings.Join(lo.Map(commands, func(cmd string, i int) string {
-		return fmt.Sprintf(`o_%[1]d=$(%[2]s | awk '{print}' ORS='\\\\n'); r_%[1]d=$?; `, i, cmd)
+	prep := `(set -o pipefail) 2>/dev/null && set -o pipefail; ` + strings.Join(lo.Map(commands, func(cmd string, i int) string {
+		return fmt.Sprintf(`o_%[1]d=$(%[2]s); r_%[1]d=$?; o_%[1]d=$(printf '%%s' "$o_%[1]d" | awk '{print}' ORS='\\\\n'); `, i, cmd)
 	}), "")
 	output := strings.Join(lo.Map(commands, func(cmd string, i int) string {
 		return fmt.Sprintf(`r_%[1]d=$r_%[1]d\no_%[1]d=$o_%[1]d`, i)
 	}), "\\n")
 
 	collector = &BatchCommandResult{}
-	command, collector.CaptureResult = GenerateCommandAndCaptureResult(prep, output)
+	command, collector.CaptureResult = GenerateSubshellCommandAndCaptureResult(prep, output)
 
 	return command, collector
 }
 
+// GenerateInShellCommandAndCaptureResult runs a command in the shell itself rather than in a subshell, for builtins
+// that change the state of the shell, only its exit code is captured
+func GenerateInShellCommandAndCaptureResult(cmd string) (command string, collector *BatchCommandResult) {
+	collector = &BatchCommandResult{}
+	command, collector.CaptureResult = GenerateCommandAndCaptureResult(fmt.Sprintf(`%s; r_0=$?; `, cmd), `r_0=$r_0\no_0=`)
+	return command, collector
+}
+
 func (p *BatchCommandResult) Find(in string) (matchEndIndex int) {
 	defer func() {
 		if matchEndIndex != -1 {
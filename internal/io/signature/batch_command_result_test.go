@@ -13,7 +13,7 @@ func TestBatchCommandResult(t *testing.T) {
 		"command -v dd",
 		"command -v stty",
 	})
-	printCmd := fmt.Sprintf(` { set -o pipefail; o_0=$(command -v dd | awk '{print}' ORS='\\\\n'); r_0=$?; o_1=$(command -v stty | awk '{print}' ORS='\\\\n'); r_1=$?; printf "________capture_begin_10000000200030004000500000000000________\nr_0=$r_0\no_0=$o_0\nr_1=$r_1\no_1=$o_1\n_________capture_end_10000000200030004000500000000000_________\n"; }` + "\n")
+	printCmd := fmt.Sprintf(` ( (set -o pipefail) 2>/dev/null && set -o pipefail; o_0=$(command -v dd); r_0=$?; o_0=$(printf '%%s' "$o_0" | awk '{print}' ORS='\\\\n'); o_1=$(command -v stty); r_1=$?; o_1=$(printf '%%s' "$o_1" | awk '{print}' ORS='\\\\n'); printf "________capture_begin_10000000200030004000500000000000________\nr_0=$r_0\no_0=$o_0\nr_1=$r_1\no_1=$o_1\n_________capture_end_10000000200030004000500000000000_________\n"; )` + "\n")
 	require.Equal(t, printCmd, regexp.MustCompile("_[0-9a-f]{32}_").ReplaceAllString(actual, "_10000000200030004000500000000000_"))
 
 	output := `________capture_begin_10000000200030004000500000000000________
@@ -30,3 +30,14 @@ _________capture_end_10000000200030004000500000000000_________
 	require.Equal(t, CommandResult{Result: 0, Output: "/bin/dd"}, parsed.Results[0])
 	require.Equal(t, CommandResult{Result: 0, Output: "/bin/stty"}, parsed.Results[1])
 }
+
+func TestInShellCommandResult(t *testing.T) {
+	actual, parsed := GenerateInShellCommandAndCaptureResult("set +o history")
+	printCmd := ` { set +o history; r_0=$?; printf "________capture_begin_10000000200030004000500000000000________\nr_0=$r_0\no_0=\n_________capture_end_10000000200030004000500000000000_________\n"; }` + "\n"
+	require.Equal(t, printCmd, regexp.MustCompile("_[0-9a-f]{32}_").ReplaceAllString(actual, "_10000000200030004000500000000000_"))
+
+	output := "________capture_begin_10000000200030004000500000000000________\r\nr_0=1\r\no_0=\r\n_________capture_end_10000000200030004000500000000000_________\r\n"
+	idx := parsed.Find(output)
+	require.NotEqual(t, -1, idx)
+	require.Equal(t, []CommandResult{{Result: 1, Output: ""}}, parsed.Results)
+}
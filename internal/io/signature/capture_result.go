@@ -13,16 +13,28 @@ var resultCaptureRegex = regexp.MustCompile("________capture_begin_([0-9a-z]{32}
 
 const resultCaptureFmt = " { %[2]sprintf \"________capture_begin_%[1]s________\\n%[3]s\\n_________capture_end_%[1]s_________\\n\"; }\n"
 
+// resultCaptureInSubshellFmt is resultCaptureFmt that keeps the variables and options of prep out of the shell
+const resultCaptureInSubshellFmt = " ( %[2]sprintf \"________capture_begin_%[1]s________\\n%[3]s\\n_________capture_end_%[1]s_________\\n\"; )\n"
+
 type CaptureResult struct {
 	Id       uuid.UUID
 	Captured string
 }
 
 func GenerateCommandAndCaptureResult(prep string, output string) (command string, collector *CaptureResult) {
+	return generateCommandAndCaptureResult(resultCaptureFmt, prep, output)
+}
+
+// GenerateSubshellCommandAndCaptureResult is GenerateCommandAndCaptureResult that runs prep in a subshell
+func GenerateSubshellCommandAndCaptureResult(prep string, output string) (command string, collector *CaptureResult) {
+	return generateCommandAndCaptureResult(resultCaptureInSubshellFmt, prep, output)
+}
+
+func generateCommandAndCaptureResult(format string, prep string, output string) (command string, collector *CaptureResult) {
 	id := uuid.New()
 	b := make([]byte, 16)
 	copy(b[:], id[:])
-	return fmt.Sprintf(resultCaptureFmt, hex.EncodeToString(b), prep, output), &CaptureResult{Id: id}
+	return fmt.Sprintf(format, hex.EncodeToString(b), prep, output), &CaptureResult{Id: id}
 }
 
 func (p *CaptureResult) GenerateLookupRegex() *regexp.Regexp {
@@ -32,6 +44,10 @@ func (p *CaptureResult) GenerateLookupRegex() *regexp.Regexp {
 	return regexp.MustCompile(pattern)
 }
 
+func (p *CaptureResult) Prefix() string {
+	return literalPrefix(resultCaptureRegex)
+}
+
 func (p *CaptureResult) Find(in string) (matchEndIndex int) {
 	groups, matchEndIndex := findRegex(in, resultCaptureRegex)
 	if groups == nil {
@@ -3,7 +3,6 @@ package signature
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"hash/crc64"
 	"regexp"
 	"strings"
 )
@@ -12,6 +11,20 @@ type Signature interface {
 	Find(input string) (matchEndIndex int)
 }
 
+// Prefixed signatures always start with a literal prefix, the signature detector only runs Find on the input that
+// follows an occurrence of it
+type Prefixed interface {
+	Signature
+	Prefix() string
+}
+
+// Bounded signatures are never longer than MaxLength, the signature detector gives up on an occurrence of the prefix
+// once that many bytes have followed it without a match
+type Bounded interface {
+	Prefixed
+	MaxLength() int
+}
+
 func findRegex(in string, re *regexp.Regexp) (groups []string, lastMatchIdx int) {
 	lastMatchIdx = -1
 	matches := re.FindStringSubmatch(in)
@@ -26,6 +39,11 @@ func findRegex(in string, re *regexp.Regexp) (groups []string, lastMatchIdx int)
 	return matches, lastMatchIdx
 }
 
+func literalPrefix(re *regexp.Regexp) string {
+	prefix, _ := re.LiteralPrefix()
+	return prefix
+}
+
 func toHex(v uint64) string {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, v)
@@ -39,9 +57,3 @@ func fromHex(v string) (uint64, error) {
 	}
 	return binary.LittleEndian.Uint64(bytes), nil
 }
-
-func calculateChecksum(num uint64) uint64 {
-	randomBytes := make([]byte, 8)
-	binary.LittleEndian.PutUint64(randomBytes, num)
-	return crc64.Checksum(randomBytes, crc64.MakeTable(crc64.ECMA))
-}
@@ -1,39 +1,86 @@
 package signature
 
 import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/hkdf"
+	stdio "io"
 	"math"
-	"math/rand/v2"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
-var SpyStartRegex = regexp.MustCompile("\\[spy] start{timestamp:\"([0-9A-Z]{16})\",seed:\"([0-9A-Z]{16})\",checksum:\"([0-9A-Z]{16})\"}")
+// the handshake proves that both sides know the per-installation secret, without it anything that prints a spy start
+// signature to the terminal (e.g. a file that is cat'ed) could make listen-mode open its services to it.
+//
+//	spy-mode:    [spy] start{timestamp, nonce, key, transport, mac(timestamp, nonce, key, transport)}
+//	listen-mode: [listen] connect{challenge, key, mac(nonce, spy key, challenge, key)}
+//	spy-mode:    HelloResponse{proof: mac(challenge, nonce)}, listen-mode launches the services only after checking it
+//
+// the keys are ephemeral x25519 public keys, the tunnel is encrypted with the keys derived from their shared secret
+// so a recorded session reveals nothing even if the per-installation secret leaks later. the macs pin them to the
+// secret that preflight uploads, so that nothing in between can swap them.
 
-const ListenConnectFmt = " [listen] connect{}"
+var ErrUnauthenticated = errors.New("handshake is not authenticated")
 
-const spyStartFmt = "[spy] start{timestamp:\"%s\",seed:\"%s\",checksum:\"%s\"}"
+var SpyStartRegex = regexp.MustCompile("\\[spy] start{timestamp:\"([0-9A-Z]{16})\",nonce:\"([0-9A-Z]{16})\",key:\"([0-9A-Z]{64})\",transport:\"([a-z]+)\",mac:\"([0-9A-Z]{64})\"}")
+
+var ListenConnectRegex = regexp.MustCompile(" \\[listen] connect{challenge:\"([0-9A-Z]{16})\",key:\"([0-9A-Z]{64})\",mac:\"([0-9A-Z]{64})\"}")
+
+const spyStartFmt = "[spy] start{timestamp:\"%s\",nonce:\"%s\",key:\"%s\",transport:\"%s\",mac:\"%s\"}"
+
+const listenConnectFmt = " [listen] connect{challenge:\"%s\",key:\"%s\",mac:\"%s\"}"
+
+// ListenConnectLength is the exact length of the listen connect signature
+var ListenConnectLength = len(fmt.Sprintf(listenConnectFmt, toHex(0), strings.Repeat("0", 64), strings.Repeat("0", sha256.Size*2)))
+
+// spyStartMaxLength is the length of the spy start signature with the longest transport
+var spyStartMaxLength = len(fmt.Sprintf(spyStartFmt, toHex(0), toHex(0), strings.Repeat("0", 64), lo.MaxBy([]config.TransportType{config.Raw, config.Tmux, config.Screen}, func(a, b config.TransportType) bool {
+	return len(a) > len(b)
+}), strings.Repeat("0", sha256.Size*2)))
 
 type SpyStart struct {
-	timestamp uint64
-	seed      uint64
-	checksum  uint64
+	timestamp  uint64
+	nonce      uint64
+	key        string
+	transport  config.TransportType
+	mac        string
+	privateKey *ecdh.PrivateKey // only known to the spy-mode that created it
 }
 
 func GenerateSpyStart(s *SpyStart) string {
-	return fmt.Sprintf(spyStartFmt, toHex(s.timestamp), toHex(s.seed), toHex(calculateChecksum(s.seed)))
+	return fmt.Sprintf(spyStartFmt, toHex(s.timestamp), toHex(s.nonce), s.key, s.transport, s.mac)
 }
 
-func NewSpyStart() *SpyStart {
+func NewSpyStart(transport config.TransportType) *SpyStart {
 	s := SpyStart{}
 	s.timestamp = uint64(time.Now().UnixNano())
-	s.seed = rand.Uint64()
-	s.checksum = calculateChecksum(s.seed)
+	s.nonce = randomUint64()
+	s.privateKey, s.key = generateKey()
+	s.transport = transport
+	s.mac = calculateMac("spy-start", toHex(s.timestamp), toHex(s.nonce), s.key, string(s.transport))
 	return &s
 }
 
+func (s *SpyStart) Prefix() string {
+	return literalPrefix(SpyStartRegex)
+}
+
+func (s *SpyStart) MaxLength() int {
+	return spyStartMaxLength
+}
+
 func (s *SpyStart) Find(in string) (matchEndIndex int) {
 	groups, matchEndIndex := findRegex(in, SpyStartRegex)
 	if matchEndIndex == -1 {
@@ -41,26 +88,191 @@ func (s *SpyStart) Find(in string) (matchEndIndex int) {
 	}
 
 	s.timestamp, _ = fromHex(groups[1])
-	s.seed, _ = fromHex(groups[2])
-	s.checksum, _ = fromHex(groups[3])
+	s.nonce, _ = fromHex(groups[2])
+	s.key = groups[3]
+	s.transport = config.TransportType(groups[4])
+	s.mac = groups[5]
 
-	if !s.isChecksumValid() {
-		logrus.Warnf("invalid checksum on handshake signature: %+v", s)
-		return matchEndIndex
+	return matchEndIndex
+}
+
+// Verify is used by listen-mode to make sure the signature is printed by a genuine spy-mode, and that it is not
+// replayed
+func (s *SpyStart) Verify() error {
+	if !hmac.Equal([]byte(s.mac), []byte(calculateMac("spy-start", toHex(s.timestamp), toHex(s.nonce), s.key, string(s.transport)))) {
+		return fmt.Errorf("%w: spy-mode does not know the secret", ErrUnauthenticated)
 	}
 
+	// the clock of the server may be off, the nonce and the hello proof are what stop replays
 	if s.timestampAge() > config.Config.Transfer.ConnectionTimeout {
-		logrus.Warnf("the handshake signature was too old: %+v", s)
-		return matchEndIndex
+		logrus.Warnf("the spy start signature is %s old, or the clocks of the two sides disagree", s.timestampAge().Round(time.Second))
 	}
 
-	return matchEndIndex
+	if !usedNonces.use(s.nonce) {
+		return fmt.Errorf("%w: spy start signature is replayed", ErrUnauthenticated)
+	}
+
+	return nil
 }
 
-func (s *SpyStart) isChecksumValid() bool {
-	return s.checksum == calculateChecksum(s.seed)
+// Transport tells how spy-mode gets its output past the terminal multiplexer it runs in
+func (s *SpyStart) Transport() config.TransportType {
+	return s.transport
 }
 
 func (s *SpyStart) timestampAge() time.Duration {
 	return time.Duration(math.Abs(float64(s.timestamp) - float64(time.Now().UnixNano())))
 }
+
+// ---------------------------------------------------------------------------
+
+type ListenConnect struct {
+	challenge  uint64
+	key        string
+	mac        string
+	privateKey *ecdh.PrivateKey // only known to the listen-mode that created it
+}
+
+// NewListenConnect creates the response of listen-mode to the given spy start signature
+func NewListenConnect(spy *SpyStart) *ListenConnect {
+	l := ListenConnect{}
+	l.challenge = randomUint64()
+	l.privateKey, l.key = generateKey()
+	l.mac = calculateMac("listen-connect", toHex(spy.nonce), spy.key, toHex(l.challenge), l.key)
+	return &l
+}
+
+func GenerateListenConnect(l *ListenConnect) string {
+	return fmt.Sprintf(listenConnectFmt, toHex(l.challenge), l.key, l.mac)
+}
+
+func (l *ListenConnect) Prefix() string {
+	return literalPrefix(ListenConnectRegex)
+}
+
+func (l *ListenConnect) MaxLength() int {
+	return ListenConnectLength
+}
+
+func (l *ListenConnect) Find(in string) (matchEndIndex int) {
+	groups, matchEndIndex := findRegex(in, ListenConnectRegex)
+	if matchEndIndex == -1 {
+		return matchEndIndex
+	}
+
+	l.challenge, _ = fromHex(groups[1])
+	l.key = groups[2]
+	l.mac = groups[3]
+
+	return matchEndIndex
+}
+
+// Verify is used by spy-mode to make sure the response comes from a genuine listen-mode
+func (l *ListenConnect) Verify(spy *SpyStart) error {
+	if !hmac.Equal([]byte(l.mac), []byte(calculateMac("listen-connect", toHex(spy.nonce), spy.key, toHex(l.challenge), l.key))) {
+		return fmt.Errorf("%w: listen-mode does not know the secret", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// HelloProof is sent by spy-mode in response to the challenge of listen-mode
+func HelloProof(spy *SpyStart, l *ListenConnect) string {
+	return calculateMac("spy-hello", toHex(l.challenge), toHex(spy.nonce))
+}
+
+// VerifyHelloProof is used by listen-mode to check the proof received from spy-mode
+func VerifyHelloProof(spy *SpyStart, l *ListenConnect, proof string) error {
+	if !hmac.Equal([]byte(proof), []byte(HelloProof(spy, l))) {
+		return fmt.Errorf("%w: spy-mode failed the challenge", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// TunnelKeys derives the keys that spy-mode seals and opens the tunnel with, it needs the spy start it created
+func TunnelKeys(spy *SpyStart, l *ListenConnect) (seal []byte, open []byte, err error) {
+	return deriveKeys(spy, l, spy.privateKey, l.key)
+}
+
+// ListenTunnelKeys derives the keys that listen-mode seals and opens the tunnel with, it needs the listen connect
+// it created
+func ListenTunnelKeys(spy *SpyStart, l *ListenConnect) (seal []byte, open []byte, err error) {
+	toListen, toSpy, err := deriveKeys(spy, l, l.privateKey, spy.key)
+	return toSpy, toListen, err
+}
+
+func deriveKeys(spy *SpyStart, l *ListenConnect, privateKey *ecdh.PrivateKey, peerKey string) (toListen []byte, toSpy []byte, err error) {
+	if privateKey == nil {
+		return nil, nil, errors.New("the private key of the handshake is not known on this side")
+	}
+	peerKeyBytes, err := hex.DecodeString(peerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerPublicKey, err := ecdh.X25519().NewPublicKey(peerKeyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := privateKey.ECDH(peerPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := strings.Join([]string{"unbound-ssh tunnel", toHex(spy.nonce), spy.key, toHex(l.challenge), l.key}, "|")
+	keys := hkdf.New(sha256.New, shared, config.Secret, []byte(info))
+	toListen = make([]byte, 32)
+	toSpy = make([]byte, 32)
+	if _, err := stdio.ReadFull(keys, toListen); err != nil {
+		return nil, nil, err
+	}
+	if _, err := stdio.ReadFull(keys, toSpy); err != nil {
+		return nil, nil, err
+	}
+	return toListen, toSpy, nil
+}
+
+// ---------------------------------------------------------------------------
+
+func generateKey() (*ecdh.PrivateKey, string) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		// the system random source never fails in practice
+		panic(err)
+	}
+	return privateKey, strings.ToUpper(hex.EncodeToString(privateKey.PublicKey().Bytes()))
+}
+
+// randomUint64 generates the nonce and the challenge of the handshake, which must not be predictable
+func randomUint64() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// the system random source never fails in practice
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func calculateMac(parts ...string) string {
+	mac := hmac.New(sha256.New, config.Secret)
+	mac.Write([]byte(strings.Join(parts, "|")))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// usedNonces remembers every nonce that listen-mode accepted, for as long as it runs, as a signature of any age is
+// accepted
+var usedNonces = &nonceCache{nonces: map[uint64]struct{}{}}
+
+type nonceCache struct {
+	lock   sync.Mutex
+	nonces map[uint64]struct{}
+}
+
+func (c *nonceCache) use(nonce uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = struct{}{}
+	return true
+}
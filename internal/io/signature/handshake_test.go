@@ -1,18 +1,121 @@
 package signature
 
 import (
+	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/stretchr/testify/require"
 	"testing"
 	"time"
 )
 
+func withSecret(t *testing.T, secret string) {
+	original := config.Secret
+	config.Secret = []byte(secret)
+	t.Cleanup(func() {
+		config.Secret = original
+	})
+}
+
 func TestSpyHelloSignature(t *testing.T) {
+	withSecret(t, "secret")
 	now := uint64(time.Now().UnixNano())
-	sig := GenerateSpyStart(NewSpyStart())
+	sig := GenerateSpyStart(NewSpyStart(config.Tmux))
 
 	extracted := SpyStart{}
 	matchEndIndex := (&extracted).Find(sig)
 
 	require.Equal(t, len(sig), matchEndIndex)
+	require.Equal(t, config.Tmux, extracted.Transport())
 	require.Less(t, int64(extracted.timestamp)-int64(now), time.Second)
+	require.NoError(t, extracted.Verify())
+
+	// the very same signature must not be accepted twice
+	require.ErrorIs(t, extracted.Verify(), ErrUnauthenticated)
+}
+
+func TestSpyHelloSignatureWrongSecret(t *testing.T) {
+	withSecret(t, "secret")
+	sig := GenerateSpyStart(NewSpyStart(config.Raw))
+
+	withSecret(t, "another secret")
+	extracted := SpyStart{}
+	require.Equal(t, len(sig), extracted.Find(sig))
+	require.ErrorIs(t, extracted.Verify(), ErrUnauthenticated)
+}
+
+func TestSpyHelloSignatureClockSkew(t *testing.T) {
+	withSecret(t, "secret")
+	spyStart := NewSpyStart(config.Raw)
+	spyStart.timestamp -= uint64(2 * config.Config.Transfer.ConnectionTimeout)
+	spyStart.mac = calculateMac("spy-start", toHex(spyStart.timestamp), toHex(spyStart.nonce), spyStart.key, string(spyStart.transport))
+	sig := GenerateSpyStart(spyStart)
+
+	extracted := SpyStart{}
+	require.Equal(t, len(sig), extracted.Find(sig))
+	require.NoError(t, extracted.Verify())
+	// the same signature can not be used twice though
+	require.ErrorIs(t, extracted.Verify(), ErrUnauthenticated)
+}
+
+func TestSpyHelloSignatureReplayedLater(t *testing.T) {
+	withSecret(t, "secret")
+	connectionTimeout := config.Config.Transfer.ConnectionTimeout
+	config.Config.Transfer.ConnectionTimeout = time.Millisecond
+	t.Cleanup(func() {
+		config.Config.Transfer.ConnectionTimeout = connectionTimeout
+	})
+	sig := GenerateSpyStart(NewSpyStart(config.Raw))
+
+	extracted := SpyStart{}
+	require.Equal(t, len(sig), extracted.Find(sig))
+	require.NoError(t, extracted.Verify())
+
+	// a signature captured from a recording is not accepted again once it is old
+	time.Sleep(5 * time.Millisecond)
+	require.ErrorIs(t, extracted.Verify(), ErrUnauthenticated)
+}
+
+func TestListenConnectSignature(t *testing.T) {
+	withSecret(t, "secret")
+	spyStart := NewSpyStart(config.Raw)
+	sig := GenerateListenConnect(NewListenConnect(spyStart))
+	require.Equal(t, ListenConnectLength, len(sig))
+
+	extracted := ListenConnect{}
+	require.Equal(t, len(sig), extracted.Find(sig))
+	require.NoError(t, extracted.Verify(spyStart))
+	require.NoError(t, VerifyHelloProof(spyStart, &extracted, HelloProof(spyStart, &extracted)))
+
+	// a listen connect that answers another spy start is refused
+	require.ErrorIs(t, extracted.Verify(NewSpyStart(config.Raw)), ErrUnauthenticated)
+	require.ErrorIs(t, VerifyHelloProof(spyStart, &extracted, "proof"), ErrUnauthenticated)
+}
+
+func TestTunnelKeys(t *testing.T) {
+	withSecret(t, "secret")
+	spyStart := NewSpyStart(config.Raw)
+	listenConnect := NewListenConnect(spyStart)
+
+	// each side only knows its own private key
+	receivedSpyStart := SpyStart{}
+	receivedSpyStart.Find(GenerateSpyStart(spyStart))
+	receivedListenConnect := ListenConnect{}
+	receivedListenConnect.Find(GenerateListenConnect(listenConnect))
+
+	spySeal, spyOpen, err := TunnelKeys(spyStart, &receivedListenConnect)
+	require.NoError(t, err)
+	listenSeal, listenOpen, err := ListenTunnelKeys(&receivedSpyStart, listenConnect)
+	require.NoError(t, err)
+	require.Equal(t, spySeal, listenOpen)
+	require.Equal(t, spyOpen, listenSeal)
+	require.NotEqual(t, spySeal, spyOpen)
+
+	// a side that did not create the handshake cannot derive them
+	_, _, err = TunnelKeys(&receivedSpyStart, &receivedListenConnect)
+	require.Error(t, err)
+
+	// nor can a side with another secret
+	withSecret(t, "another secret")
+	otherSeal, _, err := TunnelKeys(spyStart, &receivedListenConnect)
+	require.NoError(t, err)
+	require.NotEqual(t, spySeal, otherSeal)
 }
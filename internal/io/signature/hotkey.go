@@ -0,0 +1,48 @@
+package signature
+
+import (
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"strings"
+)
+
+// Hotkey is a key sequence that the user presses to trigger an action, see the [keys] section of the config
+type Hotkey struct {
+	Action config.KeyAction
+	keys   string
+}
+
+// NewHotkey returns nil if the action is disabled
+func NewHotkey(action config.KeyAction) *Hotkey {
+	keys := config.Config.KeySequence(action).Bytes()
+	if len(keys) == 0 {
+		return nil
+	}
+	return &Hotkey{Action: action, keys: string(keys)}
+}
+
+// Hotkeys returns the signatures of the actions that are enabled
+func Hotkeys(actions ...config.KeyAction) []Signature {
+	var hotkeys []Signature
+	for _, action := range actions {
+		if hotkey := NewHotkey(action); hotkey != nil {
+			hotkeys = append(hotkeys, hotkey)
+		}
+	}
+	return hotkeys
+}
+
+func (h *Hotkey) Prefix() string {
+	return h.keys
+}
+
+func (h *Hotkey) MaxLength() int {
+	return len(h.keys)
+}
+
+func (h *Hotkey) Find(in string) (matchEndIndex int) {
+	idx := strings.Index(in, h.keys)
+	if idx == -1 {
+		return -1
+	}
+	return idx + len(h.keys)
+}
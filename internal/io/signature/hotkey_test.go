@@ -0,0 +1,26 @@
+package signature
+
+import (
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestHotkey(t *testing.T) {
+	original := config.Config.Keys
+	t.Cleanup(func() {
+		config.Config.Keys = original
+	})
+	config.Config.Keys.Preflight = "^T^T"
+	config.Config.Keys.Status = ""
+
+	hotkeys := Hotkeys(config.PreflightAction, config.StatusAction)
+	require.Len(t, hotkeys, 1)
+	require.Nil(t, NewHotkey(config.StatusAction))
+
+	preflight := hotkeys[0].(*Hotkey)
+	require.Equal(t, config.PreflightAction, preflight.Action)
+	require.Equal(t, "\x14\x14", preflight.Prefix())
+	require.Equal(t, 4, preflight.Find("ls\x14\x14\x14"))
+	require.Equal(t, -1, preflight.Find("ls\x07\x07\x07"))
+}
@@ -13,6 +13,10 @@ func NewRegexSignature(regex *regexp.Regexp) *RegexSignature {
 	return &RegexSignature{regex: regex}
 }
 
+func (s *RegexSignature) Prefix() string {
+	return literalPrefix(s.regex)
+}
+
 func (s *RegexSignature) Find(in string) (matchEndIndex int) {
 	s.Groups, matchEndIndex = findRegex(in, s.regex)
 	return matchEndIndex
@@ -3,52 +3,53 @@ package term
 import (
 	"context"
 	"errors"
-	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/sirupsen/logrus"
 	"io"
 )
 
+// ReadInBackground consumes stdin while it is not forwarded anywhere, and reacts to the hotkeys that are pressed
 type ReadInBackground struct {
-	Stdin     io.Reader
-	reactions map[byte]func()
-	buf       []byte
+	Stdin     *core.ContextReader
+	reactions map[*signature.Hotkey]func()
 }
 
-func NewReadInBackground(stdin io.Reader) ReadInBackground {
-	return ReadInBackground{Stdin: stdin, reactions: map[byte]func(){}, buf: make([]byte, 1)}
+func NewReadInBackground(stdin *core.ContextReader) ReadInBackground {
+	return ReadInBackground{Stdin: stdin, reactions: map[*signature.Hotkey]func(){}}
 }
 
-func (r *ReadInBackground) ReactTo(key byte, with func()) *ReadInBackground {
-	r.reactions[key] = with
+// ReactTo ignores a nil hotkey, i.e. a disabled action
+func (r *ReadInBackground) ReactTo(hotkey *signature.Hotkey, with func()) *ReadInBackground {
+	if hotkey != nil {
+		r.reactions[hotkey] = with
+	}
 	return r
 }
 
 func (r *ReadInBackground) Start(ctx context.Context) {
+	hotkeys := make([]signature.Signature, 0, len(r.reactions))
+	for hotkey := range r.reactions {
+		hotkeys = append(hotkeys, hotkey)
+	}
+	detector := core.NewSignatureDetector(hotkeys...)
+
 	go func() {
+		reader := detector.Wrap(r.Stdin).BindTo(ctx)
 		for {
-			c, err := r.fetchByte(ctx)
-			if err != nil {
-				if !errors.Is(err, context.Canceled) {
-					logrus.Warnf("error reading from stdin: %s", err.Error())
-				}
-				return
+			_, err := io.Copy(io.Discard, reader)
+			if errors.Is(err, core.SignatureFound) {
+				hotkey := detector.LastMatch().(*signature.Hotkey)
+				logrus.Debugf("reacting to received hotkey: %s", hotkey.Action)
+				r.reactions[hotkey]()
+				detector.Reset()
+				continue
 			}
 
-			if reaction, ok := r.reactions[c]; ok {
-				logrus.Debug(fmt.Sprintf("reacting to received key: %x [%c]", c, c))
-				reaction()
+			if err != nil && !errors.Is(err, context.Canceled) {
+				logrus.Warnf("error reading from stdin: %s", err.Error())
 			}
+			return
 		}
 	}()
 }
-
-func (r *ReadInBackground) fetchByte(ctx context.Context) (byte, error) {
-	err := ctx.Err()
-	if err == nil {
-		n := 0
-		for n == 0 && err == nil {
-			n, err = r.Stdin.Read(r.buf)
-		}
-	}
-	return r.buf[0], err
-}
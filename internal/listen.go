@@ -2,51 +2,383 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/ctl"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/ztrue/tracerr"
+	"golang.org/x/sync/errgroup"
+	"os"
+	"strings"
+	"time"
 )
 
-func Listen(cmd []string) error {
-	ctx := context.Background()
-	// create base state
-	baseState, err := listen.CreateBaseState(cmd)
-	defer baseState.Close()
+// ListenOptions are the flags of listen-mode
+type ListenOptions struct {
+	// Headless leaves the terminal alone and launches spy-mode as soon as the shell prompts
+	Headless bool
+	// Stdio is the bind address of a service that stdin/stdout is piped to, it implies Headless
+	Stdio string
+	// Auto runs the preflight script and launches spy-mode once the shell prompts for the first time
+	Auto bool
+}
+
+func Listen(cmd []string, options ListenOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sessions := config.Config.Sessions(cmd)
+	if len(sessions) == 0 {
+		return tracerr.New("nothing to run, pass an ssh command or define a [[session]] in the config file")
+	}
+
+	var stdioService config.ServiceDescription
+	if options.Stdio != "" {
+		var found bool
+		stdioService, found = lo.Find(config.Config.Service, func(s config.ServiceDescription) bool {
+			return s.Bind.FullAddress() == options.Stdio
+		})
+		if !found {
+			return tracerr.Errorf("no service binds %s to pipe stdin/stdout to", options.Stdio)
+		}
+		options.Headless = true
+	}
+
+	// share the terminal between sessions
+	var terminal *listen.Terminal
+	if options.Headless {
+		terminal = listen.NewHeadlessTerminal()
+	} else {
+		var err error
+		terminal, err = listen.NewTerminal()
+		if err != nil {
+			return tracerr.Wrap(err)
+		}
+	}
+	defer terminal.Close()
+
+	// create a base state per session
+	baseStates := make([]*listen.BaseState, 0, len(sessions))
+	defer func() {
+		for _, baseState := range baseStates {
+			baseState.Close()
+		}
+	}()
+	services := config.Config.SessionServices(sessions)
+	for _, session := range sessions {
+		baseState, err := listen.CreateBaseState(session.Name, session.Command, services, terminal)
+		if err != nil {
+			return tracerr.Wrap(err)
+		}
+		baseStates = append(baseStates, baseState)
+	}
+
+	// allow managing the sessions from another terminal
+	ctlServer, err := ctl.Listen(config.ProcessString(config.Config.Ctl.Socket))
 	if err != nil {
-		return tracerr.Wrap(err)
+		logrus.Warnf("ctl is disabled: %s", err.Error())
+	} else {
+		defer func() {
+			_ = ctlServer.Close()
+		}()
+		serveCtl(ctlServer, terminal, baseStates)
+	}
+
+	// the sessions are over once the process that uses the pipe is done with it
+	if options.Stdio != "" {
+		go func() {
+			if err := listen.PipeStdio(ctx, stdioService, os.Stdin, os.Stdout); err != nil {
+				logrus.Warnf("stdin/stdout pipe failed: %s", err.Error())
+			}
+			cancel()
+			for _, baseState := range baseStates {
+				baseState.Close()
+			}
+		}()
+	}
+
+	// a session that ends does not end the others
+	group := errgroup.Group{}
+	for i, baseState := range baseStates {
+		baseState, login := baseState, sessions[i].Login
+		group.Go(func() error {
+			defer baseState.Close()
+			err := runSession(ctx, baseState, login, options)
+			if err != nil {
+				logrus.Warnf("session \"%s\" ended with error: %s", baseState.Name, err.Error())
+			} else {
+				logrus.Infof("session \"%s\" ended.", baseState.Name)
+			}
+			return err
+		})
+	}
+	err = group.Wait()
+	if ctx.Err() != nil {
+		// the sessions are cut short once the stdin/stdout pipe is closed
+		return nil
+	}
+	return err
+}
+
+func runSession(ctx context.Context, baseState *listen.BaseState, login []config.LoginStep, options ListenOptions) error {
+	// run the login script first, the session goes on as usual if it fails
+	if len(login) > 0 {
+		baseState.SetStatus("login")
+		loginState := listen.NewLoginState(baseState, login)
+		if err := loginState.Run(ctx); err != nil {
+			logrus.Warnf("login state failed, transitioning to wiretap state: %s", err.Error())
+		}
+	}
+
+	// get to spy-mode without keystrokes, the session goes on as usual if it fails
+	if options.Auto {
+		baseState.SetStatus("auto")
+		autoState := listen.NewAutoState(baseState)
+		spyStart, err := autoState.Run(ctx)
+		if err != nil {
+			logrus.Warnf("auto state failed, transitioning to wiretap state: %s", err.Error())
+		} else if spyStart != nil {
+			connect(ctx, baseState, spyStart)
+		}
 	}
 
 	// transition to wiretap state
 	wiretapState := listen.CreateWiretapState(baseState)
+	launcher := spyLauncher{}
 
 	for {
 		// run wiretap state, continue only if SignatureFound error is returned
-		stdinSigs := []signature.Signature{&signature.Preflight{}}
+		stdinSigs := signature.Hotkeys(config.PreflightAction, config.ConnectNowAction, config.StatusAction, config.UploadAction, config.DownloadAction, config.UninstallAction)
 		ptyStdoutSigs := []signature.Signature{&signature.SpyStart{}}
+		prompt := signature.NewRegexSignature(config.Config.Launch.Prompt.Regexp())
+		if options.Headless {
+			ptyStdoutSigs = append(ptyStdoutSigs, prompt)
+		}
 
-		found, err := wiretapState.TransferUntilFound(ctx, stdinSigs, ptyStdoutSigs)
+		baseState.SetStatus("wiretap")
+		wiretapCtx, stopWaiting := waitForTransfer(ctx, baseState)
+		launchCtx, stopLaunchWait := launcher.waitUntilDue(wiretapCtx)
+		found, err := wiretapState.TransferUntilFound(launchCtx, stdinSigs, ptyStdoutSigs)
+		due := found == nil && ctx.Err() == nil && errors.Is(launchCtx.Err(), context.DeadlineExceeded)
+		stopLaunchWait()
+		if request, ok := stopWaiting(); ok {
+			logrus.Infof("%s of %s requested through ctl, transitioning to %s state.", request.Action, request.Path, request.Action)
+			runTransfer(ctx, baseState, request)
+			continue
+		}
+		if due {
+			// no spy hello showed up after the prompt, so it was the shell that prompted
+			found, err = prompt, nil
+		}
 		if err != nil {
 			return err
 		}
 
-		if _, ok := found.(*signature.SpyStart); ok {
+		if spyStart, ok := found.(*signature.SpyStart); ok {
 			logrus.Info("spy hello signature detected, transitioned to connecting state.")
-			// transition to connecting state for handshake
-			connectingState := listen.NewConnectingState(baseState)
-			err := connectingState.Connect(ctx)
-			if err != nil {
-				logrus.Warnf("connecting/connected state failed, transitioning back to wiretap state: %s", err.Error())
+			launcher.connected()
+			connect(ctx, baseState, spyStart)
+		} else if found == prompt {
+			if !launcher.prompted(time.Now()) {
+				logrus.Debugf("shell prompt detected, launching spy-mode at %s unless it says hello by then.", launcher.due.Format(time.TimeOnly))
+				continue
 			}
-		} else if _, ok := found.(*signature.Preflight); ok {
-			logrus.Info("preflight signature detected, transitioning to preflight state.")
-			preflightState := listen.NewPreflightState(baseState)
-			err := preflightState.Run(ctx)
-			if err != nil {
-				logrus.Warnf("preflight state failed transitioning back to wiretap state: %s", err.Error())
+			launcher.launched(time.Now())
+			logrus.Info("shell prompt detected, launching spy-mode.")
+			if _, err := baseState.Pty.Write([]byte(config.Config.LaunchCommand() + "\r")); err != nil {
+				return tracerr.Wrap(err)
 			}
+		} else if hotkey, ok := found.(*signature.Hotkey); ok {
+			runHotkey(ctx, baseState, hotkey.Action)
 		} else {
 			return nil
 		}
 	}
 }
+
+// spyLauncher tells when a headless session may launch spy-mode at a prompt. spy-mode says hello as soon as it starts
+// and gives up on listen-mode after the connection timeout, so a prompt-like output that shows up before then may come
+// from a spy-mode that is still running, and the launch command is only typed once that has passed without a hello.
+type spyLauncher struct {
+	// due is when the next launch may be typed
+	due time.Time
+	// pending is set by a prompt that showed up before the next launch was due
+	pending bool
+}
+
+// prompted reports whether spy-mode can be launched at a prompt that shows up at now, it is left pending otherwise
+func (l *spyLauncher) prompted(now time.Time) bool {
+	if now.Before(l.due) {
+		l.pending = true
+		return false
+	}
+	return true
+}
+
+func (l *spyLauncher) launched(now time.Time) {
+	// a spy-mode that can not start is not relaunched in a loop either
+	l.due = now.Add(max(config.Config.Launch.RetryInterval, config.Config.Transfer.ConnectionTimeout))
+	l.pending = false
+}
+
+// connected drops the pending prompt, as it was followed by a spy hello
+func (l *spyLauncher) connected() {
+	l.pending = false
+}
+
+// waitUntilDue returns a context that expires once the pending launch is due
+func (l *spyLauncher) waitUntilDue(ctx context.Context) (context.Context, context.CancelFunc) {
+	if !l.pending {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, l.due)
+}
+
+func connect(ctx context.Context, baseState *listen.BaseState, spyStart *signature.SpyStart) {
+	// transition to connecting state for handshake
+	baseState.SetStatus("connected")
+	connectingState := listen.NewConnectingState(baseState, spyStart)
+	err := connectingState.Connect(ctx)
+	if err != nil {
+		logrus.Warnf("connecting/connected state failed, transitioning back to wiretap state: %s", err.Error())
+	}
+}
+
+func runHotkey(ctx context.Context, baseState *listen.BaseState, action config.KeyAction) {
+	switch action {
+	case config.PreflightAction:
+		logrus.Info("preflight hotkey pressed, transitioning to preflight state.")
+		baseState.SetStatus("preflight")
+		preflightState := listen.NewPreflightState(baseState)
+		if err := preflightState.Run(ctx); err != nil {
+			logrus.Warnf("preflight state failed transitioning back to wiretap state: %s", err.Error())
+		}
+	case config.ConnectNowAction:
+		logrus.Info("connect-now hotkey pressed, launching spy-mode.")
+		if _, err := baseState.Pty.Write([]byte(config.Config.LaunchCommand() + "\r")); err != nil {
+			logrus.Warnf("failed to launch spy-mode: %s", err.Error())
+		}
+	case config.StatusAction:
+		baseState.PrintStatus()
+	case config.UploadAction, config.DownloadAction, config.UninstallAction:
+		logrus.Infof("%s hotkey pressed, transitioning to %s state.", action, action)
+		runTransfer(ctx, baseState, listen.TransferRequest{Action: action})
+	}
+}
+
+// waitForTransfer returns a context that is canceled once a transfer is requested through ctl, stop cancels it anyway
+// and returns the request if there is one
+func waitForTransfer(ctx context.Context, baseState *listen.BaseState) (context.Context, func() (listen.TransferRequest, bool)) {
+	ctx, cancel := context.WithCancel(ctx)
+	requested := make(chan listen.TransferRequest, 1)
+	go func() {
+		defer close(requested)
+		select {
+		case request := <-baseState.Transfers():
+			requested <- request
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() (listen.TransferRequest, bool) {
+		cancel()
+		request, ok := <-requested
+		return request, ok
+	}
+}
+
+// runTransfer runs upload, download or uninstall state, the path of a transfer is asked for if it is empty
+func runTransfer(ctx context.Context, baseState *listen.BaseState, request listen.TransferRequest) {
+	baseState.SetStatus(string(request.Action))
+	var err error
+	switch request.Action {
+	case config.DownloadAction:
+		downloadState := listen.NewDownloadState(baseState, request.Path)
+		err = downloadState.Run(ctx)
+	case config.UninstallAction:
+		uninstallState := listen.NewUninstallState(baseState)
+		err = uninstallState.Run(ctx)
+	default:
+		uploadState := listen.NewUploadState(baseState, request.Path)
+		err = uploadState.Run(ctx)
+	}
+	if err != nil {
+		logrus.Warnf("%s state failed transitioning back to wiretap state: %s", request.Action, err.Error())
+	}
+}
+
+func serveCtl(server *ctl.Server, terminal *listen.Terminal, baseStates []*listen.BaseState) {
+	server.
+		Handle("list", func(args []string) (string, error) {
+			foreground := terminal.Foreground()
+			lines := make([]string, 0, len(baseStates))
+			for _, baseState := range baseStates {
+				marker := " "
+				if baseState.Name == foreground {
+					marker = "*"
+				}
+				lines = append(lines, fmt.Sprintf("%s %-20s %-10s pid %d", marker, baseState.Name, baseState.Status(), baseState.Process.Process.Pid))
+			}
+			return strings.Join(lines, "\n"), nil
+		}).
+		Handle("switch", func(args []string) (string, error) {
+			if len(args) != 1 {
+				return "", tracerr.New("usage: switch <session>")
+			}
+			return "", terminal.Switch(args[0])
+		}).
+		Handle("upload", transferHandler(config.UploadAction, terminal, baseStates)).
+		Handle("download", transferHandler(config.DownloadAction, terminal, baseStates)).
+		Handle("uninstall", func(args []string) (string, error) {
+			if len(args) > 1 {
+				return "", tracerr.New("usage: uninstall [session]")
+			}
+			baseState, err := wiretapSession(terminal, baseStates, args)
+			if err != nil {
+				return "", err
+			}
+			if err := baseState.RequestTransfer(listen.TransferRequest{Action: config.UninstallAction}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("uninstall queued in session \"%s\", see its terminal for the result", baseState.Name), nil
+		}).
+		Serve()
+}
+
+// transferHandler queues an upload or a download on the foreground session or the one that is named
+func transferHandler(action config.KeyAction, terminal *listen.Terminal, baseStates []*listen.BaseState) ctl.Handler {
+	return func(args []string) (string, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return "", tracerr.Errorf("usage: %s <path> [session]", action)
+		}
+		baseState, err := wiretapSession(terminal, baseStates, args[1:])
+		if err != nil {
+			return "", err
+		}
+		if err := baseState.RequestTransfer(listen.TransferRequest{Action: action, Path: args[0]}); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s of %s queued in session \"%s\", see its terminal for progress", action, args[0], baseState.Name), nil
+	}
+}
+
+// wiretapSession is the session that is named in args, or the foreground one if args is empty, as long as it is in
+// wiretap state
+func wiretapSession(terminal *listen.Terminal, baseStates []*listen.BaseState, args []string) (*listen.BaseState, error) {
+	name := terminal.Foreground()
+	if len(args) > 0 {
+		name = args[0]
+	}
+	baseState, found := lo.Find(baseStates, func(b *listen.BaseState) bool {
+		return b.Name == name
+	})
+	if !found {
+		return nil, tracerr.Errorf("no session named \"%s\"", name)
+	} else if status := baseState.Status(); status != "wiretap" {
+		return nil, tracerr.Errorf("session \"%s\" is in %s state, requests only start from wiretap state", name, status)
+	}
+	return baseState, nil
+}
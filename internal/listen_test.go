@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDefaultPrompt(t *testing.T) {
+	prompt := signature.NewRegexSignature(config.Config.Launch.Prompt.Regexp())
+
+	for _, in := range []string{"$ ", "shell#>", "Last login: today\r\nuser@server:~$ ", "motd\r\n[root@server ~]# ", "\r\n% "} {
+		require.NotEqual(t, -1, prompt.Find(in), "%q is a prompt", in)
+	}
+	for _, in := range []string{"Last login: today\r\n", "downloading\r 50%", "motd\r\n<html>\r\n<body>\r\n50% done\r 75%", "running"} {
+		require.Equal(t, -1, prompt.Find(in), "%q is not a prompt", in)
+	}
+}
+
+func TestSpyLauncher(t *testing.T) {
+	retryInterval, connectionTimeout := config.Config.Launch.RetryInterval, config.Config.Transfer.ConnectionTimeout
+	config.Config.Launch.RetryInterval, config.Config.Transfer.ConnectionTimeout = time.Second, 10*time.Second
+	t.Cleanup(func() {
+		config.Config.Launch.RetryInterval, config.Config.Transfer.ConnectionTimeout = retryInterval, connectionTimeout
+	})
+	now := time.Now()
+	launcher := spyLauncher{}
+
+	// the first prompt launches right away
+	require.True(t, launcher.prompted(now))
+	launcher.launched(now)
+
+	// a prompt while spy-mode may be running is left pending until the connection timeout passes
+	require.False(t, launcher.prompted(now.Add(5*time.Second)))
+	ctx, cancel := launcher.waitUntilDue(context.Background())
+	deadline, ok := ctx.Deadline()
+	cancel()
+	require.True(t, ok)
+	require.Equal(t, now.Add(10*time.Second), deadline)
+	require.True(t, launcher.prompted(deadline))
+
+	// a spy hello drops the pending prompt
+	launcher.connected()
+	ctx, cancel = launcher.waitUntilDue(context.Background())
+	_, ok = ctx.Deadline()
+	cancel()
+	require.False(t, ok)
+}
@@ -2,14 +2,18 @@ package mode
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/ztrue/tracerr"
 	"reflect"
-	"time"
 )
 
 type MessageId = uint32
 
-var typeRegistry = []any{HelloExchange{}, RegisterStreamExchange{}}
+// ProtocolVersion is bumped whenever listen-mode and spy-mode can no longer understand each other
+const ProtocolVersion = 5
+
+var typeRegistry = []any{HelloExchange{}}
+var messageRegistry = []any{CancelRequest{}, ErrorResponse{}}
 var commandRegistry map[string]reflect.Type
 
 // ----------------------------------------------------------------------------------------
@@ -21,27 +25,44 @@ type Exchange[Request, Response any] struct {
 
 // HelloExchange used to send hello from listen-mode to spy-mode and receive a response
 type HelloExchange = Exchange[HelloRequest, HelloResponse]
-type HelloRequest struct{}
-type HelloResponse struct{}
-
-// RegisterStreamExchange used to communicate from listen-mode to spy-mode how to serve the next established stream
-type RegisterStreamExchange = Exchange[RegisterStreamRequest, RegisterStreamResponse]
-type RegisterStreamRequest struct {
-	StreamId      uint32 `json:"stream_id"`
-	ServiceNumber int    `json:"service_number"`
+type HelloRequest struct {
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	Session         string `json:"session,omitempty"` // the listen-mode session this spy-mode belongs to
+}
+type HelloResponse struct {
+	Error string `json:"error,omitempty"`
+	Proof string `json:"proof,omitempty"` // the response of spy-mode to the handshake challenge
 }
-type RegisterStreamResponse struct {
-	Error string `json:"error"`
+
+// CancelRequest is a one-way message that tells the other side to stop processing a request that we no longer wait for
+type CancelRequest struct {
+	RequestId MessageId `json:"request_id"`
+}
+
+type ErrorCode string
+
+const (
+	ErrorInternal  ErrorCode = "internal"  // the handler of the request failed
+	ErrorUnhandled ErrorCode = "unhandled" // no handler was registered for the request in time
+)
+
+// ErrorResponse is sent back instead of the expected response of any exchange when the request could not be served
+type ErrorResponse struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Code, e.Message)
 }
 
 // ----------------------------------------------------------------------------------------
 
 type ControlMessage struct {
-	Id           MessageId     `json:"id,omitempty"`         // id of the message, unique per sender
-	RequestId    MessageId     `json:"request_id,omitempty"` // if this is a response to a request
-	ProcessDelay time.Duration `json:"-"`
-	Command      string        `json:"command"` // the struct name of "Args" to allow deserializing json later
-	Args         any           `json:"args"`    // any of request / response types in the exchange "typeRegistry"
+	Id        MessageId `json:"id,omitempty"`         // id of the message, unique per sender
+	RequestId MessageId `json:"request_id,omitempty"` // if this is a response to a request
+	Command   string    `json:"command"`              // the struct name of "Args" to allow deserializing json later
+	Args      any       `json:"args"`                 // any of the types in "typeRegistry" or "messageRegistry"
 }
 
 func (cm *ControlMessage) IsResponse() bool {
@@ -110,4 +131,8 @@ func init() {
 			commandRegistry[typeName] = typeReflect
 		}
 	}
+	for _, t := range messageRegistry {
+		typeReflect := reflect.TypeOf(t)
+		commandRegistry[typeReflect.Name()] = typeReflect
+	}
 }
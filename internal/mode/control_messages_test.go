@@ -31,8 +31,8 @@ func TestEmptyArgs(t *testing.T) {
 }
 
 func TestNonEmptyArgs(t *testing.T) {
-	expected := `{"id":2,"command":"RegisterStreamResponse","args":{"error":"error-msg"}}`
-	arg := RegisterStreamResponse{Error: "error-msg"}
+	expected := `{"id":2,"command":"HelloResponse","args":{"error":"error-msg"}}`
+	arg := HelloResponse{Error: "error-msg"}
 
 	// marshal it
 	{
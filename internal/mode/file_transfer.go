@@ -0,0 +1,85 @@
+package mode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// "unbound-ssh get/put" run on the server next to spy-mode and talk to listen-mode through a yamux stream that spy-mode
+// opens for them, spy-mode only passes the request on in the header of the stream and splices the rest.
+
+type FileDirection string
+
+const (
+	// FilePut sends a file of the server to the download directory of listen-mode
+	FilePut FileDirection = "put"
+	// FileGet sends a file of the upload directory of listen-mode to the server
+	FileGet FileDirection = "get"
+)
+
+// FileRequest is written by "unbound-ssh get/put" first, then it is the header of the stream
+type FileRequest struct {
+	Direction FileDirection `json:"direction"`
+	Name      string        `json:"name"`           // the base name of the file to put, or its path relative to the upload directory to get
+	Size      int64         `json:"size,omitempty"` // of the file to put
+}
+
+// FileReply is written by listen-mode once it accepts the request, and again once the transfer is over
+type FileReply struct {
+	Error  string `json:"error,omitempty"`
+	Size   int64  `json:"size,omitempty"`   // of the file to get
+	Path   string `json:"path,omitempty"`   // where the file is put on the side of listen-mode
+	Sha256 string `json:"sha256,omitempty"` // of the file that is put, as listen-mode received it
+}
+
+func (r *FileReply) IsSuccess() bool {
+	return r.Error == ""
+}
+
+// FileTrailer follows the content of the file, so that the receiver can verify it
+type FileTrailer struct {
+	Sha256 string `json:"sha256"`
+}
+
+func WriteFileRequest(w io.Writer, request FileRequest) error {
+	return writeFrame(w, request)
+}
+
+func ReadFileRequest(r io.Reader) (FileRequest, error) {
+	var request FileRequest
+	err := readFrame(r, &request)
+	return request, err
+}
+
+func WriteFileReply(w io.Writer, reply FileReply) error {
+	return writeFrame(w, reply)
+}
+
+func ReadFileReply(r io.Reader) (FileReply, error) {
+	var reply FileReply
+	err := readFrame(r, &reply)
+	return reply, err
+}
+
+func WriteFileTrailer(w io.Writer, trailer FileTrailer) error {
+	return writeFrame(w, trailer)
+}
+
+func ReadFileTrailer(r io.Reader) (FileTrailer, error) {
+	var trailer FileTrailer
+	err := readFrame(r, &trailer)
+	return trailer, err
+}
+
+// UniquePath appends a number to the name of the file if it already exists, neither side overwrites a file or a symlink
+func UniquePath(path string) string {
+	unique := path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(unique); errors.Is(err, os.ErrNotExist) {
+			return unique
+		}
+		unique = fmt.Sprintf("%s.%d", path, i)
+	}
+}
@@ -0,0 +1,52 @@
+package mode
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileTransferFramesRoundTrip(t *testing.T) {
+	request := FileRequest{Direction: FilePut, Name: "report.pdf", Size: 7}
+	reply := FileReply{Path: "/tmp/report.pdf", Sha256: "abc"}
+	trailer := FileTrailer{Sha256: "abc"}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteFileRequest(buf, request))
+	require.NoError(t, WriteFileReply(buf, reply))
+	buf.WriteString("content")
+	require.NoError(t, WriteFileTrailer(buf, trailer))
+
+	actualRequest, err := ReadFileRequest(buf)
+	require.NoError(t, err)
+	require.Equal(t, request, actualRequest)
+
+	actualReply, err := ReadFileReply(buf)
+	require.NoError(t, err)
+	require.Equal(t, reply, actualReply)
+	require.True(t, actualReply.IsSuccess())
+
+	// the content is not framed, the receiver reads exactly the size of the request
+	content := make([]byte, request.Size)
+	_, err = io.ReadFull(buf, content)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+
+	actualTrailer, err := ReadFileTrailer(buf)
+	require.NoError(t, err)
+	require.Equal(t, trailer, actualTrailer)
+}
+
+func TestUniquePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	require.Equal(t, path, UniquePath(path))
+
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	require.Equal(t, path+".1", UniquePath(path))
+
+	require.NoError(t, os.WriteFile(path+".1", nil, 0644))
+	require.Equal(t, path+".2", UniquePath(path))
+}
@@ -0,0 +1,196 @@
+package listen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	stdio "io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// FileServer serves "unbound-ssh get/put" that run on the server of a session, it reports their progress on Stdout
+type FileServer struct {
+	Stdout stdio.Writer
+}
+
+func (fs *FileServer) Serve(stream stdio.ReadWriter, request mode.FileRequest) {
+	var err error
+	switch request.Direction {
+	case mode.FilePut:
+		err = fs.receive(stream, request)
+	case mode.FileGet:
+		err = fs.send(stream, request)
+	default:
+		err = tracerr.Errorf("unknown direction: %s", request.Direction)
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+	}
+	if err != nil {
+		logrus.Warnf("failed to %s %s: %s", request.Direction, request.Name, err.Error())
+	}
+}
+
+// receive writes the file that is put into the download directory
+func (fs *FileServer) receive(stream stdio.ReadWriter, request mode.FileRequest) (err error) {
+	name := filepath.Base(request.Name)
+	dir := config.ProcessString(config.Config.Files.DownloadDir)
+	if dir == "" {
+		err = tracerr.New("put is disabled, download_dir of [files] is not set in the config of listen-mode")
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+		return err
+	}
+	tmp, err := prepareDownload(dir, name)
+	if err != nil {
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err := mode.WriteFileReply(stream, mode.FileReply{}); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprint(fs.Stdout, "\r\n")
+	progress := view.NewProgress(fs.Stdout, fmt.Sprintf("[unbound-ssh] receiving %s", name), request.Size)
+	defer func() {
+		if err != nil {
+			progress.Finish(fmt.Sprintf("failed: %s", err.Error()))
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := stdio.CopyN(stdio.MultiWriter(tmp, hash, progress), stream, request.Size); err != nil {
+		return tracerr.Wrap(err)
+	}
+	trailer, err := mode.ReadFileTrailer(stream)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != trailer.Sha256 {
+		err = tracerr.Errorf("checksum mismatch, sent %s but received %s", trailer.Sha256, checksum)
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return tracerr.Wrap(err)
+	}
+	path := mode.UniquePath(filepath.Join(dir, name))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+		return tracerr.Wrap(err)
+	}
+
+	progress.Finish(fmt.Sprintf("saved to %s, sha256 %s", path, checksum))
+	logrus.Infof("received %s into %s, sha256 %s.", name, path, checksum)
+	return mode.WriteFileReply(stream, mode.FileReply{Path: path, Sha256: checksum})
+}
+
+// send reads the file to get from the upload directory, the path can not escape it
+func (fs *FileServer) send(stream stdio.ReadWriter, request mode.FileRequest) (err error) {
+	root := config.ProcessString(config.Config.Files.UploadDir)
+	var file *os.File
+	if root == "" {
+		err = tracerr.New("get is disabled, upload_dir of [files] is not set in the config of listen-mode")
+	} else {
+		file, err = openInside(root, request.Name)
+	}
+	var stat os.FileInfo
+	if err == nil {
+		stat, err = file.Stat()
+		if err == nil && stat.IsDir() {
+			err = fmt.Errorf("%s is a directory", request.Name)
+		}
+	}
+	if err != nil {
+		_ = mode.WriteFileReply(stream, mode.FileReply{Error: err.Error()})
+		return tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if err := mode.WriteFileReply(stream, mode.FileReply{Size: stat.Size()}); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprint(fs.Stdout, "\r\n")
+	progress := view.NewProgress(fs.Stdout, fmt.Sprintf("[unbound-ssh] sending %s", file.Name()), stat.Size())
+	defer func() {
+		if err != nil {
+			progress.Finish(fmt.Sprintf("failed: %s", err.Error()))
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := stdio.CopyN(stream, stdio.TeeReader(file, stdio.MultiWriter(hash, progress)), stat.Size()); err != nil {
+		return tracerr.Wrap(err)
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err := mode.WriteFileTrailer(stream, mode.FileTrailer{Sha256: checksum}); err != nil {
+		return err
+	}
+
+	// the server verifies the checksum
+	reply, err := mode.ReadFileReply(stream)
+	if err != nil {
+		return err
+	} else if !reply.IsSuccess() {
+		return tracerr.New(reply.Error)
+	}
+
+	progress.Finish(fmt.Sprintf("sha256 %s", checksum))
+	logrus.Infof("sent %s, sha256 %s.", file.Name(), checksum)
+	return nil
+}
+
+// openInside opens a file under root, symlinks are not followed so that none of them can lead out of it
+func openInside(root string, name string) (*os.File, error) {
+	path, relative := root, ""
+	for _, part := range strings.Split(filepath.Clean(string(filepath.Separator)+name), string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+		path, relative = filepath.Join(path, part), filepath.Join(relative, part)
+		stat, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		} else if stat.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s is a symlink, which get does not follow", relative)
+		}
+	}
+	// the last part might have been replaced since
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// prepareDownload creates a hidden temporary file next to where the file will be saved, it is renamed once complete
+func prepareDownload(dir string, name string) (*os.File, error) {
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, fmt.Errorf("invalid file name: %s", name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	file, err := os.CreateTemp(dir, "."+name+".*.part")
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	// CreateTemp is private to the owner, the saved file should not be
+	if err := file.Chmod(0644); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, tracerr.Wrap(err)
+	}
+	return file, nil
+}
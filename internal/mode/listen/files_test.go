@@ -0,0 +1,56 @@
+package listen
+
+import (
+	"bytes"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "tools"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "tools", "jq"), []byte("jq"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "tools", "link")))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "out")))
+
+	for _, name := range []string{"tools/jq", "/tools/jq", "../tools/jq", "tools/../../tools/jq"} {
+		file, err := openInside(root, name)
+		require.NoError(t, err, name)
+		content, err := io.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "jq", string(content))
+		require.NoError(t, file.Close())
+	}
+
+	_, err := openInside(root, "tools/link")
+	require.ErrorContains(t, err, "tools/link is a symlink")
+	_, err = openInside(root, "out/secret")
+	require.ErrorContains(t, err, "out is a symlink")
+	_, err = openInside(root, "tools/missing")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestFileServerDisabled(t *testing.T) {
+	uploadDir, downloadDir := config.Config.Files.UploadDir, config.Config.Files.DownloadDir
+	config.Config.Files.UploadDir, config.Config.Files.DownloadDir = "", ""
+	t.Cleanup(func() {
+		config.Config.Files.UploadDir, config.Config.Files.DownloadDir = uploadDir, downloadDir
+	})
+
+	fs := &FileServer{Stdout: io.Discard}
+	for _, direction := range []mode.FileDirection{mode.FileGet, mode.FilePut} {
+		stream := &bytes.Buffer{}
+		fs.Serve(stream, mode.FileRequest{Direction: direction, Name: "file", Size: 1})
+		reply, err := mode.ReadFileReply(stream)
+		require.NoError(t, err)
+		require.False(t, reply.IsSuccess())
+		require.Contains(t, reply.Error, string(direction)+" is disabled")
+	}
+}
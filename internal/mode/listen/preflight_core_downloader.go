@@ -0,0 +1,150 @@
+package listen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	stdio "io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// downloadChunkOverhead is what the capture markers and the exit code take from the signature detector buffer
+const downloadChunkOverhead = 2048
+
+// base64LineLength is where base64 wraps its output, the pty turns each of those newlines into "\r\n"
+const base64LineLength = 76
+
+// DownloadAndSave fetches a file of the server into a local directory without spy-mode. Each chunk of the file is
+// printed by the shell in base64 (gzipped if possible) and captured between the markers of a command result, the whole
+// file is then verified against the size and hash of the original before it is saved under a name that is not taken.
+// progress (if not nil) is called with the size of the file once it is known and what it returns is written the content
+// of the file as it arrives, the path of the saved file is returned.
+func DownloadAndSave(ctx context.Context, shell *ShellExecutor, file string, dir string, probe *NixProbeResult, progress func(size uint64) stdio.Writer) (saved string, err error) {
+	encoder, err := chooseDownloadEncoder(probe)
+	if err != nil {
+		return "", err
+	}
+	compress := probe.HasGzip()
+
+	// stage 0: size and hash of the original, the probe would only time out if the file is missing
+	if _, err := shell.Execute(ctx, fmt.Sprintf(`test -f "%s"`, file), nil); err != nil {
+		return "", fmt.Errorf("%s is not a file on the server: %w", file, err)
+	}
+	size, hash, err := fetchSizeAnsHash(ctx, shell, file)
+	if err != nil {
+		return "", err
+	}
+	logrus.Infof("downloading %s of %d bytes, compressed: %t.", file, size, compress)
+
+	name := path.Base(file)
+	tmp, err := prepareDownload(dir, name)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	// stage 1: transfer chunks until the whole file is received
+	hasher := sha256.New()
+	out := stdio.MultiWriter(tmp, hasher)
+	if progress != nil {
+		out = stdio.MultiWriter(out, progress(size))
+	}
+	chunkSize := downloadChunkSize()
+	received := uint64(0)
+	for chunk := 0; received < size; chunk++ {
+		content, err := readChunk(ctx, shell, file, chunk, chunkSize, encoder, compress)
+		if err != nil {
+			return "", err
+		}
+		if len(content) == 0 {
+			return "", tracerr.Errorf("%s ended at %d of %d bytes", file, received, size)
+		}
+		if _, err := out.Write(content); err != nil {
+			return "", tracerr.Wrap(err)
+		}
+		received += uint64(len(content))
+	}
+	logrus.Infof("all bytes successfully received.")
+
+	// stage 2: verify size and hash of the downloaded file
+	if received != size {
+		return "", fmt.Errorf("size mismatch: expected %d received %d", size, received)
+	}
+	if actualHash := [32]byte(hasher.Sum(nil)); actualHash != hash {
+		return "", fmt.Errorf("hash mismatch: expected %x received %x", hash, actualHash)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	saved = mode.UniquePath(filepath.Join(dir, name))
+	if err = os.Rename(tmp.Name(), saved); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	return saved, nil
+}
+
+// downloadChunkSize is the largest chunk whose base64 still fits in the signature detector buffer with the markers, a
+// line of base64 takes two more bytes for its line ending and holds 57 bytes of the chunk
+func downloadChunkSize() int {
+	lines := max(core.MaxSignatureLength-downloadChunkOverhead, base64LineLength+2) / (base64LineLength + 2)
+	return lines * base64LineLength / 4 * 3
+}
+
+// chooseDownloadEncoder picks the command that turns binary into base64 on the server, other encodings may contain
+// characters that the printf of the command result would interpret
+func chooseDownloadEncoder(probe *NixProbeResult) (string, error) {
+	if probe.HasBase64() {
+		return "base64", nil
+	} else if probe.HasPython3() {
+		return `python3 -c "import sys, base64; sys.stdout.write(base64.b64encode(sys.stdin.buffer.read()).decode())"`, nil
+	}
+	return "", tracerr.New("neither base64 nor python3 is available on the server to encode the file")
+}
+
+// readChunk prints a chunk of the file in base64 through the shell and decodes it
+func readChunk(ctx context.Context, shell *ShellExecutor, file string, chunk int, chunkSize int, encoder string, compress bool) ([]byte, error) {
+	filters := encoder
+	if compress {
+		filters = "gzip -c | " + encoder
+	}
+	res, err := shell.Execute(ctx, fmt.Sprintf(`dd if="%s" bs=%d skip=%d count=1 2>/dev/null | %s`, file, chunkSize, chunk, filters), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// base64 wraps its output into lines
+	encoded := strings.Join(strings.Fields(res.Output), "")
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d is not valid base64: %w", chunk, err)
+	}
+	if !compress {
+		return content, nil
+	}
+
+	unzipper, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d is not valid gzip: %w", chunk, err)
+	}
+	content, err = stdio.ReadAll(unzipper)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d is not valid gzip: %w", chunk, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,27 @@
+package listen
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestDownloadChunkSizeFitsWrappedBase64(t *testing.T) {
+	chunk := make([]byte, downloadChunkSize())
+	_, err := rand.Read(chunk)
+	require.NoError(t, err)
+
+	// the way base64 prints it through the pty
+	encoded := base64.StdEncoding.EncodeToString(chunk)
+	var lines []string
+	for len(encoded) > base64LineLength {
+		lines, encoded = append(lines, encoded[:base64LineLength]), encoded[base64LineLength:]
+	}
+	printed := strings.Join(append(lines, encoded), "\r\n") + "\r\n"
+
+	require.LessOrEqual(t, len(printed)+downloadChunkOverhead, core.MaxSignatureLength)
+	require.Greater(t, len(printed)+downloadChunkOverhead, core.MaxSignatureLength-base64LineLength-2)
+}
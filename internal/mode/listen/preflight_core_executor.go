@@ -11,22 +11,57 @@ import (
 	"github.com/sirupsen/logrus"
 	stdio "io"
 	"os"
+	"strings"
 	"time"
 )
 
 type ShellExecutor struct {
 	PtyReader      *io2.ContextReader
 	PtyWriter      stdio.Writer
+	Stdout         stdio.Writer // where the shell output is echoed
 	DefaultTimeout time.Duration
+	NestedIn       string // the shell (fish or tcsh) that PrepareShell runs a nested sh in, empty if there is none
 }
 
 func NewShellExecutor(ptyReader *io2.ContextReader, ptyWriter stdio.Writer) *ShellExecutor {
-	return &ShellExecutor{PtyReader: ptyReader, PtyWriter: ptyWriter, DefaultTimeout: config.Config.Preflight.CommandTimeout}
+	return &ShellExecutor{PtyReader: ptyReader, PtyWriter: ptyWriter, Stdout: os.Stdout, DefaultTimeout: config.Config.Preflight.CommandTimeout}
+}
+
+// quote makes a single argument of s for sh, in which nothing is expanded
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
 
 func (se *ShellExecutor) Execute(ctx context.Context, cmd string, inputData []byte) (signature.CommandResult, error) {
-	collector, err := Execute[*signature.BatchCommandResult](ctx, se, inputData)(signature.GenerateCommandsAndCaptureResult([]string{cmd}))
-	if err != nil {
+	if len(inputData) == 0 {
+		command, collector := signature.GenerateCommandsAndCaptureResult([]string{cmd})
+		return se.executeOne(ctx, cmd, command, collector, nil, nil)
+	}
+
+	// a shell that reads its command line in blocks (e.g. dash in raw mode) would take the input that follows it, so the
+	// input is held back until the command is started and prints that it is ready
+	printReady, ready := signature.GenerateCommandAndCaptureResult("", "ready")
+	command, collector := signature.GenerateCommandsAndCaptureResult([]string{fmt.Sprintf("%s >&2; %s", strings.TrimSpace(printReady), cmd)})
+	return se.executeOne(ctx, cmd, command, collector, ready, inputData)
+}
+
+// ExecuteInShell is Execute for builtins that change the state of the shell (e.g. its history options), which would be
+// lost in the subshell that Execute runs its command in, only the exit code of the command is captured
+func (se *ShellExecutor) ExecuteInShell(ctx context.Context, cmd string) error {
+	command, collector := signature.GenerateInShellCommandAndCaptureResult(cmd)
+	_, err := se.executeOne(ctx, cmd, command, collector, nil, nil)
+	return err
+}
+
+// executeOne runs a command of a single result, inputData is typed once ready (if not nil) is printed
+func (se *ShellExecutor) executeOne(ctx context.Context, cmd string, command string, collector *signature.BatchCommandResult, ready *signature.CaptureResult, inputData []byte) (signature.CommandResult, error) {
+	if ready != nil {
+		if err := se.runAndExpect(ctx, command, nil, ready); err != nil {
+			return signature.NullCommandResult, err
+		}
+		command = ""
+	}
+	if err := se.runAndExpect(ctx, command, inputData, collector); err != nil {
 		return signature.NullCommandResult, err
 	}
 
@@ -70,7 +105,7 @@ func (se *ShellExecutor) runAndExpect(ctx context.Context, command string, input
 	}()
 
 	ctxWithTimeout, _ := context.WithTimeout(ctx, se.DefaultTimeout)
-	err := io2.DuplexCopy(ctxWithTimeout, se.PtyWriter, &io2.ContextReadCloser{ReadCloser: robotR}, os.Stdout, io2.NewSignatureDetector(expect).Wrap(se.PtyReader))
+	err := io2.DuplexCopy(ctxWithTimeout, se.PtyWriter, &io2.ContextReadCloser{ReadCloser: robotR}, se.Stdout, io2.NewSignatureDetector(expect).Wrap(se.PtyReader))
 	if err != nil && !errors.Is(err, io2.SignatureFound) {
 		return err
 	}
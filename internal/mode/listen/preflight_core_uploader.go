@@ -7,18 +7,25 @@ import (
 	"crypto/sha256"
 	"encoding/ascii85"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	stdio "io"
-	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-func ReadFileAndUpload(ctx context.Context, shell *ShellExecutor, file string, filename string, encoding config.PreflightUploadCodec) error {
+// ReadFileAndUpload uploads a local file, progress (if not nil) is reported the content of the file as it is read and
+// the chunks as they are sent
+func ReadFileAndUpload(ctx context.Context, shell *ShellExecutor, file string, filename string, encoding config.PreflightUploadCodec, method config.PreflightUploadMethod, progress *view.Progress) error {
 	reader, err := createFileReader(file)
 	if err != nil {
 		return err
@@ -27,27 +34,18 @@ func ReadFileAndUpload(ctx context.Context, shell *ShellExecutor, file string, f
 		filename = path.Base(file)
 	}
 
-	return upload(ctx, shell, filename, reader, encoding)
+	return upload(ctx, shell, filename, reader, encoding, method, progress)
 }
 
-func FetchUrlAndUpload(ctx context.Context, shell *ShellExecutor, url string, filename string, encoding config.PreflightUploadCodec) error {
-	reader, err := createUrlReader(url)
-	if err != nil {
-		return err
-	}
-
-	return upload(ctx, shell, filename, reader, encoding)
-}
-
-func Upload(ctx context.Context, shell *ShellExecutor, content string, filename string, encoding config.PreflightUploadCodec) error {
-	return upload(ctx, shell, filename, stdio.NopCloser(bytes.NewBufferString(content)), encoding)
+func Upload(ctx context.Context, shell *ShellExecutor, content string, filename string, encoding config.PreflightUploadCodec, method config.PreflightUploadMethod, progress *view.Progress) error {
+	return upload(ctx, shell, filename, stdio.NopCloser(bytes.NewBufferString(content)), encoding, method, progress)
 }
 
-func upload(ctx context.Context, shell *ShellExecutor, filename string, reader stdio.ReadCloser, encoding config.PreflightUploadCodec) error {
+func upload(ctx context.Context, shell *ShellExecutor, filename string, reader stdio.ReadCloser, encoding config.PreflightUploadCodec, method config.PreflightUploadMethod, progress *view.Progress) error {
 	// stage 0: tap reader to calculate size/hash
 	size := uint64(0)
 	hash := [32]byte{}
-	reader = trackSizeAndHash(reader, &size, &hash)
+	reader = trackSizeAndHash(reader, &size, &hash, progress)
 
 	// stage 1: add gzip filter
 	if encoding == config.GzipBase64 || encoding == config.GzipAscii85 {
@@ -77,7 +75,7 @@ func upload(ctx context.Context, shell *ShellExecutor, filename string, reader s
 			logrus.Warnf("Close() failed on the reader: %s", err.Error())
 		}
 	}()
-	err := writeFile(ctx, shell, filename, reader)
+	encoded, err := writeFile(ctx, shell, filename, reader, method, progress)
 	if err != nil {
 		logrus.Warnf("transferring file content failed: %s", err.Error())
 		return err
@@ -114,58 +112,57 @@ func upload(ctx context.Context, shell *ShellExecutor, filename string, reader s
 		return fmt.Errorf("hash mismatch: expected %x received %x", hash, actualHash)
 	}
 
-	return nil
-}
-
-func createUrlReader(url string) (stdio.ReadCloser, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("GET %s failed: %s", url, err.Error())
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		errorBody, err := stdio.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("GET %s responded with code: %d headers: %#v body: error(%s)", url, resp.StatusCode, resp.Header, err.Error())
-		} else {
-			return nil, fmt.Errorf("GET %s responded with code: %d headers: %#v body: %s", url, resp.StatusCode, resp.Header, string(errorBody))
-		}
+	ratio := float64(encoded) * 100 / float64(max(size, 1))
+	logrus.Infof("uploaded %s, %d bytes were sent as %d bytes of %s (%.1f%%).", filename, size, encoded, encoding, ratio)
+	if progress != nil {
+		progress.SetDetail("sent as %s of %s (%.0f%%)", view.FormatBytes(int64(encoded)), encoding, ratio)
 	}
-
-	return resp.Body, nil
+	return nil
 }
 
 func createFileReader(file string) (stdio.ReadCloser, error) {
 	return os.Open(file)
 }
 
-func writeFile(ctx context.Context, shell *ShellExecutor, filename string, data stdio.ReadCloser) error {
-	// upon exit clean up temporary chunks
+// uploadChunksPerPage is how many chunks of an earlier upload are listed at once, the listing needs to fit in the
+// signature detector buffer
+const uploadChunksPerPage = 100
+
+// printfLineLength is how many bytes of a chunk each printf command of the printf upload method carries, the command
+// needs to stay below the 1024 bytes that a cooked terminal of macOS takes in a line
+const printfLineLength = 512
+
+// writeFile writes the encoded content on the server chunk by chunk and reports each one to progress (if not nil),
+// encoded is the size of the content including the chunks that were on the server already
+func writeFile(ctx context.Context, shell *ShellExecutor, filename string, data stdio.ReadCloser, method config.PreflightUploadMethod, progress *view.Progress) (encoded int, err error) {
+	// upon success clean up temporary chunks, otherwise they are kept so that the next upload can resume from them
 	defer func() {
+		if err != nil {
+			logrus.Infof("keeping the chunks of %s on the server to resume the upload.", filename)
+			return
+		}
 		_, closeErr := shell.Execute(context.Background(), fmt.Sprintf(`rm %s_chunk_*.tmp`, filename), nil)
 		if closeErr != nil {
 			logrus.Warnf("failed to clean up temporary chunks: %s", closeErr.Error())
 		}
 	}()
 
-	// capture current stty settings
-	res, err := shell.Execute(ctx, `stty -g`, nil)
-	if err != nil {
-		return err
-	}
-
-	// upon exit restore terminal settings
-	defer func() {
-		_, closeErr := shell.Execute(context.Background(), fmt.Sprintf(`stty "%s"`, res.Output), nil)
-		if closeErr != nil {
-			logrus.Warnf("failed to restore terminal settings: %s", closeErr.Error())
+	// the methods that read the chunks from the terminal need it in raw mode, printf does not
+	if method != config.Printf {
+		restoreTerminal, err := enterRawMode(ctx, shell)
+		if err != nil {
+			logrus.Warnf("failed to switch the terminal to raw mode, uploading with printf instead of %s: %s", method, err.Error())
+			method = config.Printf
+		} else {
+			defer restoreTerminal()
 		}
-	}()
+	}
+	logrus.Infof("uploading %s with %s.", filename, method)
 
-	// set terminal to raw mode, to avoid tty echoing and buffering limitation
-	_, err = shell.Execute(ctx, `stty raw opost -echo`, nil)
+	// an upload that was interrupted before leaves its chunks behind
+	leftover, err := countRemoteChunks(ctx, shell, filename)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// make data read interruptible through context cancellation
@@ -175,37 +172,158 @@ func writeFile(ctx context.Context, shell *ShellExecutor, filename string, data
 	// split file content into smaller temporary chunk files and transfer them
 	var MaxChunkSize = config.Config.Preflight.UploadChunkSize
 	buf := make([]byte, MaxChunkSize)
-	for chunk := 0; true; chunk++ {
+	var remoteHashes map[int]string
+	chunk, skipped, sent := 0, 0, 0
+	start := time.Now()
+	for ; true; chunk++ {
 		nRead, err := stdio.ReadAtLeast(data, buf, len(buf))
 		if err == stdio.EOF || errors.Is(err, stdio.ErrUnexpectedEOF) {
 			err = nil
 		}
 		if err != nil {
-			return err
+			return encoded, err
 		}
 		if nRead == 0 {
 			break
 		}
+		encoded += nRead
+
+		// the encoding is deterministic, so a chunk with the same hash does not need to be sent again
+		if leftover > 0 && chunk%uploadChunksPerPage == 0 {
+			remoteHashes, err = fetchRemoteChunkHashes(ctx, shell, filename, chunk/uploadChunksPerPage)
+			if err != nil {
+				return encoded, err
+			}
+		}
+		if hash := sha256.Sum256(buf[:nRead]); remoteHashes[chunk] == hex.EncodeToString(hash[:8]) {
+			skipped++
+			if progress != nil {
+				progress.SetDetail("chunk %d was on the server already", chunk+1)
+			}
+			continue
+		}
+		if progress != nil {
+			progress.SetDetail("chunk %d, %s sent with %s", chunk+1, view.FormatBytes(int64(sent)), method)
+		}
 
 		chunkName := fmt.Sprintf(`%s_chunk_%07d.tmp`, filename, chunk)
-		// this is intentionally non-cancellable, as we need to ensure that the chunk writing is completed
+		// this is intentionally non-cancellable in raw mode, as we need to ensure that the chunk writing is completed
 		// otherwise "dd" running in raw-mode will freeze the terminal
-		_, err = shell.Execute(context.Background(), fmt.Sprintf(`dd bs=%d count=1 iflag=fullblock >%s`, nRead, chunkName), buf[:nRead])
+		err = writeChunk(lo.Ternary(method == config.Printf, ctx, context.Background()), shell, method, chunkName, buf[:nRead])
 		if err != nil {
-			return err
+			return encoded, err
+		}
+		sent += nRead
+	}
+	elapsed := time.Since(start)
+	logrus.Infof("sent %d bytes of %s with %s in %s, %.1f KB/s.", sent, filename, method, elapsed.Round(time.Millisecond), float64(sent)/1024/max(elapsed.Seconds(), 0.001))
+
+	if leftover > 0 {
+		logrus.Infof("resumed the upload of %s, %d of %d chunks were on the server already.", filename, skipped, chunk)
+
+		// an earlier upload of a larger file may have left chunks after the last one
+		_, err = shell.Execute(ctx, fmt.Sprintf(`for f in %s_chunk_*.tmp; do i=${f##*_chunk_}; if [ "$(expr "${i%%.tmp}" + 0)" -ge %d ]; then rm "$f"; fi; done`, filename, chunk), nil)
+		if err != nil {
+			return encoded, err
 		}
 	}
 
 	// concatenate all chunks into the final file
 	_, err = shell.Execute(ctx, fmt.Sprintf(`cat %[1]s_chunk_*.tmp > %[1]s`, filename), nil)
 
+	return encoded, err
+}
+
+// enterRawMode switches the terminal to raw mode, to avoid tty echoing and buffering limitation, until the returned
+// function restores its settings
+func enterRawMode(ctx context.Context, shell *ShellExecutor) (restore func(), err error) {
+	// capture current stty settings
+	res, err := shell.Execute(ctx, `stty -g`, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	restore = func() {
+		_, closeErr := shell.Execute(context.Background(), fmt.Sprintf(`stty "%s"`, res.Output), nil)
+		if closeErr != nil {
+			logrus.Warnf("failed to restore terminal settings: %s", closeErr.Error())
+		}
+	}
+	_, err = shell.Execute(ctx, `stty raw opost -echo`, nil)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return restore, nil
+}
+
+// writeChunk writes a chunk of the encoded file on the server with the given method, all but printf read it from the
+// terminal in raw mode
+func writeChunk(ctx context.Context, shell *ShellExecutor, method config.PreflightUploadMethod, chunkName string, data []byte) (err error) {
+	switch method {
+	case config.Dd:
+		_, err = shell.Execute(ctx, fmt.Sprintf(`dd bs=%d count=1 iflag=fullblock >%s`, len(data), chunkName), data)
+	case config.Head:
+		_, err = shell.Execute(ctx, fmt.Sprintf(`head -c %d >%s`, len(data), chunkName), data)
+	case config.Python3:
+		_, err = shell.Execute(ctx, fmt.Sprintf(`python3 -c "import sys; open(sys.argv[1], 'wb').write(sys.stdin.buffer.read(%d))" %s`, len(data), chunkName), data)
+	default:
+		// the encoded content is printable, only the quotes of ascii85 need escaping
+		for offset := 0; offset < len(data) && err == nil; offset += printfLineLength {
+			line := strings.ReplaceAll(string(data[offset:min(offset+printfLineLength, len(data))]), `'`, `'\''`)
+			_, err = shell.Execute(ctx, fmt.Sprintf(`printf '%%s' '%s' %s%s`, line, lo.Ternary(offset == 0, ">", ">>"), chunkName), nil)
+		}
+	}
 	return err
 }
 
-// trackSizeAndHash wraps the reader to calculate the size and hash of the content
-func trackSizeAndHash(reader stdio.ReadCloser, size *uint64, hash *[32]byte) stdio.ReadCloser {
+// countRemoteChunks tells how many chunks of the file are on the server
+func countRemoteChunks(ctx context.Context, shell *ShellExecutor, filename string) (int, error) {
+	res, err := shell.Execute(ctx, fmt.Sprintf(`for f in %s_chunk_*.tmp; do if [ -f "$f" ]; then echo "$f"; fi; done | wc -l`, filename), nil)
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(res.Output))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the chunks of %s: %w", filename, err)
+	}
+	return count, nil
+}
+
+// fetchRemoteChunkHashes returns the first 8 bytes of the sha256 of the chunks of a page that are on the server in hex,
+// by the index of the chunk
+func fetchRemoteChunkHashes(ctx context.Context, shell *ShellExecutor, filename string, page int) (map[int]string, error) {
+	res, err := shell.Execute(ctx, fmt.Sprintf(`for f in %s_chunk_%05d??.tmp; do if [ -f "$f" ]; then sha256sum "$f"; fi; done | sed -E 's/^(.{16}).*_chunk_0*([0-9]+)\.tmp$/\2 \1/'`, filename, page), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[int]string{}
+	for _, line := range strings.Split(res.Output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		chunk, err := strconv.Atoi(fields[0])
+		if err != nil {
+			logrus.Warnf("failed to parse the hash of a chunk: %s", line)
+			continue
+		}
+		hashes[chunk] = fields[1]
+	}
+	return hashes, nil
+}
+
+// trackSizeAndHash wraps the reader to calculate the size and hash of the content, which is also written to progress
+// (if not nil)
+func trackSizeAndHash(reader stdio.ReadCloser, size *uint64, hash *[32]byte, progress *view.Progress) stdio.ReadCloser {
 	hasher := sha256.New()
 	pipeR, pipeW := stdio.Pipe()
+	// progress is written once the content is taken by the pipe
+	trackers := []stdio.Writer{hasher, pipeW}
+	if progress != nil {
+		trackers = append(trackers, progress)
+	}
 	go func() {
 		defer func() {
 			err := reader.Close()
@@ -214,7 +332,7 @@ func trackSizeAndHash(reader stdio.ReadCloser, size *uint64, hash *[32]byte) std
 			}
 		}()
 
-		n, err := stdio.Copy(stdio.MultiWriter(hasher, pipeW), reader)
+		n, err := stdio.Copy(stdio.MultiWriter(trackers...), reader)
 		if err != nil {
 			logrus.Warnf("size/hash tracker failed: %s", err.Error())
 		}
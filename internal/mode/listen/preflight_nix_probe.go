@@ -1,9 +1,10 @@
 package listen
 
 import (
-	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/nimatrueway/unbound-ssh/internal/release"
+	"github.com/ztrue/tracerr"
 	"golang.org/x/mod/semver"
 	"strings"
 )
@@ -18,6 +19,8 @@ func GeneratePrintNixProbe() (command string, collector *NixProbeResult) {
 	cmd := map[string]string{
 		"internet":         "nc -w 1 -z github.com 80",
 		"dd":               "command -v dd",
+		"dd fullblock":     "dd if=/dev/null of=/dev/null iflag=fullblock",
+		"head -c":          "printf abc | head -c 1",
 		"stty":             "command -v stty",
 		"base64":           "command -v base64",
 		"uudecode":         "command -v uudecode",
@@ -28,12 +31,17 @@ func GeneratePrintNixProbe() (command string, collector *NixProbeResult) {
 		"cut":              "command -v cut",
 		"paste":            "command -v paste",
 		"gunzip":           "command -v gunzip",
+		"gzip":             "command -v gzip",
+		"tar":              "command -v tar",
 		"curl":             "command -v curl",
 		"wget":             "command -v wget",
 		"dig":              "command -v dig",
 		"ping":             "command -v ping",
 		"nc":               "command -v nc",
 		"uname":            "uname -a",
+		"uname -sm":        "uname -sm",
+		"LONG_BIT":         "getconf LONG_BIT",
+		"libc":             "ldd --version 2>&1 | head -n 1",
 		"./unbound-ssh -v": "./unbound-ssh -v",
 		"busybox":          "busybox | head -n 1",
 		"/etc/lsb-release": "cat /etc/lsb-release",
@@ -44,55 +52,54 @@ func GeneratePrintNixProbe() (command string, collector *NixProbeResult) {
 	return command, collector
 }
 
-func (p *NixProbeResult) Os() string {
-	uname := p.Get("uname")
-	if uname.Result != 0 {
-		return ""
+// Platform is what the server tells about its os, architecture and libc
+func (p *NixProbeResult) Platform() release.Platform {
+	return release.Platform{
+		Uname:   p.Get("uname -sm").Output,
+		LongBit: p.Get("LONG_BIT").Output,
+		Libc:    p.Get("libc").Output,
 	}
+}
 
-	if strings.HasPrefix(uname.Output, "Darwin") {
-		return "darwin"
-	} else if strings.HasPrefix(uname.Output, "Linux") {
-		return "linux"
-	} else {
-		return ""
+// Binary is the name of the released binary that runs on the server, an error that tells the detected platform is
+// returned if there is none
+func (p *NixProbeResult) Binary() (string, error) {
+	target, err := p.Platform().Target()
+	if err != nil {
+		return "", tracerr.Wrap(err)
 	}
+	return release.BinaryName(target), nil
 }
 
-func (p *NixProbeResult) Arch() string {
-	uname := p.Get("uname")
-	if uname.Result != 0 {
-		return ""
-	}
+func (p *NixProbeResult) HasGunzip() bool {
+	return p.Get("gunzip").IsSuccess()
+}
 
-	if strings.Contains(uname.Output, "arm64") {
-		return "arm64"
-	} else if strings.Contains(uname.Output, "x86_64") {
-		return "amd64"
-	} else {
-		return ""
-	}
+func (p *NixProbeResult) HasGzip() bool {
+	return p.Get("gzip").IsSuccess()
 }
 
-func (p *NixProbeResult) Binary() string {
-	os := p.Os()
-	arch := p.Arch()
-	if os == "" || arch == "" {
-		return ""
-	}
-	return fmt.Sprintf("unbound-ssh_%s_%s", os, arch)
+func (p *NixProbeResult) HasBase64() bool {
+	return p.Get("base64").IsSuccess()
 }
 
-func (p *NixProbeResult) HasGunzip() bool {
-	return p.Get("gunzip").IsSuccess()
+func (p *NixProbeResult) HasStty() bool {
+	return p.Get("stty").IsSuccess()
 }
 
-func (p *NixProbeResult) BinaryDownloadUrl() string {
-	binary := p.Binary()
-	if binary == "" {
-		return ""
-	}
-	return fmt.Sprintf("https://github.com/nimatrueway/unbound-ssh/releases/latest/download/%s", binary)
+// HasDdFullblock is false for the dd of busybox and macOS, without iflag=fullblock dd reads less than a block from a
+// terminal
+func (p *NixProbeResult) HasDdFullblock() bool {
+	return p.Get("dd fullblock").IsSuccess()
+}
+
+func (p *NixProbeResult) HasHeadBytes() bool {
+	res := p.Get("head -c")
+	return res.IsSuccess() && res.Output == "a"
+}
+
+func (p *NixProbeResult) HasTar() bool {
+	return p.Get("tar").IsSuccess()
 }
 
 func (p *NixProbeResult) HasPython3() bool {
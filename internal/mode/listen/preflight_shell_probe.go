@@ -0,0 +1,136 @@
+package listen
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/sirupsen/logrus"
+	"path"
+	"strings"
+)
+
+// ShellProbeResult tells which shell the commands of unbound-ssh are typed into
+type ShellProbeResult struct {
+	*signature.BatchCommandResult
+}
+
+// GeneratePrintShellProbe prints the name of the shell, which is the parent of the "sh -c" that the probe is wrapped
+// in, since that is the one command that fish, tcsh and POSIX shells all understand
+func GeneratePrintShellProbe() (command string, collector *ShellProbeResult) {
+	collector = &ShellProbeResult{BatchCommandResult: &signature.BatchCommandResult{}}
+	command, collector.CaptureResult = signature.GenerateCommandAndCaptureResult(`o_0=$(cat /proc/$PPID/comm 2>/dev/null || ps -o comm= -p $PPID); r_0=$?; `, `r_0=$r_0\no_0=$o_0`)
+	return wrapInSh(command), collector
+}
+
+// Name is the name of the shell binary e.g. "bash" or "fish", empty if it could not be told
+func (p *ShellProbeResult) Name() string {
+	if len(p.Results) != 1 || !p.Results[0].IsSuccess() {
+		return ""
+	}
+	// ps of macOS prints the path, with a dash in front for login shells
+	return strings.TrimPrefix(path.Base(strings.TrimSpace(p.Results[0].Output)), "-")
+}
+
+// IsPosix is false for the shells that can not run the commands of unbound-ssh, which are written for sh
+func (p *ShellProbeResult) IsPosix() bool {
+	switch p.Name() {
+	case "fish", "tcsh", "csh":
+		return false
+	default:
+		return true
+	}
+}
+
+// PrepareShell gets the shell ready for the commands of unbound-ssh and keeps them out of its history, the returned
+// function restores the shell once they are all executed. A POSIX shell runs them as they are, others (fish and tcsh)
+// run a nested sh until the shell is restored.
+func PrepareShell(ctx context.Context, shell *ShellExecutor) (restore func(), err error) {
+	probe, err := Execute[*ShellProbeResult](ctx, shell, nil)(GeneratePrintShellProbe())
+	if err != nil {
+		logrus.Errorf("failed to probe the shell: %s", err.Error())
+		return nil, err
+	}
+	logrus.Infof("shell is detected as \"%s\".", probe.Name())
+
+	switch {
+	case !probe.IsPosix():
+		return enterNestedSh(ctx, shell, probe.Name())
+	case probe.Name() == "bash":
+		return disableBashHistory(ctx, shell)
+	case probe.Name() == "zsh":
+		// a new history list that is not saved anywhere, until it is popped
+		return disableHistoryWith(ctx, shell, "fc -p", "fc -P")
+	default:
+		return disableHistFile(ctx, shell)
+	}
+}
+
+// enterNestedSh runs an interactive sh in the shell, whose history is not saved, until the returned function exits it
+func enterNestedSh(ctx context.Context, shell *ShellExecutor, name string) (exit func(), err error) {
+	entering, entered := generatePrintSuccess()
+	exiting, exited := generatePrintSuccess()
+	command := wrapInSh(fmt.Sprintf("%s; HISTFILE=/dev/null sh -i; %s", strings.TrimSpace(entering), strings.TrimSpace(exiting)))
+	if _, err := Execute[*signature.BatchCommandResult](ctx, shell, nil)(command, entered); err != nil {
+		logrus.Errorf("failed to enter a nested sh: %s", err.Error())
+		return nil, err
+	}
+	shell.NestedIn = name
+	return func() {
+		shell.NestedIn = ""
+		if _, err := Execute[*signature.BatchCommandResult](context.Background(), shell, nil)(" exit\n", exited); err != nil {
+			logrus.Errorf("failed to exit the nested sh: %s", err.Error())
+		}
+	}, nil
+}
+
+// disableBashHistory stops bash from recording commands, unless it is not recording them already
+func disableBashHistory(ctx context.Context, shell *ShellExecutor) (restore func(), err error) {
+	optionsRes, err := shell.Execute(ctx, "echo $SHELLOPTS", nil)
+	if err != nil {
+		logrus.Errorf("failed to get SHELLOPTS: %s", err.Error())
+		return nil, err
+	}
+	if !strings.Contains(":"+optionsRes.Output+":", ":history:") {
+		return func() {}, nil
+	}
+	return disableHistoryWith(ctx, shell, "set +o history", "set -o history")
+}
+
+// disableHistFile keeps a POSIX shell from saving its history, by unsetting HISTFILE
+func disableHistFile(ctx context.Context, shell *ShellExecutor) (restore func(), err error) {
+	histFileRes, err := shell.Execute(ctx, "echo $HISTFILE", nil)
+	if err != nil {
+		logrus.Errorf("failed to get HISTFILE: %s", err.Error())
+		return nil, err
+	}
+	restoreCmd := "true"
+	if histFileRes.Output != "" {
+		restoreCmd = fmt.Sprintf("export HISTFILE=\"%s\"", histFileRes.Output)
+	}
+	return disableHistoryWith(ctx, shell, "unset HISTFILE", restoreCmd)
+}
+
+func disableHistoryWith(ctx context.Context, shell *ShellExecutor, disableCmd string, restoreCmd string) (restore func(), err error) {
+	if err := shell.ExecuteInShell(ctx, disableCmd); err != nil {
+		logrus.Errorf("failed to disable history: %s", err.Error())
+		return nil, err
+	}
+	return func() {
+		if err := shell.ExecuteInShell(context.Background(), restoreCmd); err != nil {
+			logrus.Errorf("failed to re-enable history: %s", err.Error())
+		}
+	}, nil
+}
+
+// generatePrintSuccess prints the result of a command that succeeded with no output
+func generatePrintSuccess() (command string, collector *signature.BatchCommandResult) {
+	collector = &signature.BatchCommandResult{}
+	command, collector.CaptureResult = signature.GenerateCommandAndCaptureResult("", `r_0=0\no_0=`)
+	return command, collector
+}
+
+// wrapInSh runs a POSIX command in "sh -c" as an argument in single quotes, which all shells take literally as long
+// as it does not contain quotes, "\\" (fish) or "!" (tcsh), the leading space keeps it out of the history of fish
+func wrapInSh(command string) string {
+	return fmt.Sprintf(" sh -c '%s'\n", strings.TrimSpace(command))
+}
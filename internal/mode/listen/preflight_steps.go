@@ -0,0 +1,90 @@
+package listen
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+// runSteps runs the [[preflight.step]] of the config in order, the first one that fails stops the rest
+func (bm *PreflightState) runSteps(ctx context.Context, shell *ShellExecutor, codec config.PreflightUploadCodec, method config.PreflightUploadMethod) error {
+	for i, step := range config.Config.Preflight.Step {
+		logrus.Infof("running preflight step %d: %s.", i, step.Type)
+		var err error
+		switch step.Type {
+		case config.UploadStep:
+			err = bm.uploadStep(ctx, shell, step, codec, method)
+		case config.RunStep:
+			err = runStep(ctx, shell, step)
+		case config.EnvStep:
+			err = bm.envStep(ctx, shell, i, step)
+		case config.MkdirStep:
+			_, err = shell.Execute(ctx, fmt.Sprintf(`mkdir -p "%s"`, step.Path), nil)
+		}
+		if err != nil {
+			logrus.Errorf("preflight step %d failed: %s", i, err.Error())
+			return fmt.Errorf("preflight step %d (%s) failed: %w", i, step.Type, err)
+		}
+	}
+	return nil
+}
+
+// uploadStep uploads a local file with the permission bits it has, into a directory that is created if missing
+func (bm *PreflightState) uploadStep(ctx context.Context, shell *ShellExecutor, step config.PreflightStep, codec config.PreflightUploadCodec, method config.PreflightUploadMethod) error {
+	stat, err := os.Stat(step.Source)
+	if err != nil {
+		return err
+	}
+	if err := ensureDir(ctx, shell, step.Path); err != nil {
+		return err
+	}
+	err = bm.uploadWithProgress(shell, step.Path, stat.Size(), func(progress *view.Progress) error {
+		return ReadFileAndUpload(ctx, shell, step.Source, step.Path, codec, method, progress)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = shell.Execute(ctx, fmt.Sprintf(`chmod %o "%s"`, stat.Mode().Perm(), step.Path), nil)
+	return err
+}
+
+// envStep exports a variable into the shell, its value in single quotes so that neither the shell nor the history
+// expansion of an interactive bash ("!") changes it
+func (bm *PreflightState) envStep(ctx context.Context, shell *ShellExecutor, i int, step config.PreflightStep) error {
+	if err := shell.ExecuteInShell(ctx, fmt.Sprintf("export %s=%s", step.Name, quote(step.Value))); err != nil {
+		return err
+	}
+	// the nested sh is gone with the variable once preflight is done
+	if shell.NestedIn != "" {
+		logrus.Warnf("preflight step %d exported %s into the nested sh that preflight runs in %s, not into %s itself.", i, step.Name, shell.NestedIn, shell.NestedIn)
+		bm.Notify("preflight step %d: %s is only exported for the steps that follow, %s is not a POSIX shell", i, step.Name, shell.NestedIn)
+	}
+	return nil
+}
+
+// runStep runs a command that is expected to exit with the exit code of the step, in its own timeout if it has one
+func runStep(ctx context.Context, shell *ShellExecutor, step config.PreflightStep) error {
+	if step.Timeout > 0 {
+		defaultTimeout := shell.DefaultTimeout
+		shell.DefaultTimeout = step.Timeout
+		defer func() {
+			shell.DefaultTimeout = defaultTimeout
+		}()
+	}
+
+	command, collector := signature.GenerateCommandsAndCaptureResult([]string{step.Command})
+	if _, err := Execute[*signature.BatchCommandResult](ctx, shell, nil)(command, collector); err != nil {
+		return err
+	}
+	if len(collector.Results) != 1 {
+		return fmt.Errorf("expected 1 command result received %d: %s", len(collector.Results), collector.Captured)
+	}
+	if result := collector.Results[0]; result.Result != step.ExitCode {
+		return fmt.Errorf("command '%s' exited with %d instead of %d: %s", step.Command, result.Result, step.ExitCode, result.Output)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package listen
+
+import (
+	"bytes"
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/stretchr/testify/require"
+	"os/exec"
+	"testing"
+)
+
+func TestEnvStep(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	ctx := context.Background()
+	// an interactive bash expands "!" in double quotes from its history
+	base := startShell(t, t.TempDir(), "bash", "--norc", "--noprofile", "-i")
+	shell := base.shell()
+	restore, err := PrepareShell(ctx, shell)
+	require.NoError(t, err)
+	t.Cleanup(restore)
+	_, err = shell.Execute(ctx, "echo earlier", nil)
+	require.NoError(t, err)
+
+	preflight := NewPreflightState(base)
+	value := `it's $HOME, "!!" and !echo`
+	require.NoError(t, preflight.envStep(ctx, shell, 0, config.PreflightStep{Type: config.EnvStep, Name: "HELPER", Value: value}))
+	res, err := shell.Execute(ctx, `printf '%s' "$HELPER"`, nil)
+	require.NoError(t, err)
+	require.Equal(t, value, res.Output)
+}
+
+func TestEnvStepInNestedSh(t *testing.T) {
+	base := startShell(t, t.TempDir())
+	stdout := &bytes.Buffer{}
+	base.Stdout = stdout
+	shell := base.shell()
+	shell.NestedIn = "fish"
+
+	preflight := NewPreflightState(base)
+	require.NoError(t, preflight.envStep(context.Background(), shell, 2, config.PreflightStep{Type: config.EnvStep, Name: "HELPER", Value: "x"}))
+	require.Contains(t, stdout.String(), "preflight step 2: HELPER is only exported for the steps that follow, fish is not a POSIX shell")
+}
@@ -0,0 +1,65 @@
+package listen
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+)
+
+// AutoState gets from the first prompt of the shell to a spy-mode that is ready to connect without keystrokes: it runs
+// the preflight script, then launches spy-mode in the directory that preflight uploaded to
+type AutoState struct {
+	*BaseState
+}
+
+func NewAutoState(baseState *BaseState) AutoState {
+	return AutoState{BaseState: baseState}
+}
+
+// Run returns the start signature of spy-mode, or nil if the user canceled it with the cancel hotkey
+func (bm *AutoState) Run(ctx context.Context) (spyStart *signature.SpyStart, err error) {
+	logrus.Debug("transitioned to auto state")
+
+	// wait for the shell to prompt, the user can still type in the meantime
+	wiretapState := CreateWiretapState(bm.BaseState)
+	prompt := signature.NewRegexSignature(config.Config.Launch.Prompt.Regexp())
+	found, err := wiretapState.TransferUntilFound(ctx, signature.Hotkeys(config.CancelAction), []signature.Signature{prompt})
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	} else if found == nil {
+		return nil, tracerr.New("the shell ended before it prompted")
+	} else if found != prompt {
+		logrus.Info("auto launch is canceled.")
+		bm.Notify("auto launch is canceled")
+		return nil, nil
+	}
+	logrus.Info("shell prompt detected, running preflight.")
+
+	// preflight prints its own failure
+	preflightState := NewPreflightState(bm.BaseState)
+	if err := preflightState.Run(ctx); err != nil {
+		return nil, err
+	}
+
+	// print error on stdout if spy-mode could not be launched
+	defer func() {
+		if err != nil {
+			bm.PrintFailure("launching spy-mode failed", err)
+		}
+	}()
+
+	shell := NewShellExecutor(bm.PtyStdout, bm.Pty)
+	shell.Stdout = bm.Stdout
+	command := fmt.Sprintf("cd \"%s\" && %s\n", preflightState.Directory, config.Config.Launch.Command)
+	spyStart, err = Execute[*signature.SpyStart](ctx, shell, nil)(command, &signature.SpyStart{})
+	if err != nil {
+		logrus.Errorf("failed to launch spy-mode: %s", err.Error())
+		return nil, err
+	}
+
+	logrus.Info("spy-mode is launched.")
+	return spyStart, nil
+}
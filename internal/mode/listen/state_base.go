@@ -1,63 +1,224 @@
 package listen
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	creackpty "github.com/creack/pty"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/io/term"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/ztrue/tracerr"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// the size of the pty of a headless session, wide enough to keep long lines of the shell from wrapping
+const (
+	headlessRows = 50
+	headlessCols = 250
+)
+
+// ptyDrainTimeout is how long the output of an exited process is read before its pty is closed anyway, e.g. as a
+// background job of the process holds on to the pty
+const ptyDrainTimeout = time.Second
+
+// TransferRequest is an upload, a download or an uninstall that is queued through ctl
+type TransferRequest struct {
+	Action config.KeyAction // config.UploadAction, config.DownloadAction or config.UninstallAction
+	Path   string           // local for uploads, remote for downloads
+}
+
 type BaseState struct {
+	Name        string
 	Process     *exec.Cmd
 	Pty         *os.File
 	Stdin       *core.ContextReader
+	Stdout      io.Writer
 	PtyStdout   *core.ContextReader
-	RawSwitch   *term.RawSwitch
 	SizeAdaptor *term.SizeAdaptor
-	isClosed    atomic.Bool
+	// Services are the services of listen-mode with their session resolved, the ones of this session are bound when
+	// spy-mode connects
+	Services   []config.ServiceDescription
+	terminal   *Terminal
+	status     atomic.Value
+	isClosed   atomic.Bool
+	transfers  chan TransferRequest
+	ptyDrained chan struct{}
+	// preflightDir is the directory that preflight uploaded to in this session, where uninstall removes the files from
+	// if preflight.install_dir is not set
+	preflightDir string
 }
 
-func CreateBaseState(cmd []string) (*BaseState, error) {
+func CreateBaseState(name string, cmd []string, services []config.ServiceDescription, terminal *Terminal) (*BaseState, error) {
 	// create slave process and capture its tty in a pty
-	logrus.Info("shell to execute: ", cmd)
+	logrus.Infof("shell to execute for session \"%s\": %v", name, cmd)
 	proc := exec.Command(cmd[0], cmd[1:]...)
 	pty, err := creackpty.Start(proc)
-	logrus.Info("slave process started with pid: ", proc.Process.Pid)
 	if err != nil {
 		return nil, err
 	}
+	logrus.Info("slave process started with pid: ", proc.Process.Pid)
 
-	// create raw switch to switch between raw and cooked mode
-	rawSwitch, err := term.NewRawSwitch()
-	if err != nil {
-		return nil, err
+	// create size adaptor to adapt the size of the pty, a headless terminal has no size to adapt to
+	var sizeAdaptor *term.SizeAdaptor
+	if terminal.Headless() {
+		err = creackpty.Setsize(pty, &creackpty.Winsize{Rows: headlessRows, Cols: headlessCols})
+	} else {
+		sizeAdaptor, err = term.NewSizeAdaptor(pty)
 	}
-
-	// create size adaptor to adapt the size of the pty
-	sizeAdaptor, err := term.NewSizeAdaptor(pty)
 	if err != nil {
+		_ = pty.Close()
 		return nil, err
 	}
 
+	stdin, stdout := terminal.Attach(name)
+	ptyDrained := make(chan struct{})
 	baseState := BaseState{
+		Name:        name,
+		Services:    services,
 		Process:     proc,
 		Pty:         pty,
-		Stdin:       core.NewContextReader(os.Stdin),
-		PtyStdout:   core.NewContextReader(pty),
-		RawSwitch:   rawSwitch,
+		Stdin:       core.NewContextReader(stdin),
+		Stdout:      stdout,
+		PtyStdout:   core.NewContextReader(&ptyReader{File: pty, drained: ptyDrained}),
 		SizeAdaptor: sizeAdaptor,
+		terminal:    terminal,
+		transfers:   make(chan TransferRequest, 1),
+		ptyDrained:  ptyDrained,
 	}
+	baseState.SetStatus("wiretap")
 
 	baseState.interruptInputsOnExit()
 
 	return &baseState, nil
 }
 
+// SetStatus records the state the session is in, e.g. to be listed through ctl
+func (bm *BaseState) SetStatus(status string) {
+	bm.status.Store(status)
+}
+
+func (bm *BaseState) Status() string {
+	if bm.isClosed.Load() {
+		return "closed"
+	}
+	return bm.status.Load().(string)
+}
+
+// Notify prints a message of unbound-ssh on the terminal of the session
+func (bm *BaseState) Notify(format string, args ...any) {
+	_, _ = fmt.Fprintf(bm.Stdout, "\r\n\033[0;33m[unbound-ssh] %s\033[0m\r\n", fmt.Sprintf(format, args...))
+}
+
+// PrintFailure shows an error in a red banner on the terminal of the session, headed by what failed
+func (bm *BaseState) PrintFailure(what string, err error) {
+	_, _ = fmt.Fprintf(bm.Stdout, "\n\n\r\n\033[0;31m   %s:\n\r\n   %s\033[0m\n\n\r\n", what, err.Error())
+}
+
+// PrintStatus shows the state of the session and the services it binds, details are appended to the state
+func (bm *BaseState) PrintStatus(details ...string) {
+	services := lo.FilterMap(bm.Services, func(s config.ServiceDescription, _ int) (string, bool) {
+		return fmt.Sprintf("%s on %s", s.Type, s.Bind.FullAddress()), s.Session == bm.Name
+	})
+	if len(services) == 0 {
+		services = []string{"none"}
+	}
+	bm.Notify("session \"%s\": %s, services: %s", bm.Name, strings.Join(append([]string{bm.Status()}, details...), ", "), strings.Join(services, ", "))
+}
+
+// takeOverShell gets the shell ready for the commands of a state (see PrepareShell) and lets the cancel hotkey cancel
+// the returned context, release undoes both
+func (bm *BaseState) takeOverShell(ctx context.Context, state string) (_ context.Context, shell *ShellExecutor, release func(), err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	hotkeys := term.NewReadInBackground(bm.Stdin)
+	hotkeys.ReactTo(signature.NewHotkey(config.CancelAction), func() {
+		logrus.Infof("received cancel hotkey, exiting %s state.", state)
+		cancel()
+	}).Start(ctx)
+
+	shell = NewShellExecutor(bm.PtyStdout, bm.Pty)
+	shell.Stdout = bm.Stdout
+	restoreShell, err := PrepareShell(ctx, shell)
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+	return ctx, shell, func() {
+		restoreShell()
+		cancel()
+	}, nil
+}
+
+// uploadWithProgress shows a status line of the upload on the terminal in place of the commands that send the chunks
+func (bm *BaseState) uploadWithProgress(shell *ShellExecutor, filename string, size int64, upload func(progress *view.Progress) error) error {
+	progress := view.NewProgress(bm.Stdout, fmt.Sprintf("uploading %s", filename), size)
+	shell.Stdout = io.Discard
+	err := upload(progress)
+	shell.Stdout = bm.Stdout
+	progress.Finish(lo.Ternary(err == nil, "verified", "failed"))
+	return err
+}
+
+// RequestTransfer queues an upload or a download on the session, which starts once it is in wiretap state
+func (bm *BaseState) RequestTransfer(request TransferRequest) error {
+	select {
+	case bm.transfers <- request:
+		return nil
+	default:
+		return tracerr.Errorf("session \"%s\" has a transfer queued already", bm.Name)
+	}
+}
+
+// Transfers delivers the requests queued by RequestTransfer
+func (bm *BaseState) Transfers() <-chan TransferRequest {
+	return bm.transfers
+}
+
+// prompt reads a line that the user types, the cancel hotkey returns an empty line
+func (bm *BaseState) prompt(ctx context.Context, question string) (string, error) {
+	bm.Notify("%s", question)
+
+	cancel := config.Config.KeySequence(config.CancelAction).Bytes()
+	stdin := bm.Stdin.BindTo(ctx)
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := stdin.Read(buf); err != nil {
+			return "", tracerr.Wrap(err)
+		}
+
+		switch c := buf[0]; {
+		case c == '\r' || c == '\n':
+			_, _ = bm.Stdout.Write([]byte("\r\n"))
+			return strings.TrimSpace(string(line)), nil
+		case c == 0x7f || c == '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				_, _ = bm.Stdout.Write([]byte("\b \b"))
+			}
+		default:
+			line = append(line, c)
+			if len(cancel) > 0 && bytes.HasSuffix(line, cancel) {
+				bm.Notify("canceled")
+				return "", nil
+			}
+			_, _ = bm.Stdout.Write(buf)
+		}
+	}
+}
+
 // Check if the process is exited and return the error if it is exited with non-zero exit code
 func (bm *BaseState) isProcessExited() (bool, error) {
 	processState := bm.Process.ProcessState
@@ -85,7 +246,12 @@ func (bm *BaseState) interruptInputsOnExit() {
 			logrus.Debug("slave process exited with code: ", bm.Process.ProcessState.ExitCode())
 		}
 
-		// interrupt the all blocked readers
+		// interrupt the all blocked readers once the last output of the process is read
+		select {
+		case <-bm.ptyDrained:
+		case <-time.After(ptyDrainTimeout):
+			logrus.Debug("the output of the slave process is not drained, closing its pty anyway.")
+		}
 		bm.Close()
 	}()
 }
@@ -96,21 +262,16 @@ func (bm *BaseState) Close() {
 	}
 	bm.isClosed.Store(true)
 
-	bm.RawSwitch.Restore()
-	bm.SizeAdaptor.Close()
+	if bm.SizeAdaptor != nil {
+		bm.SizeAdaptor.Close()
+	}
 
 	// EOF makes more sense than Cancel
-	err := os.Stdin.Close()
-	if err != nil {
-		if !errors.Is(err, os.ErrClosed) {
-			logrus.Warn("error while closing stdin: ", err)
-		}
-	} else {
-		logrus.Debug("stdin closed.")
-	}
+	bm.terminal.Detach(bm.Name)
+	logrus.Debug("stdin closed.")
 
 	// EOF makes more sense than Cancel
-	err = bm.Pty.Close()
+	err := bm.Pty.Close()
 	if err != nil {
 		if !errors.Is(err, os.ErrClosed) {
 			logrus.Warn("error while closing slave process pty: ", err)
@@ -119,3 +280,22 @@ func (bm *BaseState) Close() {
 		logrus.Debug("slave process pty closed.")
 	}
 }
+
+// ptyReader reads the output of the slave process, ending with EOF instead of the EIO that linux returns once the
+// process has exited and its output is drained
+type ptyReader struct {
+	*os.File
+	drained chan struct{}
+	once    sync.Once
+}
+
+func (r *ptyReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	if errors.Is(err, syscall.EIO) || errors.Is(err, io.EOF) {
+		r.once.Do(func() {
+			close(r.drained)
+		})
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,30 @@
+package listen
+
+import (
+	creackpty "github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os/exec"
+	"testing"
+)
+
+func TestPtyReaderDrainsExitedProcess(t *testing.T) {
+	proc := exec.Command("printf", "access denied")
+	pty, err := creackpty.Start(proc)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pty.Close()
+	})
+	require.NoError(t, proc.Wait())
+
+	// the output outlives the process, and then ends in EOF
+	reader := &ptyReader{File: pty, drained: make(chan struct{})}
+	output, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "access denied", string(output))
+	select {
+	case <-reader.drained:
+	default:
+		require.Fail(t, "the pty is not reported as drained")
+	}
+}
@@ -18,10 +18,16 @@ type ConnectedState struct {
 	reader  core.ContextBindingReader
 	writer  stdio.Writer
 	manager *service.YamuxStreamManager
+	// VerifyProof checks the response of spy-mode to the handshake challenge, if set
+	VerifyProof func(proof string) error
+	// Keys encrypt the tunnel, if set
+	Keys *codec.Keys
+	// Transport of spy-mode, its output is extracted from the passthrough frames unless it is raw
+	Transport config.TransportType
+	// Files serves the get/put requests of the server, if set
+	Files *FileServer
 }
 
-const EndOfText byte = 3 // Ctrl+C in ascii
-
 func CreateConnectedState(r core.ContextBindingReader, w stdio.Writer) ConnectedState {
 	return ConnectedState{
 		reader: r,
@@ -30,8 +36,42 @@ func CreateConnectedState(r core.ContextBindingReader, w stdio.Writer) Connected
 }
 
 func (ym *ConnectedState) ListenAndServe(ctx context.Context, manager *service.ListenServiceManager) error {
+	closer, err := ym.Connect(ctx, manager.Session())
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	return ym.Serve(ctx, manager)
+}
+
+// Serve forwards the connections of the services through the yamux session that is created by Connect
+func (ym *ConnectedState) Serve(ctx context.Context, manager *service.ListenServiceManager) error {
+	if ym.manager == nil {
+		return tracerr.New("not connected")
+	}
+	if ym.Files != nil {
+		go ym.manager.AcceptFileStreams(ym.Files.Serve)
+	}
+
+	err := ym.manager.ReceiveAndOpenYamux(ctx, manager)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	return nil
+}
+
+// Manager is available once Connect succeeds
+func (ym *ConnectedState) Manager() *service.YamuxStreamManager {
+	return ym.manager
+}
+
+// Connect creates the yamux client session and completes the hello exchange with spy-mode, closer is to be called
+// once the session is no longer needed
+func (ym *ConnectedState) Connect(ctx context.Context, session string) (closer func(), err error) {
 	if ym.manager != nil {
-		return tracerr.New("already listening")
+		return nil, tracerr.New("already listening")
 	}
 
 	// create a yamux client config
@@ -45,42 +85,56 @@ func (ym *ConnectedState) ListenAndServe(ctx context.Context, manager *service.L
 	// assign rwc
 	reader := ym.reader.BindTo(context.Background())
 	writer := core.NewContextBoundWriter(ym.writer, context.Background())
-	closer := func() {
+	closeRwc := func() {
 		logrus.Info("closing virtual connection of listen-mode.")
 		_ = reader.Close()
 		_ = writer.Close()
 	}
-	rwc := core.WithRwCloser(codec.WrapCodec(reader, writer), func() error {
-		closer()
+	defer func() {
+		if err != nil {
+			closeRwc()
+		}
+	}()
+	var codecReader stdio.Reader = reader
+	if ym.Transport != "" && ym.Transport != config.Raw {
+		codecReader = codec.PassthroughReader(reader)
+	}
+	rw, err := codec.WrapCodec(codecReader, writer, ym.Keys)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	rwc := core.WithRwCloser(rw, func() error {
+		closeRwc()
 		return nil
 	})
-	defer closer()
 
 	// create a yamux client session
-	session, err := yamux.Client(rwc, cfg)
+	yamuxSession, err := yamux.Client(rwc, cfg)
 	if err != nil {
-		return tracerr.Wrap(err)
+		return nil, tracerr.Wrap(err)
 	}
 	logrus.Info("created yamux client session.")
 
 	// forward traffic of the incoming connections to the yamux session
-	ym.manager = service.NewYamuxForwarderManager(session, writer)
+	ym.manager = service.NewYamuxForwarderManager(yamuxSession, writer)
+	defer func() {
+		// spy-mode waits on the session until it is closed, so it must not be left open when the hello fails
+		if err != nil {
+			_ = ym.manager.Close(false)
+			ym.manager = nil
+		}
+	}()
 
 	// open the control stream
-	err = openAndAssignControlStream(ym.manager)
+	err = openAndAssignControlStream(ctx, ym.manager, session, ym.VerifyProof)
 	if err != nil {
-		return err
-	}
-
-	err = ym.manager.ReceiveAndOpenYamux(ctx, manager)
-	if err != nil {
-		return tracerr.Wrap(err)
+		return nil, err
 	}
 
-	return nil
+	return closeRwc, nil
 }
 
-func openAndAssignControlStream(ym *service.YamuxStreamManager) error {
+func openAndAssignControlStream(ctx context.Context, ym *service.YamuxStreamManager, session string, verifyProof func(string) error) error {
 	yamuxStream, err := ym.Session.OpenStream()
 	if err != nil {
 		return tracerr.Wrap(err)
@@ -90,12 +144,23 @@ func openAndAssignControlStream(ym *service.YamuxStreamManager) error {
 	// send the first command as HelloRequest
 	ym.ControlStream = service.NewControlStream(yamuxStream)
 
-	sendHello := service.RpcCreateInvoker[mode.HelloExchange](ym.ControlStream)
-	_, err = sendHello(mode.HelloRequest{})
+	helloCtx, cancel := context.WithTimeout(ctx, config.Config.Transfer.RequestTimeout)
+	defer cancel()
+	res, err := service.RpcInvoke[mode.HelloExchange](helloCtx, ym.ControlStream, mode.HelloRequest{ProtocolVersion: mode.ProtocolVersion, Session: session})
 	if err != nil {
 		logrus.Errorf("failed to complete HelloExchange through control stream: %s", err.Error())
 		return err
 	}
+	if res.Error != "" {
+		logrus.Errorf("spy-mode rejected HelloExchange: %s", res.Error)
+		return tracerr.Errorf("spy-mode rejected hello: %s", res.Error)
+	}
+	if verifyProof != nil {
+		if err := verifyProof(res.Proof); err != nil {
+			logrus.Errorf("spy-mode failed to prove the secret: %s", err.Error())
+			return tracerr.Wrap(err)
+		}
+	}
 
 	logrus.Info("successfully completed HelloExchange through control stream.")
 	return nil
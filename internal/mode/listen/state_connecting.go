@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/codec"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/io/term"
 	"github.com/nimatrueway/unbound-ssh/internal/service"
@@ -14,46 +15,84 @@ import (
 
 type ConnectingState struct {
 	baseState *BaseState
+	spyStart  *signature.SpyStart
 }
 
-func NewConnectingState(baseState *BaseState) ConnectingState {
-	return ConnectingState{baseState: baseState}
+func NewConnectingState(baseState *BaseState, spyStart *signature.SpyStart) ConnectingState {
+	return ConnectingState{baseState: baseState, spyStart: spyStart}
 }
 
 func (pym *ConnectingState) Connect(ctx context.Context) error {
+	// do not even respond to a spy-mode that does not know the secret
+	if err := pym.spyStart.Verify(); err != nil {
+		pym.warn(err)
+		return tracerr.Wrap(err)
+	}
+
 	// complete the handshake
-	_, err := fmt.Fprintf(pym.baseState.Pty, signature.ListenConnectFmt)
+	listenConnect := signature.NewListenConnect(pym.spyStart)
+	_, err := fmt.Fprint(pym.baseState.Pty, signature.GenerateListenConnect(listenConnect))
 	if err != nil {
-		fmt.Print("\r\nfailed to connect.\r\n")
+		_, _ = fmt.Fprint(pym.baseState.Stdout, "\r\nfailed to connect.\r\n")
 		return tracerr.Wrap(err)
 	} else {
-		fmt.Print(signature.ListenConnectFmt)
+		_, _ = fmt.Fprint(pym.baseState.Stdout, signature.GenerateListenConnect(listenConnect))
 	}
 	logrus.Info("sent hello back to complete handshake.")
 
-	// launch the listener
-	serviceManager, err := service.NewListenServiceManager(config.Config.Service)
-	if err != nil {
-		return err
-	}
-
 	// create connected state
 	connectedState := CreateConnectedState(pym.baseState.PtyStdout, pym.baseState.Pty)
+	connectedState.VerifyProof = func(proof string) error {
+		return signature.VerifyHelloProof(pym.spyStart, listenConnect, proof)
+	}
+	seal, open, err := signature.ListenTunnelKeys(pym.spyStart, listenConnect)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	connectedState.Keys = &codec.Keys{Seal: seal, Open: open}
+	connectedState.Transport = pym.spyStart.Transport()
+	connectedState.Files = &FileServer{Stdout: pym.baseState.Stdout}
 
 	// exchange context
 	connectedStateCtx, connectedStateCloser := context.WithCancel(ctx)
 
-	// allow user to kill the process with ctrl+c or ctrl+d
-	reactToClose := term.NewReadInBackground(pym.baseState.Stdin.BindTo(connectedStateCtx))
+	// allow user to disconnect or see the status with hotkeys
+	hotkeys := term.NewReadInBackground(pym.baseState.Stdin)
 	stop := func() {
-		logrus.Info("received interrupt signal, shutting down connected state.")
+		logrus.Info("received disconnect hotkey, shutting down connected state.")
 		connectedStateCloser()
 	}
-	reactToClose.ReactTo(EndOfText, stop).Start(connectedStateCtx)
+	status := func() {
+		if manager := connectedState.Manager(); manager != nil {
+			pym.baseState.PrintStatus(fmt.Sprintf("%d open streams", manager.Session.NumStreams()))
+		} else {
+			pym.baseState.PrintStatus()
+		}
+	}
+	hotkeys.
+		ReactTo(signature.NewHotkey(config.DisconnectAction), stop).
+		ReactTo(signature.NewHotkey(config.StatusAction), status).
+		Start(connectedStateCtx)
 	defer connectedStateCloser()
 
-	// transition to connected state
-	err = connectedState.ListenAndServe(connectedStateCtx, serviceManager)
+	// the services are launched only once spy-mode passes the challenge
+	closeConnection, err := connectedState.Connect(connectedStateCtx, pym.baseState.Name)
+	if err == nil {
+		defer closeConnection()
+
+		// launch the listener
+		var serviceManager *service.ListenServiceManager
+		serviceManager, err = service.NewListenServiceManager(pym.baseState.Services, pym.baseState.Name)
+		if err != nil {
+			_ = connectedState.Manager().Close(false)
+			return err
+		}
+
+		// transition to connected state
+		err = connectedState.Serve(connectedStateCtx, serviceManager)
+	} else if errors.Is(err, signature.ErrUnauthenticated) {
+		pym.warn(err)
+	}
 
 	if err != nil {
 		logrus.Warnf("connected state failed: %s", err.Error())
@@ -66,3 +105,9 @@ func (pym *ConnectingState) Connect(ctx context.Context) error {
 
 	return nil
 }
+
+// warn lets the user know on the screen, since it may be an attempt to reach the services of listen-mode
+func (pym *ConnectingState) warn(err error) {
+	logrus.Warnf("refused spy-mode: %s", err.Error())
+	_, _ = fmt.Fprintf(pym.baseState.Stdout, "\r\n\033[0;31m[unbound-ssh] refused to connect to spy-mode: %s\033[0m\r\n", err.Error())
+}
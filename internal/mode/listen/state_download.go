@@ -0,0 +1,81 @@
+package listen
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"io"
+	"path"
+)
+
+// DownloadState downloads a file of the server into the download directory through the shell, so it works without
+// spy-mode, the reverse of UploadState
+type DownloadState struct {
+	*BaseState
+	// Path is the file on the server, relative to the working directory of the shell, it is asked for when empty
+	Path string
+}
+
+func NewDownloadState(baseState *BaseState, path string) DownloadState {
+	return DownloadState{BaseState: baseState, Path: path}
+}
+
+func (bm *DownloadState) Run(ctx context.Context) (err error) {
+	logrus.Debug("transitioned to download state")
+
+	dir := config.ProcessString(config.Config.Files.DownloadDir)
+	if dir == "" {
+		err = tracerr.New("download is disabled, download_dir of [files] is not set")
+		bm.PrintFailure("download failed", err)
+		return err
+	}
+	if bm.Path == "" {
+		bm.Path, err = bm.prompt(ctx, "file on the server to download: ")
+		if err != nil || bm.Path == "" {
+			return err
+		}
+	}
+
+	// print error on stdout if download failed
+	defer func() {
+		if err != nil {
+			bm.PrintFailure("download failed", err)
+		}
+	}()
+
+	ctx, shell, releaseShell, err := bm.takeOverShell(ctx, "download")
+	if err != nil {
+		return err
+	}
+	defer releaseShell()
+
+	probe, err := Execute[*NixProbeResult](ctx, shell, nil)(GeneratePrintNixProbe())
+	if err != nil {
+		logrus.Errorf("failed to write available commands probe to robot: %s", err.Error())
+		return err
+	}
+
+	// the progress line stands in for the commands that transfer the chunks
+	var progress *view.Progress
+	newProgress := func(size uint64) io.Writer {
+		progress = view.NewProgress(bm.Stdout, fmt.Sprintf("downloading %s", path.Base(bm.Path)), int64(size))
+		return progress
+	}
+	shell.Stdout = io.Discard
+	saved, err := DownloadAndSave(ctx, shell, bm.Path, dir, probe, newProgress)
+	shell.Stdout = bm.Stdout
+	if progress != nil {
+		progress.Finish(lo.Ternary(err == nil, "verified", "failed"))
+	}
+	if err != nil {
+		logrus.Errorf("failed to download file: %s", err.Error())
+		return err
+	}
+
+	bm.Notify("downloaded %s to %s", bm.Path, saved)
+	return nil
+}
@@ -0,0 +1,91 @@
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// LoginState runs the login script of the session, e.g. to get through bastion menus, mfa prompts or sudo, before
+// preflight and spy-mode. stdin is still forwarded so that the user can step in, the cancel hotkey aborts the script.
+type LoginState struct {
+	*BaseState
+	steps []config.LoginStep
+}
+
+func NewLoginState(baseState *BaseState, steps []config.LoginStep) LoginState {
+	return LoginState{BaseState: baseState, steps: steps}
+}
+
+func (bm *LoginState) Run(ctx context.Context) (err error) {
+	logrus.Debug("transitioned to login state")
+
+	// print error on stdout if login failed
+	defer func() {
+		if err != nil {
+			bm.PrintFailure("login script failed", err)
+		}
+	}()
+
+	wiretapState := CreateWiretapState(bm.BaseState)
+	for i, step := range bm.steps {
+		stepCtx, cancel := ctx, context.CancelFunc(func() {})
+		if step.Timeout > 0 {
+			stepCtx, cancel = context.WithTimeout(ctx, step.Timeout)
+		}
+		expect := signature.NewRegexSignature(step.Expect.Regexp())
+		found, err := wiretapState.TransferUntilFound(stepCtx, signature.Hotkeys(config.CancelAction), []signature.Signature{expect})
+		cancel()
+
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return tracerr.Errorf("step %d did not see %q in %s", i+1, step.Expect, step.Timeout)
+		} else if err != nil {
+			return tracerr.Wrap(err)
+		} else if found == nil {
+			return tracerr.Errorf("the shell ended before step %d saw %q", i+1, step.Expect)
+		} else if found != expect {
+			logrus.Info("login script is canceled.")
+			bm.Notify("login script is canceled")
+			return nil
+		}
+		logrus.Infof("login step %d matched %q.", i+1, step.Expect)
+
+		input, err := loginInput(ctx, step)
+		if err != nil {
+			return tracerr.Errorf("step %d: %w", i+1, err)
+		}
+		if _, err := bm.Pty.Write([]byte(input)); err != nil {
+			return tracerr.Wrap(err)
+		}
+	}
+
+	logrus.Info("login script is complete.")
+	return nil
+}
+
+// loginInput is what the step types, secrets are not logged
+func loginInput(ctx context.Context, step config.LoginStep) (string, error) {
+	switch {
+	case step.SendEnv != "":
+		value, ok := os.LookupEnv(step.SendEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", step.SendEnv)
+		}
+		return value + "\r", nil
+	case len(step.SendCommand) > 0:
+		output, err := exec.CommandContext(ctx, step.SendCommand[0], step.SendCommand[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to run %s: %w", step.SendCommand[0], err)
+		}
+		return strings.TrimRight(string(output), "\r\n") + "\r", nil
+	default:
+		return step.Send, nil
+	}
+}
@@ -2,15 +2,37 @@ package listen
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/io/term"
+	"github.com/nimatrueway/unbound-ssh/internal/release"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
 	"os"
+	"strings"
 )
 
+// the files that preflight leaves in its directory
+const (
+	binaryFile = "unbound-ssh"
+	configFile = "config.toml"
+	secretFile = "unbound_ssh.secret"
+)
+
+// certificateFile is the name that the certificate of a service is uploaded as
+func certificateFile(service int) string {
+	return fmt.Sprintf("service%d_certificate.pem", service)
+}
+
 type PreflightState struct {
 	*BaseState
+	// Directory is where the files are uploaded to (preflight.install_dir or the working directory of the shell), known
+	// once Run has started
+	Directory string
 }
 
 func NewPreflightState(baseState *BaseState) PreflightState {
@@ -20,42 +42,46 @@ func NewPreflightState(baseState *BaseState) PreflightState {
 func (bm *PreflightState) Run(ctx context.Context) (err error) {
 	logrus.Debug("transitioned to preflight state")
 
-	// allow user to kill the process with ctrl+c or ctrl+d
+	// allow user to cancel the preflight with a hotkey
 	ctx, connectedStateCloser := context.WithCancel(ctx)
-	reactToClose := term.NewReadInBackground(bm.BaseState.Stdin.BindTo(ctx))
+	hotkeys := term.NewReadInBackground(bm.BaseState.Stdin)
 	stop := func() {
-		logrus.Info("received interrupt signal, existing preflight mode.")
+		logrus.Info("received cancel hotkey, exiting preflight mode.")
 		connectedStateCloser()
 	}
-	reactToClose.ReactTo(EndOfText, stop).Start(ctx)
+	hotkeys.ReactTo(signature.NewHotkey(config.CancelAction), stop).Start(ctx)
 	defer connectedStateCloser()
 
 	shell := NewShellExecutor(bm.PtyStdout, bm.Pty)
+	shell.Stdout = bm.Stdout
 
 	// print error on stdout if preflight failed
 	defer func() {
 		if err != nil {
-			fmt.Printf("\n\n\r\n\033[0;31m   preflight failed:\n\r\n   %s\033[0m\n\n\r\n", err.Error())
+			bm.PrintFailure("preflight failed", err)
 		}
 	}()
 
-	// disable history for the duration of the preflight
-	histFileRes, err := shell.Execute(ctx, "echo $HISTFILE", nil)
+	// speak sh and disable history for the duration of the preflight
+	restoreShell, err := PrepareShell(ctx, shell)
 	if err != nil {
-		logrus.Errorf("failed to get HISTFILE: %s", err.Error())
 		return err
 	}
-	_, err = shell.Execute(ctx, "unset HISTFILE", nil)
+	defer restoreShell()
+
+	leaveInstallDir, err := enterInstallDir(ctx, shell)
 	if err != nil {
-		logrus.Errorf("failed to disable history: %s", err.Error())
 		return err
 	}
-	defer func() {
-		_, err := shell.Execute(context.Background(), fmt.Sprintf("export HISTFILE=\"%s\"", histFileRes.Output), nil)
-		if err != nil {
-			logrus.Errorf("failed to re-enable history: %s", err.Error())
-		}
-	}()
+	defer leaveInstallDir()
+
+	pwdRes, err := shell.Execute(ctx, "pwd", nil)
+	if err != nil {
+		logrus.Errorf("failed to get the working directory: %s", err.Error())
+		return err
+	}
+	bm.Directory = strings.TrimSpace(pwdRes.Output)
+	bm.preflightDir = bm.Directory
 
 	// start the full duplex transfer
 	GlobalProbeResult, err := Execute[*NixProbeResult](ctx, shell, nil)(GeneratePrintNixProbe())
@@ -66,29 +92,30 @@ func (bm *PreflightState) Run(ctx context.Context) (err error) {
 		logrus.Infof("available *nix commands probed: %#v", GlobalProbeResult)
 	}
 
-	codec := config.Config.Preflight.UploadCodec
-	if codec == config.Auto {
-		if GlobalProbeResult.HasGunzip() {
-			if GlobalProbeResult.HasPython3() {
-				codec = config.GzipAscii85
-			} else {
-				codec = config.GzipBase64
-			}
-		} else {
-			if GlobalProbeResult.HasPython3() {
-				codec = config.Ascii85
-			} else {
-				codec = config.Base64
-			}
-		}
-	}
+	codec := chooseUploadCodec(GlobalProbeResult)
+	method := chooseUploadMethod(GlobalProbeResult)
 
 	logrus.Info("uploading file.")
 	if !GlobalProbeResult.HasUpdatedUnboundSsh() {
-		url := GlobalProbeResult.BinaryDownloadUrl()
-		filename := "unbound-ssh"
+		var binary string
+		binary, err = GlobalProbeResult.Binary()
+		if err != nil {
+			logrus.Errorf("failed to pick the binary for the server: %s", err.Error())
+			return err
+		}
+		logrus.Infof("server platform detected as %s, uploading %s.", GlobalProbeResult.Platform(), binary)
+		url := release.DownloadUrl(binary)
+		filename := binaryFile
+		var cache *release.Cache
+		cache, err = release.OpenCache()
+		if err != nil {
+			logrus.Errorf("failed to open the binary cache: %s", err.Error())
+			return err
+		}
 
-		if GlobalProbeResult.HasInternetAccess() && GlobalProbeResult.HasWget() {
+		if cache.Pinned {
+			err = bm.uploadCachedBinary(ctx, shell, cache, binary, filename, codec, method)
+		} else if GlobalProbeResult.HasInternetAccess() && GlobalProbeResult.HasWget() {
 			_, err = shell.Execute(ctx, fmt.Sprintf(`wget -O "%[1]s.tmp" "%[2]s" && mv "%[1]s.tmp" %[1]s`, filename, url), nil)
 			if err != nil {
 				logrus.Errorf("failed to download %s binary using wget: %s", filename, err.Error())
@@ -99,10 +126,7 @@ func (bm *PreflightState) Run(ctx context.Context) (err error) {
 				logrus.Errorf("failed to download %s binary using curl: %s", filename, err.Error())
 			}
 		} else {
-			err = FetchUrlAndUpload(ctx, shell, url, filename, codec)
-			if err != nil {
-				logrus.Errorf("failed to upload file: %s", err.Error())
-			}
+			err = bm.uploadCachedBinary(ctx, shell, cache, binary, filename, codec, method)
 		}
 
 		if err != nil {
@@ -120,7 +144,9 @@ func (bm *PreflightState) Run(ctx context.Context) (err error) {
 
 	// collect all dependency files and their content to upload
 	dependencyFiles := make(map[string]string)
-	conf := config.Config.Clone()
+	secretFiles := []string{secretFile}
+	// spy-mode gets its part of the config alone, with the files it refers to renamed to the uploaded ones
+	conf := config.Config.SpyConfig()
 	for i := range conf.Service {
 		certFile := conf.Service[i].Certificate
 		if certFile != "" {
@@ -128,21 +154,150 @@ func (bm *PreflightState) Run(ctx context.Context) (err error) {
 			if err != nil {
 				logrus.Errorf("error reading certificate file %s to transfer to server: %s", conf.Service[i].Certificate, err.Error())
 			} else {
-				conf.Service[i].Certificate = fmt.Sprintf("service%d_certificate.pem", i)
+				conf.Service[i].Certificate = certificateFile(i)
 				dependencyFiles[conf.Service[i].Certificate] = string(data)
+				secretFiles = append(secretFiles, conf.Service[i].Certificate)
 			}
 		}
 	}
-	dependencyFiles["config.toml"] = conf.SaveData()
+	// spy-mode needs the secret to authenticate itself
+	conf.Auth.SecretFile = secretFile
+	dependencyFiles[conf.Auth.SecretFile] = hex.EncodeToString(config.Secret)
+	dependencyFiles[configFile] = conf.SaveData()
+	if diff, err := config.SpyConfigDiff(config.Config.SaveData(), dependencyFiles[configFile]); err != nil {
+		logrus.Warnf("failed to compare the config of spy-mode with the local one: %s", err.Error())
+	} else {
+		logrus.Debugf("the config of spy-mode leaves out (-) or changes (~): %s", strings.Join(diff, ", "))
+	}
 
-	// upload all dependency files
-	for filename, content := range dependencyFiles {
-		err = Upload(ctx, shell, content, filename, codec)
-		if err != nil {
-			logrus.Errorf("failed to upload file: %s", err.Error())
+	// upload all dependency files, the secret and certificates (and the chunks they are uploaded in) are created
+	// readable by the user alone
+	uploadFiles := func(secret bool) error {
+		for filename, content := range dependencyFiles {
+			if lo.Contains(secretFiles, filename) != secret {
+				continue
+			}
+			err := bm.uploadWithProgress(shell, filename, int64(len(content)), func(progress *view.Progress) error {
+				return Upload(ctx, shell, content, filename, codec, method, progress)
+			})
+			if err != nil {
+				logrus.Errorf("failed to upload file: %s", err.Error())
+				return err
+			}
+		}
+		return nil
+	}
+	if err = uploadFiles(false); err != nil {
+		return err
+	}
+	err = withUmask(ctx, shell, "077", func() error {
+		// files that are left from an earlier preflight keep their permissions when they are overwritten
+		if _, err := shell.Execute(ctx, fmt.Sprintf("touch %[1]s && chmod 600 %[1]s", strings.Join(secretFiles, " ")), nil); err != nil {
+			logrus.Errorf("failed to restrict access to the secret and certificates: %s", err.Error())
 			return err
 		}
+		return uploadFiles(true)
+	})
+	if err != nil {
+		return err
+	}
+
+	return bm.runSteps(ctx, shell, codec, method)
+}
+
+// withUmask runs f with the umask of the shell set to mask, and restores the umask afterward
+func withUmask(ctx context.Context, shell *ShellExecutor, mask string, f func() error) error {
+	res, err := shell.Execute(ctx, "umask", nil)
+	if err != nil {
+		logrus.Errorf("failed to get the umask: %s", err.Error())
+		return err
 	}
+	if err := shell.ExecuteInShell(ctx, "umask "+mask); err != nil {
+		logrus.Errorf("failed to set the umask: %s", err.Error())
+		return err
+	}
+	defer func() {
+		if err := shell.ExecuteInShell(context.Background(), "umask "+strings.TrimSpace(res.Output)); err != nil {
+			logrus.Errorf("failed to restore the umask: %s", err.Error())
+		}
+	}()
+	return f()
+}
 
-	return nil
+// enterInstallDir changes the working directory of the shell to preflight.install_dir, which is created for the user
+// alone if it is missing, the returned function changes it back
+func enterInstallDir(ctx context.Context, shell *ShellExecutor) (leave func(), err error) {
+	dir := config.Config.Preflight.InstallDir
+	if dir == "" {
+		return func() {}, nil
+	}
+	if err := shell.ExecuteInShell(ctx, fmt.Sprintf("mkdir -p -m 700 %[1]s && cd %[1]s", config.Config.InstallDirArg())); err != nil {
+		logrus.Errorf("failed to enter the install directory %s: %s", dir, err.Error())
+		return nil, err
+	}
+	return func() {
+		if err := shell.ExecuteInShell(context.Background(), `cd "$OLDPWD"`); err != nil {
+			logrus.Errorf("failed to leave the install directory: %s", err.Error())
+		}
+	}, nil
+}
+
+// uploadCachedBinary uploads a binary from the cache, which downloads it first if needed and possible
+func (bm *PreflightState) uploadCachedBinary(ctx context.Context, shell *ShellExecutor, cache *release.Cache, binary string, filename string, codec config.PreflightUploadCodec, method config.PreflightUploadMethod) error {
+	path, err := cache.Get(binary)
+	if err != nil {
+		logrus.Errorf("failed to get %s from the binary cache: %s", binary, err.Error())
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	logrus.Infof("uploading %s from the binary cache.", path)
+	err = bm.uploadWithProgress(shell, filename, stat.Size(), func(progress *view.Progress) error {
+		return ReadFileAndUpload(ctx, shell, path, filename, codec, method, progress)
+	})
+	if err != nil {
+		logrus.Errorf("failed to upload file: %s", err.Error())
+	}
+	return err
+}
+
+// chooseUploadCodec resolves the "auto" upload codec to the most compact one the remote machine can decode
+func chooseUploadCodec(probe *NixProbeResult) config.PreflightUploadCodec {
+	codec := config.Config.Preflight.UploadCodec
+	if codec != config.Auto {
+		return codec
+	}
+	if probe.HasGunzip() {
+		if probe.HasPython3() {
+			return config.GzipAscii85
+		}
+		return config.GzipBase64
+	}
+	if probe.HasPython3() {
+		return config.Ascii85
+	}
+	return config.Base64
+}
+
+// chooseUploadMethod resolves the "auto" upload method to the first one the remote machine supports, printf is the
+// last resort as it needs nothing but the shell
+func chooseUploadMethod(probe *NixProbeResult) config.PreflightUploadMethod {
+	method := config.Config.Preflight.UploadMethod
+	if method != config.AutoUploadMethod {
+		return method
+	}
+	switch {
+	case !probe.HasStty():
+		return config.Printf
+	case probe.HasDdFullblock():
+		return config.Dd
+	case probe.HasHeadBytes():
+		return config.Head
+	case probe.HasPython3():
+		return config.Python3
+	default:
+		return config.Printf
+	}
 }
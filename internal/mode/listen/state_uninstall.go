@@ -0,0 +1,80 @@
+package listen
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"strings"
+)
+
+// UninstallState removes what preflight and spy-mode leave on the server: the files in preflight.install_dir (or the
+// directory that preflight uploaded to in this session if it is not set), the install directory itself if nothing else
+// is in it, and the sockets of services that a spy-mode which did not exit cleanly left in the temporary directory
+type UninstallState struct {
+	*BaseState
+}
+
+func NewUninstallState(baseState *BaseState) UninstallState {
+	return UninstallState{BaseState: baseState}
+}
+
+func (bm *UninstallState) Run(ctx context.Context) (err error) {
+	logrus.Debug("transitioned to uninstall state")
+
+	// print error on stdout if uninstall failed
+	defer func() {
+		if err != nil {
+			bm.PrintFailure("uninstall failed", err)
+		}
+	}()
+
+	// without preflight.install_dir the files are only known to be in the directory that preflight uploaded to
+	installDir := config.Config.Preflight.InstallDir
+	dir := lo.Ternary(installDir != "", installDir, bm.preflightDir)
+	if dir == "" {
+		return tracerr.New("preflight.install_dir is not set and preflight did not run in this session, so there is no directory known to uninstall from")
+	}
+
+	ctx, shell, releaseShell, err := bm.takeOverShell(ctx, "uninstall")
+	if err != nil {
+		return err
+	}
+	defer releaseShell()
+
+	removeFiles := fmt.Sprintf(`for f in %s; do if [ -e "$f" ]; then rm -f "$f" && echo "$f"; fi; done`, strings.Join(preflightArtifacts(), " "))
+	removeSockets := `for f in "${TMPDIR:-/tmp}"/unbound-ssh-service-*.sock; do if [ -O "$f" ]; then rm -f "$f" && echo "$f"; fi; done`
+	var cmd string
+	if installDir != "" {
+		// the directory is gone already if an earlier uninstall emptied it
+		cmd = fmt.Sprintf("if cd %[1]s 2>/dev/null; then %[2]s; cd \"$OLDPWD\" && { rmdir %[1]s 2>/dev/null; true; }; fi; %[3]s", config.Config.InstallDirArg(), removeFiles, removeSockets)
+	} else {
+		// the directory that preflight found the shell in is not made for unbound-ssh, so it stays
+		cmd = fmt.Sprintf("if cd %s 2>/dev/null; then %s; cd \"$OLDPWD\"; fi; %s", quote(dir), removeFiles, removeSockets)
+	}
+	res, err := shell.Execute(ctx, cmd, nil)
+	if err != nil {
+		logrus.Errorf("failed to remove the files of unbound-ssh: %s", err.Error())
+		return err
+	}
+
+	removed := lo.Compact(strings.Split(res.Output, "\n"))
+	logrus.Infof("uninstalled unbound-ssh, removed: %v", removed)
+	bm.Notify("uninstalled unbound-ssh from %s, removed %d files", dir, len(removed))
+	return nil
+}
+
+// preflightArtifacts lists the files that preflight and spy-mode leave in their directory as shell globs, including the
+// chunks of an interrupted upload
+func preflightArtifacts() []string {
+	files := []string{binaryFile, binaryFile + ".tmp", configFile, secretFile, "service*_certificate.pem"}
+	chunks := lo.Map(files, func(file string, _ int) string {
+		return file + "_chunk_*.tmp"
+	})
+	files = append(files, chunks...)
+	// what spy-mode creates, as named by the config that preflight uploads
+	spyFiles := strings.NewReplacer("$(mode)", "spy", "$(time)", "*", "$(random)", "*")
+	return append(files, spyFiles.Replace(config.Config.Files.Socket), spyFiles.Replace(config.Config.Log.File))
+}
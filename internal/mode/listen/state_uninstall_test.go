@@ -0,0 +1,128 @@
+package listen
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnterInstallDir(t *testing.T) {
+	cwd := t.TempDir()
+	shell := startShell(t, cwd).shell()
+	installDir := filepath.Join(t.TempDir(), "cache", "unbound-ssh")
+	setInstallDir(t, installDir)
+
+	leave, err := enterInstallDir(context.Background(), shell)
+	require.NoError(t, err)
+	require.Equal(t, installDir, workingDir(t, shell))
+	stat, err := os.Stat(installDir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), stat.Mode().Perm())
+
+	leave()
+	require.Equal(t, cwd, workingDir(t, shell))
+
+	// the directory is quoted, apart from a leading ~ that is the home directory of the shell
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	shell = startShell(t, cwd).shell()
+	setInstallDir(t, "~/it's a $dir; touch x")
+	leave, err = enterInstallDir(context.Background(), shell)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, "it's a $dir; touch x"), workingDir(t, shell))
+	leave()
+	requireFiles(t, home, "it's a $dir; touch x")
+	requireFiles(t, cwd)
+
+	// the shell stays where it is without install_dir
+	setInstallDir(t, "")
+	leave, err = enterInstallDir(context.Background(), shell)
+	require.NoError(t, err)
+	require.Equal(t, cwd, workingDir(t, shell))
+	leave()
+}
+
+func TestUninstall(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	cwd := t.TempDir()
+	writeFiles(t, cwd, binaryFile)
+	setInstallDir(t, "")
+
+	// without install_dir the files are only removed from where preflight uploaded them
+	base := startShell(t, cwd)
+	uninstall := NewUninstallState(base)
+	require.ErrorContains(t, uninstall.Run(context.Background()), "no directory known to uninstall from")
+	require.FileExists(t, filepath.Join(cwd, binaryFile))
+
+	base.preflightDir = filepath.Join(t.TempDir(), "it's here")
+	require.NoError(t, os.Mkdir(base.preflightDir, 0755))
+	writeFiles(t, base.preflightDir, binaryFile, configFile, secretFile, binaryFile+"_chunk_3.tmp", "notes.txt")
+	writeFiles(t, tmpDir, "unbound-ssh-service-0.sock")
+	require.NoError(t, uninstall.Run(context.Background()))
+	requireFiles(t, base.preflightDir, "notes.txt")
+	requireFiles(t, tmpDir)
+	require.FileExists(t, filepath.Join(cwd, binaryFile))
+
+	// install_dir is removed as well once it is empty
+	installDir := filepath.Join(t.TempDir(), "install dir")
+	setInstallDir(t, installDir)
+	require.NoError(t, os.Mkdir(installDir, 0700))
+	writeFiles(t, installDir, binaryFile, configFile)
+	require.NoError(t, uninstall.Run(context.Background()))
+	require.NoDirExists(t, installDir)
+	require.FileExists(t, filepath.Join(cwd, binaryFile))
+}
+
+// startShell runs a shell (sh unless another command is given) in dir as the process of a headless session
+func startShell(t *testing.T, dir string, shellCmd ...string) *BaseState {
+	if len(shellCmd) == 0 {
+		shellCmd = []string{"sh"}
+	}
+	base, err := CreateBaseState("test", []string{"sh", "-c", "cd " + quote(dir) + " && exec " + strings.Join(shellCmd, " ")}, nil, NewHeadlessTerminal())
+	require.NoError(t, err)
+	base.Stdout = io.Discard
+	t.Cleanup(base.Close)
+	return base
+}
+
+func (bm *BaseState) shell() *ShellExecutor {
+	shell := NewShellExecutor(bm.PtyStdout, bm.Pty)
+	shell.Stdout = io.Discard
+	return shell
+}
+
+func setInstallDir(t *testing.T, dir string) {
+	installDir := config.Config.Preflight.InstallDir
+	config.Config.Preflight.InstallDir = dir
+	t.Cleanup(func() {
+		config.Config.Preflight.InstallDir = installDir
+	})
+}
+
+func workingDir(t *testing.T, shell *ShellExecutor) string {
+	res, err := shell.Execute(context.Background(), "pwd", nil)
+	require.NoError(t, err)
+	return strings.TrimSpace(res.Output)
+}
+
+func writeFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0600))
+	}
+}
+
+func requireFiles(t *testing.T, dir string, names ...string) {
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	found := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		found = append(found, entry.Name())
+	}
+	require.ElementsMatch(t, names, found, dir)
+}
@@ -0,0 +1,183 @@
+package listen
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// plainFileName matches the names that the shell takes literally
+var plainFileName = regexp.MustCompile(`^[A-Za-z0-9._+,@=][A-Za-z0-9._+,@=-]*$`)
+
+// UploadState uploads a local file or directory into the working directory of the remote shell with the preflight
+// machinery, so it works without spy-mode. A directory is uploaded as a tar archive and extracted on the server.
+type UploadState struct {
+	*BaseState
+	// Path is the local file or directory to upload, it is asked for when empty
+	Path string
+}
+
+func NewUploadState(baseState *BaseState, path string) UploadState {
+	return UploadState{BaseState: baseState, Path: path}
+}
+
+func (bm *UploadState) Run(ctx context.Context) (err error) {
+	logrus.Debug("transitioned to upload state")
+
+	if bm.Path == "" {
+		bm.Path, err = bm.prompt(ctx, "local file or directory to upload: ")
+		if err != nil || bm.Path == "" {
+			return err
+		}
+	}
+
+	// print error on stdout if upload failed
+	defer func() {
+		if err != nil {
+			bm.PrintFailure("upload failed", err)
+		}
+	}()
+
+	stat, err := os.Stat(bm.Path)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	// the name goes into the commands that write the chunks as is, along with their globs, "." is named after its
+	// directory like its archive
+	absPath, err := filepath.Abs(bm.Path)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	if !plainFileName.MatchString(filepath.Base(absPath)) {
+		return tracerr.Errorf("%s has characters in its name that the shell would interpret, only names of letters, digits and \"._+,@=-\" that do not start with \"-\" can be uploaded", filepath.Base(absPath))
+	}
+
+	ctx, shell, releaseShell, err := bm.takeOverShell(ctx, "upload")
+	if err != nil {
+		return err
+	}
+	defer releaseShell()
+
+	probe, err := Execute[*NixProbeResult](ctx, shell, nil)(GeneratePrintNixProbe())
+	if err != nil {
+		logrus.Errorf("failed to write available commands probe to robot: %s", err.Error())
+		return err
+	}
+
+	file, filename, size := bm.Path, filepath.Base(absPath), stat.Size()
+	if stat.IsDir() {
+		if !probe.HasTar() {
+			return tracerr.Errorf("tar is not available on the server to extract %s", filename)
+		}
+		file, err = archiveDir(bm.Path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = os.Remove(file)
+		}()
+		filename += ".tar"
+		archiveStat, err := os.Stat(file)
+		if err != nil {
+			return tracerr.Wrap(err)
+		}
+		size = archiveStat.Size()
+	}
+
+	// the progress line stands in for the commands that transfer the chunks
+	logrus.Infof("uploading %s as %s.", bm.Path, filename)
+	err = bm.uploadWithProgress(shell, filename, size, func(progress *view.Progress) error {
+		return ReadFileAndUpload(ctx, shell, file, filename, chooseUploadCodec(probe), chooseUploadMethod(probe), progress)
+	})
+	if err != nil {
+		logrus.Errorf("failed to upload file: %s", err.Error())
+		return err
+	}
+
+	if stat.IsDir() {
+		_, err = shell.Execute(ctx, fmt.Sprintf(`tar -xf %[1]s && rm %[1]s`, quote(filename)), nil)
+		if err != nil {
+			logrus.Errorf("failed to extract %s: %s", filename, err.Error())
+			return err
+		}
+	}
+
+	bm.Notify("uploaded %s", bm.Path)
+	return nil
+}
+
+// archiveDir writes a directory into a temporary tar archive whose entries are prefixed with the name of the directory
+func archiveDir(dir string) (archive string, err error) {
+	file, err := os.CreateTemp("", "unbound-ssh-upload-*.tar")
+	if err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = file.Close()
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	// "." and ".." are named after the directory they stand for
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	root := filepath.Dir(dir)
+	writer := tar.NewWriter(file)
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		_, err = io.Copy(writer, f)
+		return err
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	return file.Name(), nil
+}
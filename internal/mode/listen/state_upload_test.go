@@ -0,0 +1,79 @@
+package listen
+
+import (
+	"archive/tar"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveDir(t *testing.T) {
+	project := filepath.Join(t.TempDir(), "parent", "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(project, "nested", "deep"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(project, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(project, "nested", "deep", "run.sh"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, os.Symlink("nested/deep/run.sh", filepath.Join(project, "run")))
+	require.NoError(t, os.Symlink("nested", filepath.Join(project, "dir")))
+
+	expected := map[string]tar.Header{
+		"project":                    {Typeflag: tar.TypeDir},
+		"project/a.txt":              {Typeflag: tar.TypeReg, Mode: 0644},
+		"project/dir":                {Typeflag: tar.TypeSymlink, Linkname: "nested"},
+		"project/nested":             {Typeflag: tar.TypeDir},
+		"project/nested/deep":        {Typeflag: tar.TypeDir},
+		"project/nested/deep/run.sh": {Typeflag: tar.TypeReg, Mode: 0755},
+		"project/run":                {Typeflag: tar.TypeSymlink, Linkname: "nested/deep/run.sh"},
+	}
+	contents := map[string]string{"project/a.txt": "a", "project/nested/deep/run.sh": "#!/bin/sh"}
+
+	// the entries are prefixed with the name of the directory however it is referred to
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(filepath.Join(project, "nested")))
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	for _, dir := range []string{project, project + "/", filepath.Join(project, "nested", ".."), ".."} {
+		archive, err := archiveDir(dir)
+		require.NoError(t, err, dir)
+		t.Cleanup(func() {
+			_ = os.Remove(archive)
+		})
+
+		file, err := os.Open(archive)
+		require.NoError(t, err)
+		reader := tar.NewReader(file)
+		seen := map[string]bool{}
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			want, ok := expected[header.Name]
+			require.True(t, ok, "unexpected entry %s of %s", header.Name, dir)
+			require.Equal(t, want.Typeflag, header.Typeflag, header.Name)
+			require.Equal(t, want.Linkname, header.Linkname, header.Name)
+			if want.Mode != 0 {
+				require.Equal(t, want.Mode, header.Mode&0777, header.Name)
+			}
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, contents[header.Name], string(content), header.Name)
+			seen[header.Name] = true
+		}
+		require.NoError(t, file.Close())
+		require.Len(t, seen, len(expected), dir)
+	}
+}
+
+func TestPlainFileName(t *testing.T) {
+	for _, name := range []string{"project", "notes.txt", "v1.2_build+3", ".dotfiles"} {
+		require.True(t, plainFileName.MatchString(name), name)
+	}
+	for _, name := range []string{"$(reboot)", "a\"b", "`id`", "my project", "-rf", "*.txt", "a;b", ""} {
+		require.False(t, plainFileName.MatchString(name), name)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/sirupsen/logrus"
-	"os"
 )
 
 type WiretapState struct {
@@ -23,7 +22,7 @@ func (bm *WiretapState) TransferUntilFound(ctx context.Context, localSigs []sign
 	// start the full duplex transfer
 	stdinTapped := core.NewSignatureDetector(localSigs...)
 	remoteStdoutTapped := core.NewSignatureDetector(remoteSigs...)
-	err = core.DuplexCopy(ctx, bm.Pty, stdinTapped.Wrap(bm.Stdin), os.Stdout, remoteStdoutTapped.Wrap(bm.PtyStdout))
+	err = core.DuplexCopy(ctx, bm.Pty, stdinTapped.Wrap(bm.Stdin), bm.Stdout, remoteStdoutTapped.Wrap(bm.PtyStdout))
 	if errors.Is(err, core.SignatureFound) {
 		err = nil
 	}
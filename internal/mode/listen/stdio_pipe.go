@@ -0,0 +1,46 @@
+package listen
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"io"
+	"net"
+	"time"
+)
+
+// stdioDialInterval is how often the service is dialed while spy-mode is not connected yet
+const stdioDialInterval = 500 * time.Millisecond
+
+// PipeStdio connects stdin/stdout (of listen-mode) to a service once it is up, which lets listen-mode act as the
+// ProxyCommand of ssh. It returns when either side of the pipe is closed.
+func PipeStdio(ctx context.Context, service config.ServiceDescription, stdin io.Reader, stdout io.Writer) error {
+	bind := service.Bind
+	var conn net.Conn
+	for {
+		var err error
+		conn, err = (&net.Dialer{}).DialContext(ctx, bind.Network(), bind.String())
+		if err == nil {
+			break
+		}
+		logrus.Debugf("service %s is not up yet: %s", bind.FullAddress(), err.Error())
+
+		select {
+		case <-ctx.Done():
+			return tracerr.Wrap(ctx.Err())
+		case <-time.After(stdioDialInterval):
+		}
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	logrus.Infof("piping stdin/stdout to service %s.", bind.FullAddress())
+
+	err := core.DuplexCopy(ctx, conn, core.NewContextReader(stdin), stdout, &core.ContextReadCloser{ReadCloser: conn})
+	if err != nil && !core.IsAlreadyClosed(err) {
+		return tracerr.Wrap(err)
+	}
+	return nil
+}
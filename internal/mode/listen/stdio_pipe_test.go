@@ -0,0 +1,64 @@
+package listen
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeStdio(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "echo.sock")
+	service := config.ServiceDescription{Type: config.Echo, Bind: config.NewAddress("unix", socket)}
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+
+	piped := make(chan error, 1)
+	go func() {
+		piped <- PipeStdio(context.Background(), service, stdinR, stdoutW)
+	}()
+
+	// the service comes up after the pipe has dialed it a few times
+	time.Sleep(2 * stdioDialInterval)
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	_, err = stdinW.Write([]byte("hello"))
+	require.NoError(t, err)
+	echoed := make([]byte, len("hello"))
+	_, err = io.ReadFull(stdoutR, echoed)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(echoed))
+
+	// closing stdin ends the pipe
+	require.NoError(t, stdinW.Close())
+	select {
+	case err := <-piped:
+		require.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		require.FailNow(t, "the pipe did not end with stdin")
+	}
+}
+
+func TestPipeStdioCancelled(t *testing.T) {
+	service := config.ServiceDescription{Type: config.Echo, Bind: config.NewAddress("unix", filepath.Join(t.TempDir(), "down.sock"))}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*stdioDialInterval)
+	defer cancel()
+
+	err := PipeStdio(ctx, service, strings.NewReader(""), io.Discard)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,179 @@
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/term"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"io"
+	"os"
+	"sync"
+)
+
+// Terminal shares the real terminal of listen-mode between sessions, only the foreground session receives the
+// keystrokes and gets its output printed, the others keep running in the background.
+type Terminal struct {
+	lock       sync.Mutex
+	sessions   []*terminalSession
+	foreground *terminalSession
+	rawSwitch  *term.RawSwitch
+	headless   bool
+}
+
+type terminalSession struct {
+	name   string
+	stdinR *io.PipeReader
+	stdinW *io.PipeWriter
+}
+
+func NewTerminal() (*Terminal, error) {
+	// create raw switch to switch between raw and cooked mode
+	rawSwitch, err := term.NewRawSwitch()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Terminal{rawSwitch: rawSwitch}
+	go t.forwardStdin()
+	return t, nil
+}
+
+// NewHeadlessTerminal leaves the real terminal alone, the sessions get no keystrokes and their output is dropped
+func NewHeadlessTerminal() *Terminal {
+	return &Terminal{headless: true}
+}
+
+func (t *Terminal) Headless() bool {
+	return t.headless
+}
+
+// Attach adds a session to the terminal, the first session to attach is brought to the foreground
+func (t *Terminal) Attach(name string) (stdin io.Reader, stdout io.Writer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stdinR, stdinW := io.Pipe()
+	session := &terminalSession{name: name, stdinR: stdinR, stdinW: stdinW}
+	t.sessions = append(t.sessions, session)
+	if t.foreground == nil {
+		t.foreground = session
+	}
+
+	return stdinR, &terminalWriter{terminal: t, session: session}
+}
+
+// Detach removes the session from the terminal, its stdin reaches EOF and the next session is brought to the
+// foreground if it was in the foreground
+func (t *Terminal) Detach(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	session, idx, found := lo.FindIndexOf(t.sessions, func(s *terminalSession) bool {
+		return s.name == name
+	})
+	if !found {
+		return
+	}
+	_ = session.stdinW.Close()
+	t.sessions = append(t.sessions[:idx], t.sessions[idx+1:]...)
+
+	if t.foreground == session {
+		t.foreground = nil
+		if len(t.sessions) > 0 {
+			t.switchTo(t.sessions[0])
+		}
+	}
+}
+
+// Switch brings the given session to the foreground
+func (t *Terminal) Switch(name string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	session, found := lo.Find(t.sessions, func(s *terminalSession) bool {
+		return s.name == name
+	})
+	if !found {
+		return tracerr.Errorf("unknown session: %s", name)
+	}
+	if t.foreground != session {
+		t.switchTo(session)
+	}
+	return nil
+}
+
+func (t *Terminal) switchTo(session *terminalSession) {
+	t.foreground = session
+	logrus.Infof("session \"%s\" is brought to the foreground.", session.name)
+	if t.headless {
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "\r\n\033[0;33m[unbound-ssh] switched to session \"%s\"\033[0m\r\n", session.name)
+}
+
+func (t *Terminal) Foreground() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.foreground == nil {
+		return ""
+	}
+	return t.foreground.name
+}
+
+func (t *Terminal) Close() {
+	if t.headless {
+		return
+	}
+	t.rawSwitch.Restore()
+}
+
+func (t *Terminal) forwardStdin() {
+	buf := make([]byte, config.Config.Transfer.Buffer)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			t.lock.Lock()
+			foreground := t.foreground
+			t.lock.Unlock()
+
+			// the write blocks until the session reads it, a detached session fails it right away
+			if foreground != nil {
+				_, _ = foreground.stdinW.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				logrus.Warn("error while reading stdin: ", err)
+			}
+
+			// EOF makes more sense than Cancel
+			t.lock.Lock()
+			for _, session := range t.sessions {
+				_ = session.stdinW.Close()
+			}
+			t.lock.Unlock()
+			return
+		}
+	}
+}
+
+// terminalWriter prints the output of a session only while it is in the foreground
+type terminalWriter struct {
+	terminal *Terminal
+	session  *terminalSession
+}
+
+func (w *terminalWriter) Write(p []byte) (int, error) {
+	w.terminal.lock.Lock()
+	defer w.terminal.lock.Unlock()
+
+	if w.terminal.headless || w.terminal.foreground != w.session {
+		// the output of a background session is dropped, so that it never blocks on the terminal
+		return len(p), nil
+	}
+	return os.Stdout.Write(p)
+}
@@ -2,6 +2,8 @@ package spy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/hashicorp/yamux"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/codec"
@@ -19,6 +21,10 @@ type ConnectedState struct {
 	writer  stdio.Writer
 	session *yamux.Session
 	manager *service.YamuxStreamManager
+	// HelloProof is the response to the handshake challenge of listen-mode
+	HelloProof string
+	// Keys encrypt the tunnel, if set
+	Keys *codec.Keys
 }
 
 func NewConnectedState(r core.ContextBindingReader, w stdio.Writer) ConnectedState {
@@ -49,11 +55,15 @@ func (ym *ConnectedState) ListenAndServe(ctx context.Context, serviceManager *se
 		_ = reader.Close()
 		_ = writer.Close()
 	}
-	rwc := core.WithRwCloser(codec.WrapCodec(reader, writer), func() error {
+	defer closer()
+	rw, err := codec.WrapCodec(reader, writer, ym.Keys)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	rwc := core.WithRwCloser(rw, func() error {
 		closer()
 		return nil
 	})
-	defer closer()
 
 	// create yamux server session
 	session, err := yamux.Server(rwc, cfg)
@@ -66,11 +76,25 @@ func (ym *ConnectedState) ListenAndServe(ctx context.Context, serviceManager *se
 	ym.manager = service.NewYamuxForwarderManager(session, writer)
 
 	// open the accept stream
-	err = acceptAndAssignControlStream(ym.manager)
-	if err != nil {
+	err = acceptAndAssignControlStream(ctx, ym.manager, serviceManager, ym.HelloProof)
+	if errors.Is(err, service.ErrControlStreamClosed) || errors.Is(err, service.ErrRequestCancelled) {
+		// listen-mode gave up on the hello (e.g. it was disconnected right away), there is nothing to serve
+		logrus.Warnf("listen-mode left before the hello was complete: %s", err.Error())
+		return nil
+	} else if err != nil {
 		return err
 	}
 
+	// let "unbound-ssh get/put" on this server reach listen-mode while it is connected
+	files, err := serveFileSocket(ctx, ym.manager)
+	if err != nil {
+		logrus.Warnf("get/put are disabled: %s", err.Error())
+	} else {
+		defer func() {
+			_ = files.Close()
+		}()
+	}
+
 	err = ym.manager.AcceptYamuxAndForward(ctx, serviceManager)
 	if err != nil {
 		return tracerr.Wrap(err)
@@ -79,7 +103,7 @@ func (ym *ConnectedState) ListenAndServe(ctx context.Context, serviceManager *se
 	return nil
 }
 
-func acceptAndAssignControlStream(ym *service.YamuxStreamManager) error {
+func acceptAndAssignControlStream(ctx context.Context, ym *service.YamuxStreamManager, serviceManager *service.SpyServiceManager, proof string) error {
 	yamuxStream, err := ym.Session.AcceptStream()
 	if err != nil {
 		return tracerr.Wrap(err)
@@ -88,10 +112,15 @@ func acceptAndAssignControlStream(ym *service.YamuxStreamManager) error {
 
 	ym.ControlStream = service.NewControlStream(yamuxStream)
 
-	helloResponder := func(hello mode.HelloRequest) (mode.HelloResponse, error) {
-		return mode.HelloResponse{}, nil
+	helloResponder := func(_ context.Context, hello mode.HelloRequest) (mode.HelloResponse, error) {
+		if hello.ProtocolVersion != mode.ProtocolVersion {
+			err := fmt.Errorf("listen-mode speaks protocol v%d but spy-mode speaks v%d, make sure both sides run the same version of unbound-ssh", hello.ProtocolVersion, mode.ProtocolVersion)
+			return mode.HelloResponse{Error: err.Error()}, err
+		}
+		serviceManager.AssignSession(hello.Session)
+		return mode.HelloResponse{Proof: proof}, nil
 	}
-	if err := service.RpcExpectAndRespond[mode.HelloExchange](ym.ControlStream, helloResponder); err != nil {
+	if err := service.RpcExpectAndRespond[mode.HelloExchange](ctx, ym.ControlStream, helloResponder); err != nil {
 		logrus.Errorf("failed to receive Hello or respond to it on the control stream: %s", err.Error())
 		return err
 	}
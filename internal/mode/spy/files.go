@@ -0,0 +1,35 @@
+package spy
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/ctl"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/service"
+	"github.com/sirupsen/logrus"
+	"net"
+)
+
+// serveFileSocket passes the connections of "unbound-ssh get/put" on to listen-mode, until the listener is closed
+func serveFileSocket(ctx context.Context, manager *service.YamuxStreamManager) (net.Listener, error) {
+	path := config.ProcessString(config.Config.Files.Socket)
+	listener, err := ctl.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Info("serving get/put on: ", path)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !core.IsAlreadyClosed(err) {
+					logrus.Warn("error accepting get/put connection: ", err)
+				}
+				return
+			}
+			go manager.OpenFileStream(ctx, conn)
+		}
+	}()
+	return listener, nil
+}
@@ -0,0 +1,137 @@
+package spy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	creackpty "github.com/creack/pty"
+	"github.com/nimatrueway/unbound-ssh/internal/io/codec"
+	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
+	"github.com/nimatrueway/unbound-ssh/internal/service"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	stdio "io"
+	"os"
+	"os/exec"
+)
+
+// RelayState runs the ssh of the next hop in a pty and acts as its listen-mode, so that the streams of further hops
+// can be relayed to it
+type RelayState struct {
+	Process   *exec.Cmd
+	Pty       *os.File
+	PtyStdout *core.ContextReader
+}
+
+func NewRelayState(cmd []string) (*RelayState, error) {
+	// create relay process and capture its tty in a pty
+	logrus.Info("relay command to execute: ", cmd)
+	proc := exec.Command(cmd[0], cmd[1:]...)
+	pty, err := creackpty.Start(proc)
+	if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	logrus.Info("relay process started with pid: ", proc.Process.Pid)
+
+	rs := &RelayState{
+		Process:   proc,
+		Pty:       pty,
+		PtyStdout: core.NewContextReader(pty),
+	}
+
+	// interrupt the readers when the process is exited
+	go func() {
+		if err := proc.Wait(); err != nil {
+			logrus.Warn("relay process did not exit gracefully: ", err)
+		} else {
+			logrus.Info("relay process exited.")
+		}
+		_ = pty.Close()
+	}()
+
+	return rs, nil
+}
+
+// Serve relays to the next hop whenever its spy-mode is started, until ctx is done or the relay process exits
+func (rs *RelayState) Serve(ctx context.Context, serviceManager *service.SpyServiceManager) {
+	for ctx.Err() == nil {
+		spyStart, listenConnect, err := rs.waitForSpy(ctx)
+		if errors.Is(err, signature.ErrUnauthenticated) {
+			logrus.Warnf("refused spy-mode of the next hop: %s", err.Error())
+			continue
+		} else if err != nil {
+			if !errors.Is(err, stdio.EOF) && !errors.Is(err, context.Canceled) && !core.IsAlreadyClosed(err) {
+				logrus.Warnf("stopped relaying to the next hop: %s", err.Error())
+			}
+			return
+		}
+
+		if err := rs.connectAndServe(ctx, serviceManager, spyStart, listenConnect); err != nil {
+			logrus.Warnf("relay to the next hop failed, waiting for its spy-mode to start again: %s", err.Error())
+		}
+	}
+}
+
+func (rs *RelayState) waitForSpy(ctx context.Context) (*signature.SpyStart, *signature.ListenConnect, error) {
+	// nobody sees the output of the next hop, so it is logged instead
+	logWriter := logrus.StandardLogger().WriterLevel(logrus.DebugLevel)
+	defer func() {
+		_ = logWriter.Close()
+	}()
+
+	spyStart := &signature.SpyStart{}
+	detector := core.NewSignatureDetector(spyStart)
+	_, err := stdio.Copy(logWriter, detector.Wrap(rs.PtyStdout).BindTo(ctx))
+	if !errors.Is(err, core.SignatureFound) {
+		if err == nil {
+			err = stdio.EOF
+		}
+		return nil, nil, err
+	}
+	logrus.Info("spy hello signature of the next hop detected.")
+	if err := spyStart.Verify(); err != nil {
+		return nil, nil, err
+	}
+
+	// complete the handshake
+	listenConnect := signature.NewListenConnect(spyStart)
+	_, err = fmt.Fprint(rs.Pty, signature.GenerateListenConnect(listenConnect))
+	if err != nil {
+		return nil, nil, tracerr.Wrap(err)
+	}
+	return spyStart, listenConnect, nil
+}
+
+func (rs *RelayState) connectAndServe(ctx context.Context, serviceManager *service.SpyServiceManager, spyStart *signature.SpyStart, listenConnect *signature.ListenConnect) error {
+	connectedState := listen.CreateConnectedState(rs.PtyStdout, rs.Pty)
+	connectedState.VerifyProof = func(proof string) error {
+		return signature.VerifyHelloProof(spyStart, listenConnect, proof)
+	}
+	seal, open, err := signature.ListenTunnelKeys(spyStart, listenConnect)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	connectedState.Keys = &codec.Keys{Seal: seal, Open: open}
+	connectedState.Transport = spyStart.Transport()
+
+	// this hop already checks the session of every stream, the next hop serves whatever it is relayed
+	closer, err := connectedState.Connect(ctx, "")
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	serviceManager.SetRelay(connectedState.Manager())
+	defer serviceManager.SetRelay(nil)
+	logrus.Info("relay to the next hop is established.")
+
+	return connectedState.Manager().ServeRelay(ctx)
+}
+
+func (rs *RelayState) Close() {
+	// fails harmlessly if it has already exited
+	_ = rs.Process.Process.Kill()
+	_ = rs.Pty.Close()
+}
@@ -0,0 +1,104 @@
+package mode
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/ztrue/tracerr"
+	"io"
+	"math"
+)
+
+// StreamHeader is written by the side that opens a yamux stream right before any other byte, it makes each stream
+// self-describing so that the accepting side knows how to serve it without coordinating through the control stream.
+type StreamHeader struct {
+	ServiceNumber int               `json:"service_number"`        // index of the service in the config file
+	Hop           string            `json:"hop,omitempty"`         // the spy-mode that serves it, others relay it
+	Destination   string            `json:"destination,omitempty"` // e.g. "tcp://host:port", used by dynamic proxies
+	Metadata      map[string]string `json:"metadata,omitempty"`    // free-form data for the service
+	File          *FileRequest      `json:"file,omitempty"`        // set on the streams that spy-mode opens for get/put
+}
+
+type StreamErrorCode string
+
+const (
+	StreamGeneralFailure     StreamErrorCode = "general_failure"
+	StreamNotAllowed         StreamErrorCode = "not_allowed"
+	StreamNetworkUnreachable StreamErrorCode = "network_unreachable"
+	StreamHostUnreachable    StreamErrorCode = "host_unreachable"
+	StreamConnectionRefused  StreamErrorCode = "connection_refused"
+	StreamTimeout            StreamErrorCode = "timeout"
+)
+
+// StreamReply is written back by the side that accepts a yamux stream once it knows whether it can serve the stream,
+// so that a failure only affects the very connection behind the stream.
+type StreamReply struct {
+	Error   StreamErrorCode `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+func (r *StreamReply) IsSuccess() bool {
+	return r.Error == ""
+}
+
+const maxFrameLength = math.MaxUint16
+
+// WriteStreamHeader writes the header as a 2-byte big-endian length followed by its json representation
+func WriteStreamHeader(w io.Writer, header StreamHeader) error {
+	return writeFrame(w, header)
+}
+
+// ReadStreamHeader reads exactly one header written by WriteStreamHeader and nothing more
+func ReadStreamHeader(r io.Reader) (StreamHeader, error) {
+	var header StreamHeader
+	err := readFrame(r, &header)
+	return header, err
+}
+
+func WriteStreamReply(w io.Writer, reply StreamReply) error {
+	return writeFrame(w, reply)
+}
+
+func ReadStreamReply(r io.Reader) (StreamReply, error) {
+	var reply StreamReply
+	err := readFrame(r, &reply)
+	return reply, err
+}
+
+func writeFrame(w io.Writer, obj any) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	if len(data) > maxFrameLength {
+		return tracerr.Errorf("stream frame is too long: %d bytes", len(data))
+	}
+
+	// write it in one go, so that it ends up in a single yamux frame
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err = w.Write(frame)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	return nil
+}
+
+func readFrame(r io.Reader, obj any) error {
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	if err := json.Unmarshal(data, obj); err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	return nil
+}
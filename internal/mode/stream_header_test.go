@@ -0,0 +1,51 @@
+package mode
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestStreamHeaderRoundTrip(t *testing.T) {
+	expected := StreamHeader{
+		ServiceNumber: 3,
+		Hop:           "bastion",
+		Destination:   "tcp://example.com:80",
+		Metadata:      map[string]string{"client": "127.0.0.1:5555"},
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteStreamHeader(buf, expected))
+	buf.WriteString("payload")
+
+	actual, err := ReadStreamHeader(buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	// the bytes following the header must be left untouched
+	rest, err := io.ReadAll(buf)
+	require.NoError(t, err)
+	require.Equal(t, "payload", string(rest))
+}
+
+func TestStreamHeaderTruncated(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteStreamHeader(buf, StreamHeader{ServiceNumber: 1}))
+	truncated := bytes.NewBuffer(buf.Bytes()[:buf.Len()-1])
+
+	_, err := ReadStreamHeader(truncated)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestStreamReplyRoundTrip(t *testing.T) {
+	expected := StreamReply{Error: StreamConnectionRefused, Message: "dial tcp 127.0.0.1:1: connect: connection refused"}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteStreamReply(buf, expected))
+
+	actual, err := ReadStreamReply(buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.False(t, actual.IsSuccess())
+}
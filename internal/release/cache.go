@@ -0,0 +1,224 @@
+package release
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/ztrue/tracerr"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ManifestFile lists the sha256 of the binaries of a cache in the format of sha256sum, so "sha256sum -c" verifies it too
+const ManifestFile = "SHA256SUMS"
+
+// Cache is a local directory of unbound-ssh binaries that preflight uploads to servers without internet access
+type Cache struct {
+	Dir string
+	// Pinned is set when the directory is configured, the binaries are then only taken from it and never downloaded
+	Pinned bool
+}
+
+// OpenCache opens preflight.binary_dir, or a directory per release (see Tag) under the cache directory of the user
+func OpenCache() (*Cache, error) {
+	cache := &Cache{Dir: config.ProcessString(config.Config.Preflight.BinaryDir), Pinned: true}
+	if cache.Dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, tracerr.Wrap(err)
+		}
+		cache.Dir = filepath.Join(base, "unbound-ssh", lo.Ternary(Tag() == "", "latest", Tag()))
+		cache.Pinned = false
+	}
+	if err := os.MkdirAll(cache.Dir, 0755); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return cache, nil
+}
+
+// Get returns the path of a cached binary, a cache that is not pinned downloads the binary if it is missing
+func (c *Cache) Get(binary string) (string, error) {
+	path, err := c.Lookup(binary)
+	if errors.Is(err, os.ErrNotExist) && !c.Pinned {
+		return c.Fetch(binary)
+	} else if errors.Is(err, os.ErrNotExist) {
+		return "", tracerr.Errorf("%s is not in %s, run \"unbound-ssh bundle\" to fill it: %w", binary, c.Dir, err)
+	}
+	return path, err
+}
+
+// Lookup returns the path of a cached binary once it is verified against the manifest
+func (c *Cache) Lookup(binary string) (string, error) {
+	manifest, err := c.readManifest()
+	if err != nil {
+		return "", err
+	}
+	expected, ok := manifest[binary]
+	if !ok {
+		return "", tracerr.Errorf("%s is not listed in %s: %w", binary, ManifestFile, os.ErrNotExist)
+	}
+
+	path := filepath.Join(c.Dir, binary)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return "", tracerr.Errorf("%s is corrupted, expected sha256 %s but it is %s", path, expected, actual)
+	}
+	return path, nil
+}
+
+// Fetch downloads a binary of the release into the cache, it is verified against the SHA256SUMS of the release if the
+// release publishes one
+func (c *Cache) Fetch(binary string) (string, error) {
+	published, err := fetchPublishedChecksums()
+	if err != nil {
+		return "", err
+	}
+	expected, ok := published[binary]
+	if published != nil && !ok {
+		return "", tracerr.Errorf("%s is not listed in %s of the release", binary, ManifestFile)
+	}
+
+	url := DownloadUrl(binary)
+	logrus.Infof("downloading %s into %s.", url, c.Dir)
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", tracerr.Errorf("GET %s failed: %w", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", tracerr.Errorf("GET %s responded with code: %d", url, resp.StatusCode)
+	}
+
+	return c.add(binary, resp.Body, expected)
+}
+
+// fetchPublishedChecksums downloads the SHA256SUMS of the release, it is nil if the release has none
+func fetchPublishedChecksums() (map[string]string, error) {
+	url := DownloadUrl(ManifestFile)
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, tracerr.Errorf("GET %s failed: %w", url, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		logrus.Warnf("the release publishes no %s, the binaries that are downloaded can not be verified.", ManifestFile)
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, tracerr.Errorf("GET %s responded with code: %d", url, resp.StatusCode)
+	}
+	return parseManifest(resp.Body)
+}
+
+// Add writes a binary into the cache and lists it in the manifest
+func (c *Cache) Add(binary string, content io.Reader) (path string, err error) {
+	return c.add(binary, content, "")
+}
+
+// add writes a binary into the cache, as long as its sha256 is the expected one if that is not empty
+func (c *Cache) add(binary string, content io.Reader, expected string) (path string, err error) {
+	tmp, err := os.CreateTemp(c.Dir, "."+binary+".*.part")
+	if err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), content); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && actual != expected {
+		return "", tracerr.Errorf("%s is corrupted, the release lists sha256 %s but it is %s", binary, expected, actual)
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	path = filepath.Join(c.Dir, binary)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+
+	manifest, err := c.readManifest()
+	if err != nil {
+		return "", err
+	}
+	manifest[binary] = actual
+	return path, c.writeManifest(manifest)
+}
+
+func (c *Cache) readManifest() (map[string]string, error) {
+	f, err := os.Open(filepath.Join(c.Dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return parseManifest(f)
+}
+
+// parseManifest reads a manifest in the format of sha256sum into the sha256 of each binary
+func parseManifest(r io.Reader) (map[string]string, error) {
+	manifest := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// "<sha256>  <name>", the name is preceded by "*" in binary mode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		manifest[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, tracerr.Wrap(err)
+	}
+	return manifest, nil
+}
+
+func (c *Cache) writeManifest(manifest map[string]string) error {
+	binaries := lo.Keys(manifest)
+	slices.Sort(binaries)
+	var sb strings.Builder
+	for _, binary := range binaries {
+		sb.WriteString(fmt.Sprintf("%s  %s\n", manifest[binary], binary))
+	}
+
+	path := filepath.Join(c.Dir, ManifestFile)
+	if err := os.WriteFile(path+".tmp", []byte(sb.String()), 0644); err != nil {
+		return tracerr.Wrap(err)
+	}
+	return tracerr.Wrap(os.Rename(path+".tmp", path))
+}
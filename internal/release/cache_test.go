@@ -0,0 +1,128 @@
+package release
+
+import (
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pinCache(t *testing.T) *Cache {
+	original := config.Config.Preflight.BinaryDir
+	config.Config.Preflight.BinaryDir = t.TempDir()
+	t.Cleanup(func() {
+		config.Config.Preflight.BinaryDir = original
+	})
+
+	cache, err := OpenCache()
+	require.NoError(t, err)
+	require.True(t, cache.Pinned)
+	return cache
+}
+
+func TestCacheAddAndLookup(t *testing.T) {
+	cache := pinCache(t)
+	binary := BinaryName("linux_amd64")
+
+	path, err := cache.Add(binary, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(cache.Dir, binary), path)
+
+	// the manifest is in the format of sha256sum
+	manifest, err := os.ReadFile(filepath.Join(cache.Dir, ManifestFile))
+	require.NoError(t, err)
+	require.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  unbound-ssh_linux_amd64\n", string(manifest))
+
+	found, err := cache.Lookup(binary)
+	require.NoError(t, err)
+	require.Equal(t, path, found)
+}
+
+func TestCacheRejectsCorruptedBinary(t *testing.T) {
+	cache := pinCache(t)
+	binary := BinaryName("linux_arm64")
+
+	path, err := cache.Add(binary, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("hellO"), 0755))
+
+	_, err = cache.Lookup(binary)
+	require.ErrorContains(t, err, "corrupted")
+}
+
+func TestPinnedCacheDoesNotDownload(t *testing.T) {
+	cache := pinCache(t)
+
+	_, err := cache.Get(BinaryName("darwin_arm64"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.ErrorContains(t, err, "unbound-ssh bundle")
+}
+
+// serveRelease serves the assets of a release at ReleasesUrl and records the paths that are requested
+func serveRelease(t *testing.T, version string, assets map[string]string) *[]string {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		content, ok := assets[path.Base(r.URL.Path)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	releasesUrl, originalVersion := ReleasesUrl, config.Version
+	ReleasesUrl, config.Version = server.URL, version
+	t.Cleanup(func() {
+		ReleasesUrl, config.Version = releasesUrl, originalVersion
+		server.Close()
+	})
+	return &requested
+}
+
+func TestFetchTaggedRelease(t *testing.T) {
+	cache := pinCache(t)
+	binary := BinaryName("linux_amd64")
+	requested := serveRelease(t, "v1.2.3", map[string]string{
+		binary:       "hello",
+		ManifestFile: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  unbound-ssh_linux_amd64\n",
+	})
+
+	path, err := cache.Fetch(binary)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/download/v1.2.3/SHA256SUMS", "/download/v1.2.3/unbound-ssh_linux_amd64"}, *requested)
+	found, err := cache.Lookup(binary)
+	require.NoError(t, err)
+	require.Equal(t, path, found)
+}
+
+func TestFetchRejectsBinaryThatMismatchesPublishedChecksum(t *testing.T) {
+	cache := pinCache(t)
+	binary := BinaryName("linux_amd64")
+	serveRelease(t, "v1.2.3", map[string]string{
+		binary:       "hellO",
+		ManifestFile: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824  unbound-ssh_linux_amd64\n",
+	})
+
+	_, err := cache.Fetch(binary)
+	require.ErrorContains(t, err, "the release lists sha256 2cf24dba")
+	_, err = cache.Lookup(binary)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	leftovers, err := filepath.Glob(filepath.Join(cache.Dir, "*"+binary+"*"))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+}
+
+func TestFetchDevelopmentBuildWithoutPublishedChecksums(t *testing.T) {
+	cache := pinCache(t)
+	binary := BinaryName("darwin_arm64")
+	requested := serveRelease(t, "v1.2.3-4-gabcdef", map[string]string{binary: "hello"})
+
+	_, err := cache.Fetch(binary)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/latest/download/SHA256SUMS", "/latest/download/unbound-ssh_darwin_arm64"}, *requested)
+}
@@ -0,0 +1,80 @@
+package release
+
+import (
+	"fmt"
+	"github.com/samber/lo"
+	"strings"
+)
+
+// Platform is what the server tells about itself, the raw outputs are kept to report them when no binary matches
+type Platform struct {
+	Uname   string // output of "uname -sm", e.g. "Linux aarch64"
+	LongBit string // output of "getconf LONG_BIT", 32 on a 32-bit userland even if the kernel is 64-bit
+	Libc    string // first lines of "ldd --version", only informative since the binaries are statically linked
+}
+
+// Os is the GOOS of the platform, empty if it is not recognized
+func (p Platform) Os() string {
+	kernel, _, _ := strings.Cut(strings.TrimSpace(p.Uname), " ")
+	switch strings.ToLower(kernel) {
+	case "darwin":
+		return "darwin"
+	case "linux":
+		return "linux"
+	case "freebsd":
+		return "freebsd"
+	default:
+		return ""
+	}
+}
+
+// Arch is the GOARCH of the platform, empty if it is not recognized
+func (p Platform) Arch() string {
+	fields := strings.Fields(p.Uname)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	machine := strings.ToLower(fields[len(fields)-1])
+	is32Bit := strings.TrimSpace(p.LongBit) == "32"
+	switch {
+	case machine == "x86_64" || machine == "amd64":
+		return lo.Ternary(is32Bit, "386", "amd64")
+	case machine == "aarch64" || machine == "arm64" || machine == "aarch64_be":
+		return lo.Ternary(is32Bit, "arm", "arm64")
+	case lo.Contains([]string{"i386", "i486", "i586", "i686", "i86pc", "x86"}, machine):
+		return "386"
+	case machine == "arm" || machine == "armv8l" || strings.HasPrefix(machine, "armv6") || strings.HasPrefix(machine, "armv7"):
+		return "arm"
+	case machine == "riscv64":
+		return "riscv64"
+	default:
+		return ""
+	}
+}
+
+// LibcName is "musl" or "glibc", empty if it is not recognized
+func (p Platform) LibcName() string {
+	libc := strings.ToLower(p.Libc)
+	if strings.Contains(libc, "musl") {
+		return "musl"
+	} else if strings.Contains(libc, "glibc") || strings.Contains(libc, "gnu libc") {
+		return "glibc"
+	}
+	return ""
+}
+
+// Target is the released target that runs on the platform, an error that tells what was detected is returned if
+// there is none
+func (p Platform) Target() (string, error) {
+	target := fmt.Sprintf("%s_%s", p.Os(), p.Arch())
+	if p.Os() == "" || p.Arch() == "" || !lo.Contains(Targets, target) {
+		return "", fmt.Errorf("no unbound-ssh binary is released for the server (uname -sm: %q, LONG_BIT: %q, libc: %q), supported targets: %s",
+			strings.TrimSpace(p.Uname), strings.TrimSpace(p.LongBit), lo.Ternary(p.LibcName() == "", "unknown", p.LibcName()), strings.Join(Targets, ", "))
+	}
+	return target, nil
+}
+
+func (p Platform) String() string {
+	return fmt.Sprintf("%s/%s (uname -sm: %q, LONG_BIT: %q, libc: %q)", p.Os(), p.Arch(), strings.TrimSpace(p.Uname), strings.TrimSpace(p.LongBit), p.LibcName())
+}
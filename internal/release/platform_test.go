@@ -0,0 +1,49 @@
+package release
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestPlatformTarget(t *testing.T) {
+	for _, tc := range []struct {
+		platform Platform
+		target   string
+	}{
+		{Platform{Uname: "Linux x86_64", LongBit: "64", Libc: "ldd (GNU libc) 2.35"}, "linux_amd64"},
+		{Platform{Uname: "Linux x86_64", LongBit: "32"}, "linux_386"},
+		{Platform{Uname: "Linux i686", LongBit: "32"}, "linux_386"},
+		{Platform{Uname: "Linux aarch64", LongBit: "64", Libc: "musl libc (aarch64)"}, "linux_arm64"},
+		{Platform{Uname: "Linux aarch64", LongBit: "32"}, "linux_arm"},
+		{Platform{Uname: "Linux armv7l", LongBit: "32"}, "linux_arm"},
+		{Platform{Uname: "Linux armv6l"}, "linux_arm"},
+		{Platform{Uname: "Linux riscv64", LongBit: "64"}, "linux_riscv64"},
+		{Platform{Uname: "Darwin arm64", LongBit: "64"}, "darwin_arm64"},
+		{Platform{Uname: "Darwin x86_64", LongBit: "64"}, "darwin_amd64"},
+		{Platform{Uname: "FreeBSD amd64", LongBit: "64"}, "freebsd_amd64"},
+		{Platform{Uname: "FreeBSD arm64\n", LongBit: "64\n"}, "freebsd_arm64"},
+	} {
+		target, err := tc.platform.Target()
+		require.NoError(t, err, tc.platform.Uname)
+		require.Equal(t, tc.target, target, tc.platform.Uname)
+	}
+}
+
+func TestPlatformWithoutTarget(t *testing.T) {
+	for _, platform := range []Platform{
+		{},
+		{Uname: "Linux mips", LongBit: "32"},
+		{Uname: "SunOS i86pc", LongBit: "64"},
+		{Uname: "FreeBSD i386", LongBit: "32"},
+	} {
+		_, err := platform.Target()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), platform.Uname)
+	}
+}
+
+func TestPlatformLibc(t *testing.T) {
+	require.Equal(t, "glibc", Platform{Libc: "ldd (Ubuntu GLIBC 2.35-0ubuntu3.6) 2.35"}.LibcName())
+	require.Equal(t, "musl", Platform{Libc: "musl libc (x86_64)"}.LibcName())
+	require.Equal(t, "", Platform{Libc: "sh: ldd: not found"}.LibcName())
+}
@@ -0,0 +1,42 @@
+package release
+
+import (
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"regexp"
+)
+
+// ReleasesUrl is the GitHub page of the releases, the binaries and their SHA256SUMS are assets of a release
+var ReleasesUrl = "https://github.com/nimatrueway/unbound-ssh/releases"
+
+// releaseTagRegex matches the versions that are released, a build between tags is versioned like "v1.2.3-4-gabcdef"
+var releaseTagRegex = regexp.MustCompile(`^v[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// Targets are the os/arch pairs that unbound-ssh is released for, see scripts/build.sh. The binaries are statically
+// linked, so the linux ones run on glibc and musl (e.g. alpine) alike.
+var Targets = []string{
+	"darwin_amd64", "darwin_arm64",
+	"linux_386", "linux_amd64", "linux_arm", "linux_arm64", "linux_riscv64",
+	"freebsd_amd64", "freebsd_arm64",
+}
+
+// BinaryName is the name of the released binary of a target, e.g. "unbound-ssh_linux_amd64"
+func BinaryName(target string) string {
+	return fmt.Sprintf("unbound-ssh_%s", target)
+}
+
+// Tag is the release of this build, or empty for a build that was not released, which goes with the latest release
+func Tag() string {
+	if releaseTagRegex.MatchString(config.Version) {
+		return config.Version
+	}
+	return ""
+}
+
+// DownloadUrl is where an asset of the release of this build (see Tag) is downloaded from, e.g. a binary or SHA256SUMS
+func DownloadUrl(asset string) string {
+	if tag := Tag(); tag != "" {
+		return fmt.Sprintf("%s/download/%s/%s", ReleasesUrl, tag, asset)
+	}
+	return fmt.Sprintf("%s/latest/download/%s", ReleasesUrl, asset)
+}
@@ -13,16 +13,21 @@ import (
 
 type ListenServiceManager struct {
 	services []config.ServiceDescription
+	session  string
+	indices  []int // service number of each listener
 	listener []net.Listener
 	accepted chan lo.Tuple2[net.Conn, int]
 }
 
-func NewListenServiceManager(services []config.ServiceDescription) (*ListenServiceManager, error) {
+// NewListenServiceManager binds only the services of the given session, while service numbers still refer to the
+// position of the service in the whole list
+func NewListenServiceManager(services []config.ServiceDescription, session string) (*ListenServiceManager, error) {
 	cloned := make([]config.ServiceDescription, len(services))
 	copy(cloned, services)
 
 	instance := ListenServiceManager{
-		services: services,
+		services: cloned,
+		session:  session,
 		accepted: make(chan lo.Tuple2[net.Conn, int]),
 	}
 	err := instance.launch()
@@ -33,6 +38,14 @@ func NewListenServiceManager(services []config.ServiceDescription) (*ListenServi
 	return &instance, nil
 }
 
+func (lsm *ListenServiceManager) Session() string {
+	return lsm.session
+}
+
+func (lsm *ListenServiceManager) Service(idx int) config.ServiceDescription {
+	return lsm.services[idx]
+}
+
 func (lsm *ListenServiceManager) Accept() (net.Conn, int, error) {
 	for {
 		tuple, ok := <-lsm.accepted
@@ -51,7 +64,7 @@ func (lsm *ListenServiceManager) acceptLoop() {
 	}
 
 	group := sync.WaitGroup{}
-	group.Add(len(lsm.services))
+	group.Add(len(lsm.listener))
 	for i, listener := range lsm.listener {
 		go func(i int, listener net.Listener) {
 			defer group.Done()
@@ -65,7 +78,7 @@ func (lsm *ListenServiceManager) acceptLoop() {
 				}
 				lsm.accepted <- lo.Tuple2[net.Conn, int]{A: conn, B: i}
 			}
-		}(i, listener)
+		}(lsm.indices[i], listener)
 	}
 	go func() {
 		group.Wait()
@@ -80,13 +93,18 @@ func (lsm *ListenServiceManager) launch() (err error) {
 		}
 	}()
 
-	for _, service := range lsm.services {
+	for i, service := range lsm.services {
+		if service.Session != lsm.session {
+			continue
+		}
+
 		var listener net.Listener
 		listener, err = net.Listen(service.Bind.Network(), service.Bind.String())
 		if err != nil {
 			return tracerr.Wrap(err)
 		}
 		lsm.listener = append(lsm.listener, listener)
+		lsm.indices = append(lsm.indices, i)
 	}
 	return nil
 }
@@ -97,7 +115,8 @@ func (lsm *ListenServiceManager) Close() error {
 	for i, listener := range lsm.listener {
 		err := listener.Close()
 		if err != nil && !core.IsAlreadyClosed(err) {
-			logrus.Warnf("error closing listener#%d (%s://%s): %s", i, lsm.services[i].Bind.Network(), lsm.services[i].Bind.String(), err.Error())
+			service := lsm.services[lsm.indices[i]]
+			logrus.Warnf("error closing listener#%d (%s://%s): %s", lsm.indices[i], service.Bind.Network(), service.Bind.String(), err.Error())
 			errs = append(errs, err)
 		}
 	}
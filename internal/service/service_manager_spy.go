@@ -1,22 +1,32 @@
 package service
 
 import (
+	"errors"
+	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
 	"github.com/sirupsen/logrus"
 	"github.com/ztrue/tracerr"
 	"net"
 	"os"
+	"sync/atomic"
 )
 
+var ErrHopUnreachable = errors.New("hop is not reachable")
+
 type SpyServiceManager struct {
 	services []config.ServiceDescription
 	servers  []Server
 	addr     []net.Addr
+	session  string
+	hop      string
+	relay    atomic.Pointer[YamuxStreamManager]
 }
 
-func NewSpyServiceManager(services []config.ServiceDescription) (*SpyServiceManager, error) {
-	instance := SpyServiceManager{services: services}
+// NewSpyServiceManager launches the services of the given hop, services of other hops are relayed
+func NewSpyServiceManager(services []config.ServiceDescription, hop string) (*SpyServiceManager, error) {
+	instance := SpyServiceManager{services: services, hop: hop}
 	if err := instance.launch(); err != nil {
 		return nil, err
 	}
@@ -27,6 +37,64 @@ func (sm *SpyServiceManager) Addr(idx int) net.Addr {
 	return sm.addr[idx]
 }
 
+// AssignSession restricts the streams to the services of the given listen-mode session
+func (sm *SpyServiceManager) AssignSession(session string) {
+	sm.session = session
+}
+
+// SetRelay assigns the yamux stream manager of the next hop, or nil when it is disconnected
+func (sm *SpyServiceManager) SetRelay(relay *YamuxStreamManager) {
+	sm.relay.Store(relay)
+}
+
+// Route checks whether the stream is allowed, and returns the relay if it is served by a further hop
+func (sm *SpyServiceManager) Route(header mode.StreamHeader) (*YamuxStreamManager, error) {
+	idx := header.ServiceNumber
+	if idx < 0 || idx >= len(sm.services) {
+		return nil, fmt.Errorf("unknown service number %d", idx)
+	}
+	// services that do not name a hop are served by the spy-mode that listen-mode talks to
+	if header.Hop == "" || header.Hop == sm.hop {
+		return nil, nil
+	}
+
+	relay := sm.relay.Load()
+	if relay == nil {
+		return nil, fmt.Errorf("%w: \"%s\" from \"%s\"", ErrHopUnreachable, header.Hop, sm.hop)
+	}
+	return relay, nil
+}
+
+// Resolve finds the address that a stream described by the given header needs to be forwarded to
+func (sm *SpyServiceManager) Resolve(header mode.StreamHeader) (net.Addr, error) {
+	idx := header.ServiceNumber
+	if idx < 0 || idx >= len(sm.addr) {
+		return nil, fmt.Errorf("unknown service number %d", idx)
+	}
+	// services that do not name a session belong to a session only listen-mode knows about
+	if sm.session != "" && sm.services[idx].Session != "" && sm.services[idx].Session != sm.session {
+		return nil, fmt.Errorf("service#%d belongs to session \"%s\" not \"%s\"", idx, sm.services[idx].Session, sm.session)
+	}
+
+	serviceType := sm.services[idx].Type
+	if header.Destination == "" {
+		if serviceType == config.DynamicForward {
+			return nil, fmt.Errorf("service#%d (%s) needs a destination", idx, serviceType)
+		}
+		return sm.Addr(idx), nil
+	}
+
+	// only services that do not run an embedded server can be pointed to another destination
+	if serviceType != config.PortForward && serviceType != config.DynamicForward {
+		return nil, fmt.Errorf("service#%d (%s) does not accept a custom destination", idx, serviceType)
+	}
+	addr := config.Address{}
+	if err := addr.UnmarshalText([]byte(header.Destination)); err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %s", header.Destination, err.Error())
+	}
+	return &addr, nil
+}
+
 func (sm *SpyServiceManager) launch() (err error) {
 	defer func() {
 		if err != nil {
@@ -70,8 +138,14 @@ func (sm *SpyServiceManager) Close() error {
 
 func (sm *SpyServiceManager) justLaunch(idx int) (net.Addr, Server, error) {
 	service := sm.services[idx]
-	if service.Type == config.PortForward {
+	if service.Hop != "" && service.Hop != sm.hop {
+		// served by a further hop
+		return nil, nil, nil
+	} else if service.Type == config.PortForward {
 		return &service.Destination, nil, nil
+	} else if service.Type == config.DynamicForward {
+		// the destination is decided per stream
+		return nil, nil, nil
 	}
 
 	// launch internal server
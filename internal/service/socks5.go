@@ -0,0 +1,149 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/samber/lo"
+	"github.com/ztrue/tracerr"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// a minimal server side implementation of SOCKS5 (RFC 1928), only "no authentication" and CONNECT are supported
+
+const (
+	socks5Version          byte = 5
+	socks5NoAuth           byte = 0
+	socks5NoAcceptableAuth byte = 0xFF
+	socks5CmdConnect       byte = 1
+	socks5AddrIPv4         byte = 1
+	socks5AddrDomain       byte = 3
+	socks5AddrIPv6         byte = 4
+)
+
+const (
+	socks5Succeeded               byte = 0
+	socks5GeneralFailure          byte = 1
+	socks5NotAllowed              byte = 2
+	socks5NetworkUnreachable      byte = 3
+	socks5HostUnreachable         byte = 4
+	socks5ConnectionRefused       byte = 5
+	socks5TtlExpired              byte = 6
+	socks5CommandNotSupported     byte = 7
+	socks5AddressTypeNotSupported byte = 8
+)
+
+// socks5NegotiateWithDeadline is socks5Negotiate that gives up on a client which does not complete it in the
+// connection timeout, so that it does not keep the connection open forever
+func socks5NegotiateWithDeadline(conn net.Conn) (destination string, err error) {
+	if err := conn.SetReadDeadline(time.Now().Add(config.Config.Transfer.ConnectionTimeout)); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+	return socks5Negotiate(conn)
+}
+
+// socks5Negotiate reads the greeting and the CONNECT request of the client and returns the requested destination,
+// the client waits for socks5Reply to be called once the outcome of the connection is known.
+func socks5Negotiate(conn io.ReadWriter) (destination string, err error) {
+	// greeting: version, number of methods, methods
+	greeting := make([]byte, 2)
+	if _, err = io.ReadFull(conn, greeting); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	if greeting[0] != socks5Version {
+		return "", tracerr.Errorf("unsupported socks version: %d", greeting[0])
+	}
+	methods := make([]byte, greeting[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	if !lo.Contains(methods, socks5NoAuth) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptableAuth})
+		return "", tracerr.New("socks client does not support unauthenticated access")
+	}
+	if _, err = conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+
+	// request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err = io.ReadFull(conn, request); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+	if request[1] != socks5CmdConnect {
+		_ = writeSocks5Reply(conn, socks5CommandNotSupported)
+		return "", tracerr.Errorf("unsupported socks command: %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if request[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return "", tracerr.Wrap(err)
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return "", tracerr.Wrap(err)
+		}
+		domain := make([]byte, length[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return "", tracerr.Wrap(err)
+		}
+		host = string(domain)
+	default:
+		_ = writeSocks5Reply(conn, socks5AddressTypeNotSupported)
+		return "", tracerr.Errorf("unsupported socks address type: %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(conn, port); err != nil {
+		return "", tracerr.Wrap(err)
+	}
+
+	hostPort := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return fmt.Sprintf("tcp://%s", hostPort), nil
+}
+
+// socks5Reply lets the client know the outcome of its CONNECT request
+func socks5Reply(conn io.Writer, reply mode.StreamReply) error {
+	return writeSocks5Reply(conn, socks5ReplyCode(reply.Error))
+}
+
+func writeSocks5Reply(conn io.Writer, code byte) error {
+	// the bound address is irrelevant for a tunnelled connection, so it is always 0.0.0.0:0
+	_, err := conn.Write([]byte{socks5Version, code, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return tracerr.Wrap(err)
+}
+
+func socks5ReplyCode(code mode.StreamErrorCode) byte {
+	switch code {
+	case "":
+		return socks5Succeeded
+	case mode.StreamNotAllowed:
+		return socks5NotAllowed
+	case mode.StreamNetworkUnreachable:
+		return socks5NetworkUnreachable
+	case mode.StreamHostUnreachable:
+		return socks5HostUnreachable
+	case mode.StreamConnectionRefused:
+		return socks5ConnectionRefused
+	case mode.StreamTimeout:
+		return socks5TtlExpired
+	default:
+		return socks5GeneralFailure
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bytes"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSocks5Negotiate(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		_, _ = client.Write([]byte{5, 1, 0})
+		_, _ = io.ReadFull(client, make([]byte, 2))
+		_, _ = client.Write(append([]byte{5, 1, 0, 3, 11}, []byte("example.com")...))
+		_, _ = client.Write([]byte{0, 80})
+	}()
+
+	destination, err := socks5Negotiate(server)
+	require.NoError(t, err)
+	require.Equal(t, "tcp://example.com:80", destination)
+}
+
+func TestSocks5NegotiateTimeout(t *testing.T) {
+	original := config.Config.Transfer.ConnectionTimeout
+	config.Config.Transfer.ConnectionTimeout = 50 * time.Millisecond
+	t.Cleanup(func() {
+		config.Config.Transfer.ConnectionTimeout = original
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// the client connects and sends nothing
+	_, err := socks5NegotiateWithDeadline(server)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestSocks5NegotiateUnsupportedCommand(t *testing.T) {
+	// BIND command
+	written := &bytes.Buffer{}
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}), written}
+
+	_, err := socks5Negotiate(conn)
+	require.Error(t, err)
+	require.Equal(t, []byte{5, 0, 5, socks5CommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}, written.Bytes())
+}
+
+func TestSocks5Reply(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, socks5Reply(buf, mode.StreamReply{Error: mode.StreamConnectionRefused}))
+	require.Equal(t, socks5ConnectionRefused, buf.Bytes()[1])
+}
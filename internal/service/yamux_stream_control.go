@@ -2,6 +2,8 @@ package service
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/mode"
@@ -10,25 +12,41 @@ import (
 	stdio "io"
 	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var messageId mode.MessageId = 0
+var ErrControlStreamClosed = errors.New("yamux control stream is closed")
+var ErrRequestCancelled = errors.New("request is cancelled by the remote side")
+
+type rpcHandler = func(ctx context.Context, args any) (any, error)
 
 type YamuxControlStream struct {
 	stream       stdio.ReadWriteCloser
-	responseCh   map[mode.MessageId]chan any           // each Send() will put a channel here to wait for the response
-	handlers     map[string]func(*mode.ControlMessage) // received messages will be processed to these handlers by their type name
+	writeLock    sync.Mutex                                   // serializes writes, so that messages do not interleave on the wire
+	lock         sync.Mutex                                   // guards all the maps below
+	pending      map[mode.MessageId]chan *mode.ControlMessage // each Invoke() waits on a channel here for the response
+	handlers     map[string]rpcHandler                        // received requests will be processed by their type name
+	backlog      map[string][]*mode.ControlMessage            // received requests that have no handler registered yet
+	inflight     map[mode.MessageId]context.CancelFunc        // received requests that are being processed
+	lastId       atomic.Uint32
+	ctx          context.Context // cancelled when the control stream stops receiving
+	cancel       context.CancelFunc
 	RemoteClosed chan any
-	isClosed     bool
+	isClosed     atomic.Bool
 }
 
 func NewControlStream(stream stdio.ReadWriteCloser) *YamuxControlStream {
+	ctx, cancel := context.WithCancel(context.Background())
 	obj := YamuxControlStream{
 		stream:       stream,
-		responseCh:   make(map[mode.MessageId]chan any),
-		handlers:     make(map[string]func(*mode.ControlMessage)),
+		pending:      make(map[mode.MessageId]chan *mode.ControlMessage),
+		handlers:     make(map[string]rpcHandler),
+		backlog:      make(map[string][]*mode.ControlMessage),
+		inflight:     make(map[mode.MessageId]context.CancelFunc),
+		ctx:          ctx,
+		cancel:       cancel,
 		RemoteClosed: make(chan any),
 	}
 	obj.startReceive()
@@ -38,15 +56,16 @@ func NewControlStream(stream stdio.ReadWriteCloser) *YamuxControlStream {
 func (ycs *YamuxControlStream) startReceive() {
 	reader := bufio.NewReader(ycs.stream)
 	go func() {
+		defer ycs.cancel()
 		for {
 			err := ycs.receiveOne(reader)
 			if err != nil {
 				if err == stdio.EOF {
-					if !ycs.isClosed {
+					if !ycs.isClosed.Load() {
 						logrus.Info("yamux control stream closed from the remote side.")
 						close(ycs.RemoteClosed)
 					}
-				} else {
+				} else if !ycs.isClosed.Load() {
 					logrus.Warnf("failed to receive command from the control stream: %s", err.Error())
 				}
 				return
@@ -67,7 +86,9 @@ func (ycs *YamuxControlStream) receiveOne(lineReader *bufio.Reader) error {
 
 	msg, err := mode.Unmarshal([]byte(trimmedLine))
 	if err != nil {
-		return err
+		// a single malformed message should not bring the whole control stream down
+		logrus.Warnf("failed to parse the received command %s: %s", trimmedLine, err.Error())
+		return nil
 	}
 
 	logrus.Debugf("received a command: %#v", msg)
@@ -78,89 +99,210 @@ func (ycs *YamuxControlStream) receiveOne(lineReader *bufio.Reader) error {
 
 func (ycs *YamuxControlStream) process(msg *mode.ControlMessage) {
 	if msg.IsResponse() {
-		waiter := ycs.responseCh[msg.RequestId]
-
-		if waiter != nil {
-			waiter <- msg.Args
-			logrus.Infof("processed the response command: %#v", msg)
-		} else {
-			ycs.queueForRetry(msg)
-		}
+		ycs.processResponse(msg)
+	} else if cancelReq, ok := msg.Args.(*mode.CancelRequest); ok {
+		ycs.processCancel(cancelReq.RequestId)
 	} else {
-		handler := ycs.handlers[msg.Command]
+		ycs.processRequest(msg)
+	}
+}
 
-		if handler != nil {
-			go handler(msg)
-			logrus.Infof("processed the received command: %#v", msg)
-		} else {
-			ycs.queueForRetry(msg)
-		}
+func (ycs *YamuxControlStream) processResponse(msg *mode.ControlMessage) {
+	ycs.lock.Lock()
+	waiter := ycs.pending[msg.RequestId]
+	delete(ycs.pending, msg.RequestId)
+	ycs.lock.Unlock()
+
+	if waiter == nil {
+		// the request has already timed out or got cancelled
+		logrus.Debugf("dropped the response nobody is waiting for: %#v", msg)
+		return
 	}
+	waiter <- msg
 }
 
-func (ycs *YamuxControlStream) queueForRetry(msg *mode.ControlMessage) {
-	if msg.ProcessDelay.Seconds() > config.Config.Transfer.RequestTimeout.Seconds() {
-		if msg.IsResponse() {
-			logrus.Warnf("received a response message with no handler: %#v", msg)
-		} else {
-			logrus.Warnf("could not process the request with message: %#v", msg)
+func (ycs *YamuxControlStream) processCancel(requestId mode.MessageId) {
+	ycs.lock.Lock()
+	defer ycs.lock.Unlock()
+
+	if cancel, ok := ycs.inflight[requestId]; ok {
+		logrus.Debugf("request %d is cancelled by the remote side.", requestId)
+		cancel()
+		return
+	}
+
+	for command, queued := range ycs.backlog {
+		for i, msg := range queued {
+			if msg.Id == requestId {
+				logrus.Debugf("queued request %d is cancelled by the remote side.", requestId)
+				ycs.backlog[command] = append(queued[:i:i], queued[i+1:]...)
+				return
+			}
 		}
-	} else {
-		go func() {
-			msg.ProcessDelay += 1 * time.Second
+	}
+}
 
-			// retry in a second
-			time.Sleep(msg.ProcessDelay)
-			ycs.process(msg)
-		}()
+func (ycs *YamuxControlStream) processRequest(msg *mode.ControlMessage) {
+	ycs.lock.Lock()
+	defer ycs.lock.Unlock()
+
+	handler, ok := ycs.handlers[msg.Command]
+	if !ok {
+		// the handler may get registered shortly, give up on the request if it does not in time
+		ycs.backlog[msg.Command] = append(ycs.backlog[msg.Command], msg)
+		time.AfterFunc(config.Config.Transfer.RequestTimeout, func() {
+			ycs.expireBacklog(msg)
+		})
+		return
 	}
+
+	ycs.dispatch(handler, msg)
+}
+
+// dispatch runs the handler in the background and responds with its result, must be called while holding the lock
+func (ycs *YamuxControlStream) dispatch(handler rpcHandler, msg *mode.ControlMessage) {
+	ctx, cancel := context.WithCancel(ycs.ctx)
+	ycs.inflight[msg.Id] = cancel
+
+	go func() {
+		defer func() {
+			ycs.lock.Lock()
+			delete(ycs.inflight, msg.Id)
+			ycs.lock.Unlock()
+			cancel()
+		}()
+
+		res, err := handler(ctx, msg.Args)
+		if ctx.Err() != nil {
+			logrus.Debugf("discarded the response of cancelled request: %#v", msg)
+			return
+		}
+		if err != nil {
+			res = toErrorResponse(err)
+		}
+
+		if err := ycs.respond(msg.Id, res); err != nil {
+			logrus.Errorf("failed to respond to %#v with %#v on the wire: %s", msg, res, err.Error())
+		} else {
+			logrus.Debugf("processed the received command: %#v", msg)
+		}
+	}()
 }
 
-func (ycs *YamuxControlStream) send(content any, responseType any, responseTo mode.MessageId) (any, error) {
-	id := atomic.AddUint32(&messageId, 1)
-	msg := mode.ControlMessage{
-		Id:        id,
-		RequestId: responseTo,
-		Args:      content,
+func (ycs *YamuxControlStream) expireBacklog(msg *mode.ControlMessage) {
+	ycs.lock.Lock()
+	queued := ycs.backlog[msg.Command]
+	idx := -1
+	for i := range queued {
+		if queued[i] == msg {
+			idx = i
+			break
+		}
 	}
-	cmdJson, err := mode.Marshal(&msg)
-	if err != nil {
-		return nil, tracerr.Wrap(err)
+	if idx != -1 {
+		ycs.backlog[msg.Command] = append(queued[:idx:idx], queued[idx+1:]...)
 	}
+	ycs.lock.Unlock()
 
-	_, err = ycs.stream.Write(cmdJson)
-	if err != nil {
-		return nil, tracerr.Wrap(err)
+	if idx == -1 {
+		return
 	}
 
-	_, err = ycs.stream.Write([]byte("\n"))
-	if err != nil {
-		return nil, tracerr.Wrap(err)
+	logrus.Warnf("could not process the request with message: %#v", msg)
+	res := mode.ErrorResponse{Code: mode.ErrorUnhandled, Message: fmt.Sprintf("no handler for %s", msg.Command)}
+	if err := ycs.respond(msg.Id, res); err != nil {
+		logrus.Warnf("failed to respond to unhandled request %#v: %s", msg, err.Error())
 	}
-	logrus.Debugf("sent a command: %#v", msg)
+}
 
-	if msg.IsResponse() {
-		return nil, nil
+func (ycs *YamuxControlStream) register(command string, handler rpcHandler) {
+	ycs.lock.Lock()
+	defer ycs.lock.Unlock()
+
+	ycs.handlers[command] = handler
+
+	// serve the requests that arrived earlier than the handler
+	queued := ycs.backlog[command]
+	delete(ycs.backlog, command)
+	for _, msg := range queued {
+		ycs.dispatch(handler, msg)
 	}
+}
+
+func (ycs *YamuxControlStream) unregister(command string) {
+	ycs.lock.Lock()
+	defer ycs.lock.Unlock()
+
+	if _, ok := ycs.handlers[command]; ok {
+		delete(ycs.handlers, command)
+	} else {
+		logrus.Warnf("there was no handler for %s to unregister.", command)
+	}
+}
 
-	ycs.responseCh[id] = make(chan any, 1)
+// Invoke sends the request and waits for its response until ctx is done, in which case the remote side is asked to
+// cancel processing the request. A failed request results in an error of type *mode.ErrorResponse.
+func (ycs *YamuxControlStream) Invoke(ctx context.Context, req any) (any, error) {
+	id := ycs.lastId.Add(1)
+	waiter := make(chan *mode.ControlMessage, 1)
+
+	ycs.lock.Lock()
+	ycs.pending[id] = waiter
+	ycs.lock.Unlock()
+	defer func() {
+		ycs.lock.Lock()
+		delete(ycs.pending, id)
+		ycs.lock.Unlock()
+	}()
+
+	if err := ycs.write(&mode.ControlMessage{Id: id, Args: req}); err != nil {
+		return nil, err
+	}
 
 	select {
-	case response := <-ycs.responseCh[id]:
-		if mode.TypeNameOf(&responseType) != mode.TypeNameOf(response) {
-			return nil, fmt.Errorf("expected %s in response but received: %s", mode.TypeNameOf(responseType), mode.TypeNameOf(response))
+	case res := <-waiter:
+		if errRes, ok := res.Args.(*mode.ErrorResponse); ok {
+			return nil, errRes
 		}
-		return response, nil
-	case <-time.After(config.Config.Transfer.RequestTimeout):
-		return nil, tracerr.Errorf("did not receive a response for: %v", content)
+		return res.Args, nil
+	case <-ycs.ctx.Done():
+		return nil, ErrControlStreamClosed
+	case <-ctx.Done():
+		cancelReq := mode.CancelRequest{RequestId: id}
+		if err := ycs.write(&mode.ControlMessage{Id: ycs.lastId.Add(1), Args: cancelReq}); err != nil {
+			logrus.Debugf("failed to cancel request %d on the remote side: %s", id, err.Error())
+		}
+		return nil, tracerr.Errorf("did not receive a response for %#v: %w", req, context.Cause(ctx))
+	}
+}
+
+func (ycs *YamuxControlStream) respond(requestId mode.MessageId, res any) error {
+	return ycs.write(&mode.ControlMessage{Id: ycs.lastId.Add(1), RequestId: requestId, Args: res})
+}
+
+func (ycs *YamuxControlStream) write(msg *mode.ControlMessage) error {
+	cmdJson, err := mode.Marshal(msg)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+
+	ycs.writeLock.Lock()
+	defer ycs.writeLock.Unlock()
+
+	_, err = ycs.stream.Write(append(cmdJson, '\n'))
+	if err != nil {
+		return tracerr.Wrap(err)
 	}
+	logrus.Debugf("sent a command: %#v", msg)
+
+	return nil
 }
 
 func (ycs *YamuxControlStream) Close() error {
-	if ycs.isClosed {
+	if ycs.isClosed.Swap(true) {
 		return nil
 	}
-	ycs.isClosed = true
+	ycs.cancel()
 
 	err := ycs.stream.Close()
 	if err != nil {
@@ -170,52 +312,71 @@ func (ycs *YamuxControlStream) Close() error {
 	return nil
 }
 
-func RpcCreateInvoker[_ mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream) func(Request) (Response, error) {
-	return func(req Request) (res Response, err error) {
-		obj, err := ycs.send(req, nil, 0)
-		if obj != nil && err == nil {
-			resPtr := obj.(*Response)
-			res = *resPtr
-		}
+func toErrorResponse(err error) mode.ErrorResponse {
+	var errRes *mode.ErrorResponse
+	if errors.As(err, &errRes) {
+		return *errRes
+	}
+	return mode.ErrorResponse{Code: mode.ErrorInternal, Message: err.Error()}
+}
+
+// ----------------------------------------------------------------------------------------
 
+func RpcInvoke[_ mode.Exchange[Request, Response], Request any, Response any](ctx context.Context, ycs *YamuxControlStream, req Request) (res Response, err error) {
+	obj, err := ycs.Invoke(ctx, req)
+	if err != nil {
 		return res, err
 	}
+
+	resPtr, ok := obj.(*Response)
+	if !ok {
+		return res, tracerr.Errorf("expected %s in response but received: %T", reflect.TypeFor[Response]().Name(), obj)
+	}
+	return *resPtr, nil
 }
 
-func RpcRegisterResponder[_ mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream, f func(Request) Response) {
-	typeName := reflect.TypeFor[Request]().Name()
-	ycs.handlers[typeName] = func(msg *mode.ControlMessage) {
-		req := msg.Args.(*Request)
-		res := f(*req)
-		if _, err := ycs.send(res, nil, msg.Id); err != nil {
-			logrus.Errorf("failed to respond to %#v with %#v on the wire: %s", req, res, err.Error())
-		}
+func RpcCreateInvoker[E mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream) func(context.Context, Request) (Response, error) {
+	return func(ctx context.Context, req Request) (Response, error) {
+		return RpcInvoke[E](ctx, ycs, req)
 	}
 }
 
-func RpcUnregisterResponder[_ mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream) {
+func RpcRegisterResponder[_ mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream, f func(context.Context, Request) (Response, error)) {
 	typeName := reflect.TypeFor[Request]().Name()
-	if ycs.handlers[typeName] != nil {
-		ycs.handlers[typeName] = nil
-	} else {
-		logrus.Warnf("there was no handler for %s to unregister.", typeName)
-	}
+	ycs.register(typeName, func(ctx context.Context, args any) (any, error) {
+		return f(ctx, *args.(*Request))
+	})
 }
 
-func RpcExpectAndRespond[E mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream, f func(Request) (Response, error)) error {
-	done := make(chan any)
+func RpcUnregisterResponder[_ mode.Exchange[Request, Response], Request any, Response any](ycs *YamuxControlStream) {
+	ycs.unregister(reflect.TypeFor[Request]().Name())
+}
+
+// RpcExpectAndRespond waits for exactly one request of the exchange (up to the request timeout) and responds to it,
+// a request that the other side cancels before it is responded to is an error
+func RpcExpectAndRespond[E mode.Exchange[Request, Response], Request any, Response any](ctx context.Context, ycs *YamuxControlStream, f func(context.Context, Request) (Response, error)) error {
+	done := make(chan error, 1)
 	defer RpcUnregisterResponder[E](ycs)
 
-	var err error
-	RpcRegisterResponder(ycs, func(req Request) (res Response) {
-		defer close(done)
-		res, err = f(req)
-		return res
+	var once sync.Once
+	RpcRegisterResponder[E](ycs, func(reqCtx context.Context, req Request) (res Response, err error) {
+		res, err = f(reqCtx, req)
+		if err == nil && reqCtx.Err() != nil {
+			// dispatch discards the response, so the other side never learns that it succeeded
+			err = tracerr.Errorf("%s was not responded to: %w", reflect.TypeFor[Request]().Name(), ErrRequestCancelled)
+		}
+		once.Do(func() { done <- err })
+		// the error is reported to the caller, the response should still reach the other side as is
+		return res, nil
 	})
 
 	select {
-	case <-done:
+	case err := <-done:
 		return err
+	case <-ycs.ctx.Done():
+		return ErrControlStreamClosed
+	case <-ctx.Done():
+		return tracerr.Wrap(context.Cause(ctx))
 	case <-time.After(config.Config.Transfer.RequestTimeout):
 		typeName := reflect.TypeFor[Request]().Name()
 		waitTime := config.Config.Transfer.RequestTimeout.String()
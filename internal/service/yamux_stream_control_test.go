@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/mode"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newControlStreamPair creates two control streams connected to each other over an in-memory yamux session
+func newControlStreamPair(t *testing.T) (client *YamuxControlStream, server *YamuxControlStream) {
+	logrus.SetLevel(logrus.WarnLevel)
+	clientConn, serverConn := net.Pipe()
+
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	clientSession, err := yamux.Client(clientConn, cfg)
+	require.NoError(t, err)
+	serverSession, err := yamux.Server(serverConn, cfg)
+	require.NoError(t, err)
+
+	clientStream, err := clientSession.OpenStream()
+	require.NoError(t, err)
+	// yamux does not let the other side know about a stream until something is written on it
+	_, err = clientStream.Write([]byte("\n"))
+	require.NoError(t, err)
+	serverStream, err := serverSession.AcceptStream()
+	require.NoError(t, err)
+
+	client = NewControlStream(clientStream)
+	server = NewControlStream(serverStream)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+		_ = clientSession.Close()
+		_ = serverSession.Close()
+	})
+	return client, server
+}
+
+func TestControlStreamConcurrentInvokes(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	RpcRegisterResponder[mode.HelloExchange](server, func(_ context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+		return mode.HelloResponse{Error: fmt.Sprint(req.ProtocolVersion)}, nil
+	})
+
+	group := errgroup.Group{}
+	for i := 0; i < 5000; i++ {
+		i := i
+		group.Go(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			res, err := RpcInvoke[mode.HelloExchange](ctx, client, mode.HelloRequest{ProtocolVersion: i})
+			if err != nil {
+				return err
+			}
+			if res.Error != fmt.Sprint(i) {
+				return fmt.Errorf("request %d received the response of %s", i, res.Error)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, group.Wait())
+
+	// nothing should be left behind
+	require.Empty(t, client.pending)
+	require.Eventually(t, func() bool {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		return len(server.inflight) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestControlStreamRequestBeforeHandler(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		RpcRegisterResponder[mode.HelloExchange](server, func(_ context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+			return mode.HelloResponse{}, nil
+		})
+	}()
+
+	_, err := RpcInvoke[mode.HelloExchange](context.Background(), client, mode.HelloRequest{})
+	require.NoError(t, err)
+}
+
+func TestControlStreamErrorResponse(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	RpcRegisterResponder[mode.HelloExchange](server, func(_ context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+		return mode.HelloResponse{}, fmt.Errorf("boom")
+	})
+
+	_, err := RpcInvoke[mode.HelloExchange](context.Background(), client, mode.HelloRequest{})
+	var errRes *mode.ErrorResponse
+	require.ErrorAs(t, err, &errRes)
+	require.Equal(t, mode.ErrorResponse{Code: mode.ErrorInternal, Message: "boom"}, *errRes)
+}
+
+func TestControlStreamUnhandledRequest(t *testing.T) {
+	original := config.Config.Transfer.RequestTimeout
+	config.Config.Transfer.RequestTimeout = 100 * time.Millisecond
+	t.Cleanup(func() {
+		config.Config.Transfer.RequestTimeout = original
+	})
+	client, _ := newControlStreamPair(t)
+
+	_, err := RpcInvoke[mode.HelloExchange](context.Background(), client, mode.HelloRequest{})
+	var errRes *mode.ErrorResponse
+	require.ErrorAs(t, err, &errRes)
+	require.Equal(t, mode.ErrorUnhandled, errRes.Code)
+}
+
+func TestControlStreamCancellation(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	started := make(chan any)
+	cancelled := make(chan any)
+	RpcRegisterResponder[mode.HelloExchange](server, func(ctx context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return mode.HelloResponse{}, ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := RpcInvoke[mode.HelloExchange](ctx, client, mode.HelloRequest{})
+	require.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		require.FailNow(t, "the remote handler was not cancelled")
+	}
+}
+
+func TestControlStreamClosed(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	RpcRegisterResponder[mode.HelloExchange](server, func(ctx context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+		<-ctx.Done()
+		return mode.HelloResponse{}, nil
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = client.Close()
+	}()
+
+	_, err := RpcInvoke[mode.HelloExchange](context.Background(), client, mode.HelloRequest{})
+	require.ErrorIs(t, err, ErrControlStreamClosed)
+}
+
+func TestControlStreamExpectAndRespondCancelled(t *testing.T) {
+	client, server := newControlStreamPair(t)
+
+	// the hello of listen-mode gives up while spy-mode is still responding to it
+	started := make(chan any)
+	responded := make(chan error, 1)
+	go func() {
+		responded <- RpcExpectAndRespond[mode.HelloExchange](context.Background(), server, func(ctx context.Context, req mode.HelloRequest) (mode.HelloResponse, error) {
+			close(started)
+			<-ctx.Done()
+			return mode.HelloResponse{}, nil
+		})
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := RpcInvoke[mode.HelloExchange](ctx, client, mode.HelloRequest{})
+	require.ErrorIs(t, err, context.Canceled)
+
+	select {
+	case err := <-responded:
+		require.ErrorIs(t, err, ErrRequestCancelled)
+	case <-time.After(time.Second):
+		require.FailNow(t, "the responder did not return")
+	}
+}
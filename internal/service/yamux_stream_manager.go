@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hashicorp/yamux"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
 	"github.com/nimatrueway/unbound-ssh/internal/mode"
 	"github.com/sirupsen/logrus"
 	"github.com/ztrue/tracerr"
 	stdio "io"
 	"net"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type YamuxStreamManager struct {
@@ -18,6 +22,7 @@ type YamuxStreamManager struct {
 	Session       *yamux.Session
 	ControlStream *YamuxControlStream
 	connections   []YamuxForwarder
+	lock          sync.Mutex
 	stdio.Closer
 }
 
@@ -49,6 +54,9 @@ func (ym *YamuxStreamManager) ReceiveAndOpenYamux(ctx context.Context, serviceMa
 				return false
 			case <-ym.ControlStream.RemoteClosed:
 				return true
+			case <-ym.Session.CloseChan():
+				// e.g. keep-alive failure, there is no point in writing anything on the wire anymore
+				return true
 			}
 		}()
 
@@ -80,30 +88,76 @@ func (ym *YamuxStreamManager) ReceiveAndOpenYamux(ctx context.Context, serviceMa
 		}
 		logrus.Info("opened a connection from client local-addr: ", conn.LocalAddr())
 
-		stream, err := ym.Session.OpenStream()
-		if err != nil {
-			if errors.Is(ctx.Err(), context.Canceled) {
-				return nil
-			} else {
-				return tracerr.Wrap(err)
-			}
-		}
-		logrus.Info("opened a yamux stream: ", stream.StreamID())
-
-		forwarder := NewYamuxForwarder(conn, stream)
-		ym.connections = append(ym.connections, forwarder)
+		// connections are served independently, so that a slow or failing one does not affect the others
+		go ym.openStream(ctx, conn, serviceNumber, serviceMan.Service(serviceNumber))
+	}
+}
 
-		forwarder.start(ctx)
+// openStream forwards the client connection through a new yamux stream, any failure only closes this very connection
+func (ym *YamuxStreamManager) openStream(ctx context.Context, conn net.Conn, serviceNumber int, service config.ServiceDescription) {
+	header := mode.StreamHeader{ServiceNumber: serviceNumber, Hop: service.Hop}
 
-		registerStream := RpcCreateInvoker[mode.RegisterStreamExchange](ym.ControlStream)
-		res, err := registerStream(mode.RegisterStreamRequest{StreamId: stream.StreamID(), ServiceNumber: serviceNumber})
+	// dynamic proxies learn the destination from the client itself
+	if service.Type == config.DynamicForward {
+		destination, err := socks5NegotiateWithDeadline(conn)
 		if err != nil {
-			return err
+			logrus.Warnf("socks negotiation with client %s failed: %s", conn.RemoteAddr(), err.Error())
+			_ = conn.Close()
+			return
 		}
-		if res.Error != "" {
-			return tracerr.Errorf("failed to register connection map: %s", res.Error)
+		header.Destination = destination
+	}
+
+	stream, err := ym.Session.OpenStream()
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.Warnf("failed to open a yamux stream for client %s: %s", conn.RemoteAddr(), err.Error())
+		}
+		_ = conn.Close()
+		return
+	}
+	logrus.Info("opened a yamux stream: ", stream.StreamID())
+
+	reply, err := exchangeHeader(stream, header)
+	if err != nil {
+		reply = mode.StreamReply{Error: mode.StreamGeneralFailure, Message: err.Error()}
+	}
+	if service.Type == config.DynamicForward {
+		if err := socks5Reply(conn, reply); err != nil {
+			logrus.Warnf("failed to send socks reply to client %s: %s", conn.RemoteAddr(), err.Error())
+			reply = mode.StreamReply{Error: mode.StreamGeneralFailure, Message: err.Error()}
 		}
 	}
+	if !reply.IsSuccess() {
+		logrus.Warnf("closing the connection of client %s, spy-mode could not serve yamux stream [%d]: %s (%s)", conn.RemoteAddr(), stream.StreamID(), reply.Message, reply.Error)
+		_ = stream.Close()
+		_ = conn.Close()
+		return
+	}
+
+	forwarder := NewYamuxForwarder(conn, stream)
+	ym.addConnection(forwarder)
+
+	forwarder.start(ctx)
+}
+
+// exchangeHeader lets spy-mode know how to serve the stream before any other byte goes through it, and waits for the
+// outcome
+func exchangeHeader(stream *yamux.Stream, header mode.StreamHeader) (mode.StreamReply, error) {
+	if err := mode.WriteStreamHeader(stream, header); err != nil {
+		return mode.StreamReply{}, err
+	}
+
+	// spy-mode may need to dial the destination before it replies
+	timeout := config.Config.Transfer.ConnectionTimeout + config.Config.Transfer.RequestTimeout
+	if err := stream.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return mode.StreamReply{}, tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = stream.SetReadDeadline(time.Time{})
+	}()
+
+	return mode.ReadStreamReply(stream)
 }
 
 // AcceptYamuxAndForward Used by spy-mode, to forward the yamux Session to the received address
@@ -152,47 +206,215 @@ func (ym *YamuxStreamManager) AcceptYamuxAndForward(ctx context.Context, service
 		}
 		logrus.Debug("accepted a yamux stream: ", yamuxStream.StreamID())
 
-		serviceNumber, err := ym.receiveServiceNumberOf(yamuxStream.StreamID())
-		if err != nil {
-			return err
-		} else if serviceNumber == -1 {
-			return tracerr.New("service number is not received")
-		}
+		// streams are self-describing, so they can be served in parallel
+		go ym.serveStream(ctx, yamuxStream, serviceMan)
+	}
+}
 
-		addr := serviceMan.Addr(serviceNumber)
-		conn, err := net.Dial(addr.Network(), addr.String())
-		if err != nil {
-			return tracerr.Wrap(err)
+// serveStream reads the header of the stream and forwards its traffic to the service it asks for, a failure here only
+// affects this very stream and not the whole session
+func (ym *YamuxStreamManager) serveStream(ctx context.Context, yamuxStream *yamux.Stream, serviceMan *SpyServiceManager) {
+	header, err := receiveHeaderOf(yamuxStream)
+	if err != nil {
+		logrus.Warnf("failed to receive the header of yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		_ = yamuxStream.Close()
+		return
+	}
+
+	relay, err := serviceMan.Route(header)
+	if err != nil {
+		logrus.Warnf("failed to route yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		code := mode.StreamNotAllowed
+		if errors.Is(err, ErrHopUnreachable) {
+			code = mode.StreamNetworkUnreachable
 		}
-		logrus.Debug("forwarding yamux connection traffic to: ", addr)
+		rejectStream(yamuxStream, mode.StreamReply{Error: code, Message: err.Error()})
+		return
+	} else if relay != nil {
+		relay.RelayStream(ctx, yamuxStream, header)
+		return
+	}
+
+	addr, err := serviceMan.Resolve(header)
+	if err != nil {
+		logrus.Warnf("failed to resolve the service of yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		rejectStream(yamuxStream, mode.StreamReply{Error: mode.StreamNotAllowed, Message: err.Error()})
+		return
+	}
 
-		forwarder := NewYamuxForwarder(conn, yamuxStream)
-		ym.connections = append(ym.connections, forwarder)
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), config.Config.Transfer.ConnectionTimeout)
+	if err != nil {
+		logrus.Warnf("failed to dial %s://%s for yamux stream [%d]: %s", addr.Network(), addr.String(), yamuxStream.StreamID(), err.Error())
+		rejectStream(yamuxStream, mode.StreamReply{Error: classifyDialError(err), Message: err.Error()})
+		return
+	}
+	logrus.Debug("forwarding yamux connection traffic to: ", addr)
 
-		forwarder.start(ctx)
+	if err := mode.WriteStreamReply(yamuxStream, mode.StreamReply{}); err != nil {
+		logrus.Warnf("failed to reply to yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		_ = conn.Close()
+		_ = yamuxStream.Close()
+		return
 	}
+
+	forwarder := NewYamuxForwarder(conn, yamuxStream)
+	ym.addConnection(forwarder)
+
+	forwarder.start(ctx)
 }
 
-func (ym *YamuxStreamManager) receiveServiceNumberOf(streamId uint32) (int, error) {
-	var internalErr error
-	serviceNumber := -1
+// ServeRelay Used by a relaying spy-mode, to keep the yamux session of the next hop until either side closes it,
+// meanwhile streams are passed to it through RelayStream
+func (ym *YamuxStreamManager) ServeRelay(ctx context.Context) error {
+	if ym.ControlStream == nil {
+		return tracerr.New("control stream is not opened")
+	}
 
-	err := RpcExpectAndRespond(ym.ControlStream, func(streamService mode.RegisterStreamRequest) (mode.RegisterStreamResponse, error) {
-		if streamService.StreamId != streamId {
-			internalErr = fmt.Errorf("stream id mismatch: %d (control) != %d (yamux)", streamService.StreamId, streamId)
-			return mode.RegisterStreamResponse{Error: internalErr.Error()}, nil
+	isRemoteInitiated := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ym.ControlStream.RemoteClosed:
+			return true
+		case <-ym.Session.CloseChan():
+			return true
 		}
+	}()
+
+	if !isRemoteInitiated {
+		logrus.Info("initiating yamux stream manager shutdown of the relay.")
+	} else {
+		logrus.Info("continuing yamux stream manager shutdown initiated by the next hop.")
+	}
+	return ym.Close(isRemoteInitiated)
+}
 
-		serviceNumber = streamService.ServiceNumber
-		return mode.RegisterStreamResponse{}, nil
-	})
+// RelayStream passes a stream that is served by a further hop to the next spy-mode, the header is written again on a
+// new stream and the rest, including the reply, goes through untouched
+func (ym *YamuxStreamManager) RelayStream(ctx context.Context, yamuxStream *yamux.Stream, header mode.StreamHeader) {
+	next, err := ym.Session.OpenStream()
 	if err != nil {
-		return -1, err
+		logrus.Warnf("failed to open a yamux stream to relay yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		rejectStream(yamuxStream, mode.StreamReply{Error: mode.StreamNetworkUnreachable, Message: err.Error()})
+		return
 	}
-	if internalErr != nil {
-		return -1, err
+	if err := mode.WriteStreamHeader(next, header); err != nil {
+		logrus.Warnf("failed to relay the header of yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+		rejectStream(yamuxStream, mode.StreamReply{Error: mode.StreamNetworkUnreachable, Message: err.Error()})
+		_ = next.Close()
+		return
 	}
-	return serviceNumber, nil
+	logrus.Debugf("relaying yamux stream [%d] to hop \"%s\" through yamux stream [%d]", yamuxStream.StreamID(), header.Hop, next.StreamID())
+
+	forwarder := NewYamuxForwarder(yamuxStream, next)
+	ym.addConnection(forwarder)
+
+	forwarder.start(ctx)
+}
+
+// OpenFileStream Used by spy-mode, to pass the get/put request of a client on the same server on to listen-mode, the
+// rest of the connection is spliced with the stream
+func (ym *YamuxStreamManager) OpenFileStream(ctx context.Context, conn net.Conn) {
+	request, err := mode.ReadFileRequest(conn)
+	if err != nil {
+		logrus.Warnf("failed to read the get/put request of a client: %s", err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	stream, err := ym.Session.OpenStream()
+	if err == nil {
+		err = mode.WriteStreamHeader(stream, mode.StreamHeader{ServiceNumber: -1, File: &request})
+	}
+	if err != nil {
+		logrus.Warnf("failed to pass the %s request of %s on to listen-mode: %s", request.Direction, request.Name, err.Error())
+		_ = mode.WriteFileReply(conn, mode.FileReply{Error: fmt.Sprintf("listen-mode is not reachable: %s", err.Error())})
+		if stream != nil {
+			_ = stream.Close()
+		}
+		_ = conn.Close()
+		return
+	}
+	logrus.Infof("passed the %s request of %s on to listen-mode through yamux stream [%d].", request.Direction, request.Name, stream.StreamID())
+
+	forwarder := NewYamuxForwarder(conn, stream)
+	ym.addConnection(forwarder)
+
+	forwarder.start(ctx)
+}
+
+// AcceptFileStreams Used by listen-mode, to serve the get/put requests that spy-mode passes on until the session ends
+func (ym *YamuxStreamManager) AcceptFileStreams(serve func(stream stdio.ReadWriter, request mode.FileRequest)) {
+	for {
+		yamuxStream, err := ym.Session.AcceptStream()
+		if err != nil {
+			if !errors.Is(err, yamux.ErrSessionShutdown) {
+				logrus.Warnf("failed to accept a yamux stream: %s", err.Error())
+			}
+			return
+		}
+
+		go func() {
+			defer func() {
+				_ = yamuxStream.Close()
+			}()
+
+			header, err := receiveHeaderOf(yamuxStream)
+			if err != nil {
+				logrus.Warnf("failed to receive the header of yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+				return
+			} else if header.File == nil {
+				logrus.Warnf("refused yamux stream [%d], spy-mode only opens streams for get/put", yamuxStream.StreamID())
+				return
+			}
+			serve(yamuxStream, *header.File)
+		}()
+	}
+}
+
+// rejectStream lets listen-mode know why the stream could not be served and closes it
+func rejectStream(yamuxStream *yamux.Stream, reply mode.StreamReply) {
+	if err := mode.WriteStreamReply(yamuxStream, reply); err != nil {
+		logrus.Warnf("failed to reply to yamux stream [%d]: %s", yamuxStream.StreamID(), err.Error())
+	}
+	_ = yamuxStream.Close()
+}
+
+// classifyDialError maps the error of net.Dial to an error code that listen-mode can act upon
+func classifyDialError(err error) mode.StreamErrorCode {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return mode.StreamConnectionRefused
+	} else if errors.Is(err, syscall.ENETUNREACH) {
+		return mode.StreamNetworkUnreachable
+	} else if errors.Is(err, syscall.EHOSTUNREACH) || errors.As(err, &dnsErr) {
+		return mode.StreamHostUnreachable
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return mode.StreamTimeout
+	} else {
+		return mode.StreamGeneralFailure
+	}
+}
+
+func receiveHeaderOf(yamuxStream *yamux.Stream) (mode.StreamHeader, error) {
+	// do not let a silent stream hold onto a goroutine forever
+	err := yamuxStream.SetReadDeadline(time.Now().Add(config.Config.Transfer.RequestTimeout))
+	if err != nil {
+		return mode.StreamHeader{}, tracerr.Wrap(err)
+	}
+	defer func() {
+		_ = yamuxStream.SetReadDeadline(time.Time{})
+	}()
+
+	return mode.ReadStreamHeader(yamuxStream)
+}
+
+func (ym *YamuxStreamManager) addConnection(forwarder YamuxForwarder) {
+	ym.lock.Lock()
+	defer ym.lock.Unlock()
+
+	ym.connections = append(ym.connections, forwarder)
 }
 
 func (ym *YamuxStreamManager) Close(isRemoteInitiated bool) error {
@@ -212,10 +434,14 @@ func (ym *YamuxStreamManager) Close(isRemoteInitiated bool) error {
 		_ = ym.silencer.Close()
 	}
 
-	if err = ym.ControlStream.Close(); err != nil {
-		errs = append(errs, tracerr.Errorf("failed to close yamux control stream: %s", err.Error()))
+	// the control stream is missing if the session failed to open it
+	if ym.ControlStream != nil {
+		if err = ym.ControlStream.Close(); err != nil {
+			errs = append(errs, tracerr.Errorf("failed to close yamux control stream: %s", err.Error()))
+		}
 	}
 
+	ym.lock.Lock()
 	for i, conn := range ym.connections {
 		if err = conn.Close(); err != nil {
 			errs = append(errs, err)
@@ -223,6 +449,7 @@ func (ym *YamuxStreamManager) Close(isRemoteInitiated bool) error {
 			logrus.Debugf("yamux forwarder %d closed.", i)
 		}
 	}
+	ym.lock.Unlock()
 
 	err = ym.Session.Close()
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/codec"
 	io2 "github.com/nimatrueway/unbound-ssh/internal/io/core"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/mode/spy"
@@ -16,11 +17,12 @@ import (
 	"time"
 )
 
-func Spy() error {
-	ctx := context.Background()
+func Spy(hop string, relayCmd []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// run ssh server
-	serviceMan, err := service.NewSpyServiceManager(config.Config.Service)
+	serviceMan, err := service.NewSpyServiceManager(config.Config.Service, hop)
 	if err != nil {
 		return err
 	}
@@ -31,19 +33,38 @@ func Spy() error {
 		}
 	}()
 
+	// relay the streams of further hops through the ssh of the next hop
+	if len(relayCmd) > 0 {
+		relayState, err := spy.NewRelayState(relayCmd)
+		if err != nil {
+			return err
+		}
+		defer relayState.Close()
+		go relayState.Serve(ctx, serviceMan)
+	}
+
 	baseState, err := spy.NewBaseState()
 	defer baseState.RawSwitch.Restore()
 	if err != nil {
 		return tracerr.Wrap(err)
 	}
 
+	// get the output past the terminal multiplexer that spy-mode may run in
+	transport := codec.DetectTransport()
+	stdout := codec.PassthroughWriter(os.Stdout, transport)
+	logrus.Infof("using %s transport", transport)
+
 	// send hello message
-	fmt.Print(signature.GenerateSpyStart(signature.NewSpyStart()))
+	spyStart := signature.NewSpyStart(transport)
+	_, err = fmt.Fprint(stdout, signature.GenerateSpyStart(spyStart))
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
 	logrus.Info("Sent hello message to listener-mode")
 
 	// read first line and expect hello back message
-	success, err := expectHandshakeResponse(baseState.Stdin.BindToConcrete(ctx))
-	if !success && err == nil {
+	listenConnect, err := expectHandshakeResponse(baseState.Stdin.BindToConcrete(ctx), spyStart)
+	if listenConnect == nil && err == nil {
 		return nil
 	}
 	if err != nil {
@@ -51,7 +72,13 @@ func Spy() error {
 	}
 
 	// to connected state
-	connectedState := spy.NewConnectedState(baseState.Stdin, os.Stdout)
+	connectedState := spy.NewConnectedState(baseState.Stdin, stdout)
+	connectedState.HelloProof = signature.HelloProof(spyStart, listenConnect)
+	seal, open, err := signature.TunnelKeys(spyStart, listenConnect)
+	if err != nil {
+		return tracerr.Wrap(err)
+	}
+	connectedState.Keys = &codec.Keys{Seal: seal, Open: open}
 	err = connectedState.ListenAndServe(ctx, serviceMan)
 	if err != nil {
 		return tracerr.Wrap(err)
@@ -60,8 +87,8 @@ func Spy() error {
 	return nil
 }
 
-func expectHandshakeResponse(stdin *io2.ContextBoundReader) (success bool, err error) {
-	buffer := make([]byte, len(signature.ListenConnectFmt))
+func expectHandshakeResponse(stdin *io2.ContextBoundReader, spyStart *signature.SpyStart) (*signature.ListenConnect, error) {
+	buffer := make([]byte, 2*signature.ListenConnectLength)
 	alreadyRead := false
 
 	// interrupt the read after 3 seconds
@@ -73,25 +100,45 @@ func expectHandshakeResponse(stdin *io2.ContextBoundReader) (success bool, err e
 		}
 	}()
 
-	n, err := io.ReadAtLeast(stdin, buffer, len(signature.ListenConnectFmt))
+	// the terminal (multiplexer) may put stray bytes ahead of it, so it is read byte by byte to not consume the yamux
+	// session that follows it
+	listenConnect := &signature.ListenConnect{}
+	n := 0
+	var err error
+	for err == nil && n < len(buffer) {
+		_, err = io.ReadFull(stdin, buffer[n:n+1])
+		if err == nil {
+			n++
+			if buffer[n-1] == '}' && listenConnect.Find(string(buffer[:n])) != -1 {
+				break
+			}
+		}
+	}
 	alreadyRead = true
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			logrus.Errorf("Did not receive hello back message from listen-mode. exit.")
 			fmt.Printf("\r\nDid not receive hello back message from listen-mode. exiting...\r\n")
-			return false, nil
+			if spyStart.Transport() == config.Tmux {
+				fmt.Printf("make sure tmux passes it through: tmux set -g allow-passthrough on\r\n")
+			}
+			return nil, nil
 		} else {
 			logrus.Errorf("error reading from stdin: %s", err.Error())
-			return false, tracerr.Wrap(err)
+			return nil, tracerr.Wrap(err)
 		}
 	}
 
 	readLine := string(buffer[:n])
-	if readLine != signature.ListenConnectFmt {
-		logrus.Errorf("expected %v message from listen-mode, got %v", signature.ListenConnectFmt, readLine)
-		return false, tracerr.Errorf("expected a hello back message from listen-mode, got %s", readLine)
+	if listenConnect.Find(readLine) == -1 {
+		logrus.Errorf("expected %v message from listen-mode, got %v", signature.ListenConnectRegex, readLine)
+		return nil, tracerr.Errorf("expected a hello back message from listen-mode, got %s", readLine)
+	}
+	if err := listenConnect.Verify(spyStart); err != nil {
+		logrus.Errorf("refused listen-mode: %s", err.Error())
+		return nil, tracerr.Wrap(err)
 	}
 
 	logrus.Info("Received hello back message from listen-mode")
-	return true, nil
+	return listenConnect, nil
 }
@@ -0,0 +1,96 @@
+package view
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval keeps the status line from flooding a slow terminal
+const progressInterval = 200 * time.Millisecond
+
+// Progress is a status line that is rewritten in place as the bytes of a transfer go through Write, along with the
+// throughput and the time left once they can be told
+type Progress struct {
+	out       io.Writer
+	label     string
+	total     int64
+	done      int64
+	detail    string
+	start     time.Time
+	lastPrint time.Time
+	lock      sync.Mutex
+}
+
+// NewProgress prints the status line of a transfer of total bytes on out, total may be zero if it is unknown
+func NewProgress(out io.Writer, label string, total int64) *Progress {
+	p := &Progress{out: out, label: label, total: total, start: time.Now()}
+	p.print()
+	return p
+}
+
+func (p *Progress) Write(b []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.done += int64(len(b))
+	if time.Since(p.lastPrint) >= progressInterval {
+		p.print()
+	}
+	return len(b), nil
+}
+
+// SetDetail shows what the transfer is at next to its size, e.g. the chunk that is being sent
+func (p *Progress) SetDetail(format string, args ...any) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.detail = fmt.Sprintf(format, args...)
+	if time.Since(p.lastPrint) >= progressInterval {
+		p.print()
+	}
+}
+
+// Finish prints the final state of the status line and moves on to the next line
+func (p *Progress) Finish(summary string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.print()
+	_, _ = fmt.Fprintf(p.out, ", %s\r\n", summary)
+}
+
+func (p *Progress) print() {
+	p.lastPrint = time.Now()
+	line := fmt.Sprintf("%s: %s", p.label, FormatBytes(p.done))
+	if p.total > 0 {
+		line += fmt.Sprintf(" / %s (%d%%)", FormatBytes(p.total), p.done*100/p.total)
+	}
+	if p.detail != "" {
+		line += ", " + p.detail
+	}
+	// the rate of the first moments tells little
+	if elapsed := p.lastPrint.Sub(p.start); p.done > 0 && elapsed >= progressInterval {
+		rate := float64(p.done) / elapsed.Seconds()
+		line += fmt.Sprintf(", %s/s", FormatBytes(int64(rate)))
+		if p.total > p.done {
+			line += fmt.Sprintf(", ETA %s", time.Duration(float64(p.total-p.done)/rate*float64(time.Second)).Round(time.Second))
+		}
+	}
+	_, _ = fmt.Fprintf(p.out, "\r\033[K%s", line)
+}
+
+// FormatBytes renders a size with the largest binary unit that keeps it above 1
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -3,7 +3,11 @@ set -e
 flags="-X github.com/nimatrueway/unbound-ssh/internal/config.Version=$(git describe --tags)"
 app="unbound-ssh"
 output_dir="output"
-build_types="darwin_amd64 linux_amd64 darwin_arm64 linux_arm64"
+build_types="darwin_amd64 darwin_arm64 linux_386 linux_amd64 linux_arm linux_arm64 linux_riscv64 freebsd_amd64 freebsd_arm64"
+
+# static binaries run on musl as well as glibc, GOARM=6 covers armv6 and armv7
+export CGO_ENABLED=0
+export GOARM=6
 
 rm -f ${output_dir}/* || true
 pushd cmd
@@ -11,8 +11,9 @@ else
   read -p "would you like to continue? " -n 1 -r
 fi
 
-# build
+# build, the checksums are published along with the binaries for the binary cache of preflight to verify them
 "$SCRIPT_DIR"/build.sh
+(cd output && shasum -a 256 unbound-ssh_* > SHA256SUMS)
 
 # figure out the new version and changelog
 LATEST_TAG=$(git describe --tags --abbrev=0)
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/nimatrueway/unbound-ssh/internal/release"
+	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuto(t *testing.T) {
+	buildUnboundSsh(t)
+	bundleUnboundSsh(t)
+	c, vars := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "./unbound-ssh listen --auto sh",
+		AppConfig: `
+[preflight]
+install_dir = "$(TestWorkspaceDir)/server"
+binary_dir = "$(TestWorkspaceDir)/bundle"
+[[service]]
+type = "echo"
+bind = "unix://$(RandomSocket0)"
+`,
+	})
+
+	// preflight uploads to the server directory and spy-mode is launched from there at the first prompt
+	waitForSocket(t, vars["RandomSocket0"])
+	c.MustExpectRegex(signature.ListenConnectRegex)
+	serviceAddr := config.NewAddress("unix", vars["RandomSocket0"])
+	verifyEchoService(t, &serviceAddr)
+	verifyGracefulExit(t, c)
+}
+
+// bundleUnboundSsh puts the binary of the test workspace into a binary cache for preflight to upload, as preflight.binary_dir
+// pins it to the bundle directory
+func bundleUnboundSsh(t *testing.T) {
+	dir := filepath.Join(utils.TestWorkspaceDir(t), "bundle")
+	binary := fmt.Sprintf("unbound-ssh_%s", utils.BinaryOsArch(t))
+	require.NoError(t, os.MkdirAll(dir, 0755))
+	utils.CopyFile(t, filepath.Join(utils.TestWorkspaceDir(t), "unbound-ssh"), filepath.Join(dir, binary))
+
+	content, err := os.ReadFile(filepath.Join(dir, binary))
+	require.NoError(t, err)
+	manifest := fmt.Sprintf("%x  %s\n", sha256.Sum256(content), binary)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, release.ManifestFile), []byte(manifest), 0644))
+}
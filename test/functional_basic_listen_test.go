@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/test/utils"
 	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestShell(t *testing.T) {
-	c := utils.LaunchShell(t, fmt.Sprintf("go run ./cmd/cli.go listen -- sh"), utils.LaunchConfig{})
+	writeDefaultConfig(t)
+	c := utils.LaunchShell(t, fmt.Sprintf("go run %s/cmd/cli.go listen -- sh", utils.RootDir()), utils.LaunchConfig{})
 
 	// Test the prompt showing up
 	c.MustExpect(">")
@@ -33,8 +36,9 @@ func TestShell(t *testing.T) {
 func TestCat(t *testing.T) {
 	fileContent := "Hello World One\nHello World Two"
 	testFile := utils.TemporaryFile(t, "text_file", fileContent)
+	writeDefaultConfig(t)
 
-	c := utils.LaunchShell(t, fmt.Sprintf("go run ./cmd/cli.go listen -- cat %s", testFile.Name()), utils.LaunchConfig{})
+	c := utils.LaunchShell(t, fmt.Sprintf("go run %s/cmd/cli.go listen -- cat %s", utils.RootDir(), testFile.Name()), utils.LaunchConfig{})
 
 	output := c.MustExpectEOF()
 	consoleContent := "Hello World One\r\nHello World Two"
@@ -42,3 +46,9 @@ func TestCat(t *testing.T) {
 
 	c.MustExit(0)
 }
+
+// writeDefaultConfig leaves every option of listen-mode to its default, as it runs in the test workspace instead of the repo
+func writeDefaultConfig(t *testing.T) {
+	err := os.WriteFile(filepath.Join(utils.TestWorkspaceDir(t), "config.toml"), nil, 0644)
+	require.NoError(t, err)
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// launchTimeout covers preflight uploading the binary, the shell prompting, spy-mode starting and the handshake
+const launchTimeout = 30 * time.Second
+
+var headlessConfig = `
+[[service]]
+type = "echo"
+bind = "unix://$(RandomSocket0)"
+`
+
+func TestHeadless(t *testing.T) {
+	buildUnboundSsh(t)
+	c, vars := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "./unbound-ssh listen --headless sh",
+		AppConfig:      headlessConfig,
+		NoPrompt:       true,
+	})
+
+	// spy-mode is launched at the prompt of the shell without a keystroke
+	waitForSocket(t, vars["RandomSocket0"])
+	serviceAddr := config.NewAddress("unix", vars["RandomSocket0"])
+	verifyEchoService(t, &serviceAddr)
+
+	c.MustTerminate()
+}
+
+func TestStdio(t *testing.T) {
+	buildUnboundSsh(t)
+	c, vars := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "./unbound-ssh listen --stdio unix://$(RandomSocket0) sh",
+		AppConfig:      headlessConfig,
+		NoPrompt:       true,
+	})
+
+	// stdin/stdout of listen-mode is piped to the echo service once it is up
+	waitForSocket(t, vars["RandomSocket0"])
+	c.MustSend("hello\n")
+	c.MustExpect("received: hello")
+
+	// listen-mode ends with its stdin
+	c.MustSend("\004")
+	c.MustExit(0)
+}
+
+// buildUnboundSsh builds the binary into the test workspace, so that the default launch command of spy-mode finds it
+func buildUnboundSsh(t *testing.T) {
+	cmd := exec.Command("go", "build", "-o", filepath.Join(utils.TestWorkspaceDir(t), "unbound-ssh"), "./cmd")
+	cmd.Dir = utils.RootDir()
+	utils.RunCmd(t, cmd)
+}
+
+func waitForSocket(t *testing.T, socket string) {
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	}, launchTimeout, 25*time.Millisecond)
+}
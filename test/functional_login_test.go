@@ -0,0 +1,87 @@
+package test
+
+import (
+	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bastionFixture asks for a host, a password and a verification code, like a bastion with mfa, and only gets to the
+// shell if all three are right
+const bastionFixture = `#!/bin/sh
+printf 'Choose a host: '
+read host
+printf 'Password: '
+stty -echo
+read password
+stty echo
+echo
+printf 'Verification code: '
+read code
+if [ "$host" = 2 ] && [ "$password" = "s3cret pass" ] && [ "$code" = 123456 ]; then
+  echo "welcome to host $host"
+  exec sh
+fi
+echo "access denied"
+exit 1
+`
+
+func TestLoginScript(t *testing.T) {
+	writeBastionFixture(t)
+	t.Setenv("UNBOUND_SSH_TEST_PASSWORD", "s3cret pass")
+	c, _ := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "go run $(RootDir)/cmd/cli.go listen -- sh bastion.sh",
+		AppConfig: `
+[[login]]
+expect = 'Choose a host: $'
+send = "2\r"
+[[login]]
+expect = 'Password: $'
+send_env = "UNBOUND_SSH_TEST_PASSWORD"
+[[login]]
+expect = 'Verification code: $'
+send_command = ["echo", "123456"]
+`,
+	})
+
+	// the prompt of the shell only shows up if every step typed the right answer
+	c.MustSend("exit\n")
+	c.MustExpectEOF()
+	c.MustExit(0)
+}
+
+func TestLoginScriptTimeout(t *testing.T) {
+	writeBastionFixture(t)
+	c, _ := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "go run $(RootDir)/cmd/cli.go listen -- sh bastion.sh",
+		AppConfig: `
+[[login]]
+expect = 'Choose a host: $'
+send = "2\r"
+[[login]]
+expect = 'Passcode: $'
+timeout = "500ms"
+`,
+		NoPrompt: true,
+	})
+
+	// the script gives up on the step that does not match, and the user can take over
+	c.MustExpect("Password: ")
+	c.MustExpect("login script failed")
+	c.MustExpect("step 2 did not see \"Passcode: $\" in 500ms")
+	c.MustSend("s3cret pass\r")
+	c.MustExpect("Verification code: ")
+	c.MustSend("654321\r")
+	c.MustExpect("access denied")
+	c.MustExpectEOF()
+	c.MustExit(0)
+}
+
+func writeBastionFixture(t *testing.T) {
+	err := os.WriteFile(filepath.Join(utils.TestWorkspaceDir(t), "bastion.sh"), []byte(bastionFixture), 0755)
+	require.NoError(t, err)
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
+	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const DownloadSize = 256 * 1024
+
+func TestFileDownloadAlpine(t *testing.T) {
+	testDownload(t, generateContainerizedShell(t))
+}
+
+func TestFileDownloadLocal(t *testing.T) {
+	testDownload(t, "sh")
+}
+
+func testDownload(t *testing.T, shellCmd string) {
+	ctx := context.Background()
+	c, _ := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: shellCmd,
+	})
+
+	// probe *nix capabilities, downloader relies on it
+	probe := utils.SendAndMustExpect[*listen.NixProbeResult](c)(listen.GeneratePrintNixProbe())
+
+	// random data that spans several chunks, the downloader verifies its hash
+	filename := "test.bin"
+	shell := listen.NewShellExecutor(c.CtxReader, c.Writer)
+	shell.DefaultTimeout = utils.AssertionTimeout
+	_, err := shell.Execute(ctx, fmt.Sprintf("head -c %d /dev/urandom > %s", DownloadSize, filename), nil)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	saved, err := listen.DownloadAndSave(ctx, shell, filename, dir, probe, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, filename), saved)
+	stat, err := os.Stat(saved)
+	require.NoError(t, err)
+	require.Equal(t, int64(DownloadSize), stat.Size())
+
+	c.MustExpect(utils.ShellPrompt)
+	c.MustSend("\004") // ctrl+d
+	c.MustExpectEOF()
+	c.MustExit(0)
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
+	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const historyMarker = "unbound-ssh history marker"
+
+func TestPreflightShellBash(t *testing.T) {
+	testShellDialect(t, "bash --norc --noprofile -i", "bash", true)
+}
+
+func TestPreflightShellDash(t *testing.T) {
+	testShellDialect(t, "dash -i", "dash", true)
+}
+
+func TestPreflightShellZsh(t *testing.T) {
+	testShellDialect(t, "zsh -f -i", "zsh", true)
+}
+
+// busybox ash picks its history file when it starts and saves every line there, it can not be stopped
+func TestPreflightShellBusyBoxAsh(t *testing.T) {
+	testShellDialect(t, "busybox ash -i", "busybox", false)
+}
+
+func TestPreflightShellFish(t *testing.T) {
+	testShellDialect(t, "fish --no-config -i", "fish", true)
+}
+
+func TestPreflightShellTcsh(t *testing.T) {
+	testShellDialect(t, "tcsh -f -i", "tcsh", true)
+}
+
+// testShellDialect runs commands of preflight in a local shell, which must be detected as the given name
+func testShellDialect(t *testing.T, shellCmd string, name string, suppressesHistory bool) {
+	if _, err := exec.LookPath(strings.Fields(shellCmd)[0]); err != nil {
+		t.Skipf("%s is not installed", strings.Fields(shellCmd)[0])
+	}
+
+	// the shells keep their history in the test workspace
+	dir := utils.TestWorkspaceDir(t)
+	t.Setenv("HISTFILE", filepath.Join(dir, "history"))
+	t.Setenv("SAVEHIST", "100") // zsh does not save history otherwise
+	t.Setenv("XDG_DATA_HOME", dir)
+
+	ctx := context.Background()
+	c := utils.LaunchShell(t, shellCmd, utils.LaunchConfig{WorkDir: dir})
+	shell := listen.NewShellExecutor(c.CtxReader, c.Writer)
+	shell.DefaultTimeout = utils.AssertionTimeout
+
+	probe, err := listen.Execute[*listen.ShellProbeResult](ctx, shell, nil)(listen.GeneratePrintShellProbe())
+	require.NoError(t, err)
+	require.Equal(t, name, probe.Name())
+
+	restore, err := listen.PrepareShell(ctx, shell)
+	require.NoError(t, err)
+
+	// pipes, quotes and exit codes work the same in every shell
+	res, err := shell.Execute(ctx, `echo "`+historyMarker+`" | tr a-z A-Z`, nil)
+	require.NoError(t, err)
+	require.Equal(t, strings.ToUpper(historyMarker), res.Output)
+	_, err = shell.Execute(ctx, "exit 3", nil)
+	require.ErrorContains(t, err, "exit code 3")
+	nixProbe, err := listen.Execute[*listen.NixProbeResult](ctx, shell, nil)(listen.GeneratePrintNixProbe())
+	require.NoError(t, err)
+	require.NotEmpty(t, nixProbe.Platform().Os())
+
+	restore()
+	c.MustSend("exit\n")
+	c.MustExit(0)
+
+	if !suppressesHistory {
+		return
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(content), historyMarker, "history saved in %s", path)
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -1,33 +1,67 @@
 package test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
 	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
+	"github.com/nimatrueway/unbound-ssh/internal/view"
 	"github.com/nimatrueway/unbound-ssh/test/utils"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const UploadSize = 1 * 1024 * 1024
 
 func TestFileUploadAlpineBase64(t *testing.T) {
-	testUpload(t, generateContainerizedShell(t), config.Base64)
+	testUpload(t, generateContainerizedShell(t), config.Base64, config.Dd)
 }
 
 func TestFileUploadAlpineGzipBase64(t *testing.T) {
-	testUpload(t, generateContainerizedShell(t), config.GzipBase64)
+	testUpload(t, generateContainerizedShell(t), config.GzipBase64, config.Dd)
 }
 
 func TestFileUploadAlpineAscii85(t *testing.T) {
-	testUpload(t, generateContainerizedShell(t), config.Ascii85)
+	testUpload(t, generateContainerizedShell(t), config.Ascii85, config.Dd)
 }
 
 func TestFileUploadAlpineGzipAscii85(t *testing.T) {
-	testUpload(t, generateContainerizedShell(t), config.GzipAscii85)
+	testUpload(t, generateContainerizedShell(t), config.GzipAscii85, config.Dd)
+}
+
+func TestFileUploadAlpineHead(t *testing.T) {
+	testUpload(t, generateContainerizedShell(t), config.GzipBase64, config.Head)
+}
+
+func TestFileUploadAlpinePrintf(t *testing.T) {
+	testUpload(t, generateContainerizedShell(t), config.GzipAscii85, config.Printf)
+}
+
+func TestFileUploadLocalDd(t *testing.T) {
+	testUpload(t, "sh", config.GzipBase64, config.Dd)
+}
+
+func TestFileUploadLocalHead(t *testing.T) {
+	testUpload(t, "sh", config.GzipBase64, config.Head)
+}
+
+func TestFileUploadLocalPython3(t *testing.T) {
+	testUpload(t, "sh", config.GzipBase64, config.Python3)
+}
+
+// ascii85 puts quotes in the lines of printf
+func TestFileUploadLocalPrintf(t *testing.T) {
+	testUpload(t, "sh", config.GzipAscii85, config.Printf)
 }
 
 func generateContainerizedShell(t *testing.T) string {
@@ -42,7 +76,7 @@ func generateContainerizedShell(t *testing.T) string {
 	return shellCmd
 }
 
-func testUpload(t *testing.T, shellCmd string, transferEnc config.PreflightUploadCodec) {
+func testUpload(t *testing.T, shellCmd string, transferEnc config.PreflightUploadCodec, method config.PreflightUploadMethod) {
 	ctx := context.Background()
 	c, _ := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
 		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
@@ -51,6 +85,16 @@ func testUpload(t *testing.T, shellCmd string, transferEnc config.PreflightUploa
 
 	// probe *nix capabilities, uploader relies on it
 	listen.GlobalProbeResult = utils.SendAndMustExpect[*listen.NixProbeResult](c)(listen.GeneratePrintNixProbe())
+	probe := listen.GlobalProbeResult
+	supported := map[config.PreflightUploadMethod]bool{
+		config.Dd:      probe.HasStty() && probe.HasDdFullblock(),
+		config.Head:    probe.HasStty() && probe.HasHeadBytes(),
+		config.Python3: probe.HasStty() && probe.HasPython3(),
+		config.Printf:  true,
+	}
+	if !supported[method] || (transferEnc == config.Ascii85 || transferEnc == config.GzipAscii85) && !probe.HasPython3() {
+		t.Skipf("the shell does not support uploading %s with %s", transferEnc, method)
+	}
 
 	// dummy data to verify later
 	buf := make([]byte, UploadSize)
@@ -61,11 +105,99 @@ func testUpload(t *testing.T, shellCmd string, transferEnc config.PreflightUploa
 	filename := "test.bin"
 	shell := listen.NewShellExecutor(c.CtxReader, c.Writer)
 	shell.DefaultTimeout = utils.AssertionTimeout
-	err := listen.Upload(ctx, shell, string(buf), filename, transferEnc)
+	var status bytes.Buffer
+	progress := view.NewProgress(&status, filename, UploadSize)
+	err := listen.Upload(ctx, shell, string(buf), filename, transferEnc, method, progress)
+	require.NoError(t, err)
+	progress.Finish("verified")
+	require.Contains(t, status.String(), fmt.Sprintf("%s: 1.0 MiB / 1.0 MiB (100%%), sent as", filename))
+	require.Contains(t, status.String(), fmt.Sprintf("of %s", transferEnc))
+
+	c.MustExpect(utils.ShellPrompt)
+	c.MustSend("\004") // ctrl+d
+	c.MustExpectEOF()
+	c.MustExit(0)
+}
+
+func TestFileUploadLocalResume(t *testing.T) {
+	chunkSize := config.Config.Preflight.UploadChunkSize
+	config.Config.Preflight.UploadChunkSize = 4096
+	t.Cleanup(func() {
+		config.Config.Preflight.UploadChunkSize = chunkSize
+	})
+	logs := logrustest.NewGlobal()
+	c, _ := utils.LaunchAndConnect(t, utils.UnboundSshLaunchConfig{
+		LaunchConfig:   utils.LaunchConfig{WorkDir: "$(TestWorkspaceDir)"},
+		ListenShellCmd: "sh",
+	})
+	listen.GlobalProbeResult = utils.SendAndMustExpect[*listen.NixProbeResult](c)(listen.GeneratePrintNixProbe())
+	if probe := listen.GlobalProbeResult; !probe.HasStty() || !probe.HasDdFullblock() {
+		t.Skip("the shell does not support uploading with dd")
+	}
+	shell := listen.NewShellExecutor(c.CtxReader, c.Writer)
+	shell.DefaultTimeout = utils.AssertionTimeout
+
+	// 10 chunks of base64, 3072 bytes of content each
+	content := make([]byte, 10*3072)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+	interruptUpload(t, shell, content, 4)
+	chunks, err := filepath.Glob(filepath.Join(utils.TestWorkspaceDir(t), "test.bin_chunk_*.tmp"))
 	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(chunks), 4)
+
+	// the chunks that made it are not sent again
+	err = listen.Upload(context.Background(), shell, string(content), "test.bin", config.Base64, config.Dd, nil)
+	require.NoError(t, err)
+	require.True(t, lo.ContainsBy(logs.AllEntries(), func(entry *logrus.Entry) bool {
+		return entry.Message == fmt.Sprintf("resumed the upload of test.bin, %d of 10 chunks were on the server already.", len(chunks))
+	}))
+
+	// a smaller file of the same name does not pick up the chunks that the interrupted upload left after its end
+	interruptUpload(t, shell, content, 4)
+	err = listen.Upload(context.Background(), shell, string(content[:2*3072]), "test.bin", config.Base64, config.Dd, nil)
+	require.NoError(t, err)
+	uploaded, err := os.ReadFile(filepath.Join(utils.TestWorkspaceDir(t), "test.bin"))
+	require.NoError(t, err)
+	require.Equal(t, content[:2*3072], uploaded)
+	chunks, err = filepath.Glob(filepath.Join(utils.TestWorkspaceDir(t), "test.bin_chunk_*.tmp"))
+	require.NoError(t, err)
+	require.Empty(t, chunks)
 
 	c.MustExpect(utils.ShellPrompt)
 	c.MustSend("\004") // ctrl+d
 	c.MustExpectEOF()
 	c.MustExit(0)
 }
+
+// interruptUpload uploads content from a fifo as test.bin, and cancels the upload once the given number of chunks are
+// on the server while the fifo holds back the rest
+func interruptUpload(t *testing.T, shell *listen.ShellExecutor, content []byte, chunks int) {
+	fifo := filepath.Join(t.TempDir(), "source")
+	require.NoError(t, syscall.Mkfifo(fifo, 0600))
+	go func() {
+		writer, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		_, _ = writer.Write(content[:(chunks+1)*3072])
+		// the upload is canceled before the rest is needed
+		<-time.After(utils.AssertionTimeout)
+		_ = writer.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		for wait := utils.AssertionTimeout; wait > 0; wait -= 25 * time.Millisecond {
+			written, _ := filepath.Glob(filepath.Join(utils.TestWorkspaceDir(t), "test.bin_chunk_*.tmp"))
+			if len(written) >= chunks {
+				return
+			}
+			time.Sleep(25 * time.Millisecond)
+		}
+	}()
+	err := listen.ReadFileAndUpload(ctx, shell, fifo, "test.bin", config.Base64, config.Dd, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"os/exec"
 	"regexp"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -34,6 +35,10 @@ type Console struct {
 
 func (c *Console) MustExpectEOF() string {
 	output, err := c.expect(nil)
+	// linux fails the reads of the pty master with EIO instead, once its slave side is closed
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
 	require.Equal(c.t, io.EOF, err)
 	return output
 }
@@ -118,3 +123,10 @@ func (c *Console) MustExit(code int) {
 		c.t.Fatalf("timed out waiting for process to exit")
 	}
 }
+
+// MustTerminate ends a process that takes no keystrokes, e.g. a headless listen-mode
+func (c *Console) MustTerminate() {
+	err := c.cmd.Process.Signal(syscall.SIGTERM)
+	require.NoError(c.t, err)
+	c.MustExit(-1)
+}
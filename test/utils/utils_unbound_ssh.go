@@ -7,6 +7,7 @@ import (
 	"github.com/creack/pty"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
 	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/fs"
@@ -38,6 +39,8 @@ type UnboundSshLaunchConfig struct {
 	ListenShellCmd string
 	SpyLaunchCmd   string
 	AppConfig      string
+	// NoPrompt leaves the output of the shell to the test, e.g. as headless listen-mode drops it
+	NoPrompt bool
 }
 
 var LocalIsolated = UnboundSshLaunchConfig{
@@ -95,7 +98,7 @@ func LaunchAndConnect(t *testing.T, testConfig UnboundSshLaunchConfig) (*Console
 	variables["BinaryExec"] = fmt.Sprintf("unbound-ssh_%s", BinaryOsArch(t))
 	variables["ShellPrompt"] = ShellPrompt
 
-	if testConfig.SpyLaunchCmd != "" {
+	if testConfig.SpyLaunchCmd != "" || testConfig.NoPrompt {
 		createLogFilePair(t)
 	}
 
@@ -109,6 +112,9 @@ func LaunchAndConnect(t *testing.T, testConfig UnboundSshLaunchConfig) (*Console
 
 	// Launch the listen-mode
 	c := LaunchShell(t, substituteVars(testConfig.ListenShellCmd, variables), testConfig.LaunchConfig)
+	if testConfig.NoPrompt {
+		return c, variables
+	}
 	// Test the prompt showing up
 	c.MustExpect(ShellPrompt)
 
@@ -121,7 +127,7 @@ func LaunchAndConnect(t *testing.T, testConfig UnboundSshLaunchConfig) (*Console
 		c.MustExpectRegex(signature.SpyStartRegex)
 
 		// Test listen-mode completing handshake
-		c.MustExpect(signature.ListenConnectFmt)
+		c.MustExpectRegex(signature.ListenConnectRegex)
 	}
 
 	return c, variables
@@ -136,11 +142,8 @@ func LaunchShell(t *testing.T, command string, conf LaunchConfig) *Console {
 	cmd.Stdin = tty
 	cmd.Stdout = tty
 	cmd.Stderr = tty
-	if conf.WorkDir != "" {
-		cmd.Dir = conf.WorkDir
-	} else {
-		cmd.Dir = RootDir()
-	}
+	// listen-mode writes its secret, log and ctl socket into the working directory, which must never be the repo
+	cmd.Dir = lo.Ternary(conf.WorkDir != "", conf.WorkDir, TestWorkspaceDir(t))
 	cmd.Env = append(os.Environ(), fmt.Sprintf("PS1=%s", ShellPrompt))
 
 	err = cmd.Start()
@@ -5,7 +5,9 @@ import (
 	"context"
 	"fmt"
 	"github.com/nimatrueway/unbound-ssh/internal/config"
+	"github.com/nimatrueway/unbound-ssh/internal/io/codec"
 	"github.com/nimatrueway/unbound-ssh/internal/io/core"
+	"github.com/nimatrueway/unbound-ssh/internal/io/signature"
 	"github.com/nimatrueway/unbound-ssh/internal/mode/listen"
 	"github.com/nimatrueway/unbound-ssh/internal/mode/spy"
 	"github.com/nimatrueway/unbound-ssh/internal/service"
@@ -35,16 +37,25 @@ func TestYamuxManagerEchoService(t *testing.T) {
 		clientConn = DoNotCloseConnection(clientConn)
 		serverConn = DoNotCloseConnection(serverConn)
 
+		// the tunnel is encrypted with the keys of a handshake
+		spyStart := signature.NewSpyStart(config.Raw)
+		listenConnect := signature.NewListenConnect(spyStart)
+		spySeal, spyOpen, err := signature.TunnelKeys(spyStart, listenConnect)
+		require.NoError(t, err)
+		listenSeal, listenOpen, err := signature.ListenTunnelKeys(spyStart, listenConnect)
+		require.NoError(t, err)
+
 		group := errgroup.Group{}
 		listenCtx, stopper := context.WithCancel(context.Background())
 
 		// mimic listen-mode
 		group.Go(func() error {
-			serviceManager, err := service.NewListenServiceManager(services)
+			serviceManager, err := service.NewListenServiceManager(services, "")
 			require.NoError(t, err)
 
 			ctxReader := core.NewContextReader(clientConn)
 			mode := listen.CreateConnectedState(ctxReader, clientConn)
+			mode.Keys = &codec.Keys{Seal: listenSeal, Open: listenOpen}
 			err = mode.ListenAndServe(listenCtx, serviceManager)
 			require.NoError(t, err)
 
@@ -58,10 +69,11 @@ func TestYamuxManagerEchoService(t *testing.T) {
 
 		// mimic spy-mode
 		group.Go(func() error {
-			serviceManager, err := service.NewSpyServiceManager(services)
+			serviceManager, err := service.NewSpyServiceManager(services, "")
 			require.NoError(t, err)
 
 			mode := spy.NewConnectedState(core.NewContextReader(serverConn), serverConn)
+			mode.Keys = &codec.Keys{Seal: spySeal, Open: spyOpen}
 			err = mode.ListenAndServe(context.Background(), serviceManager)
 			require.NoError(t, err)
 